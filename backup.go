@@ -0,0 +1,228 @@
+package brsp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type BackupCommand struct {
+	client *Client
+	opt    *BackupCommandOption
+}
+
+type BackupCommandOption struct {
+	commandOption
+	Kinds             []string `default:"parameters,secrets" enum:"parameters,secrets,appconfig,lambda,vault" help:"kinds of items to capture into the snapshot"`
+	TargetRegion      string   `help:"target region"`
+	BucketName        string   `help:"bucket name"`
+	KeyPrefix         string   `help:"key prefix; each snapshot is written under <key-prefix>/<snapshot-id>/"`
+	DataKeyBucketName string   `help:"data key bucket name"`
+	DataKeyKey        string   `help:"data key key"`
+	KmsKey            string   `help:"KMS key for encryption"`
+	BackupObjectOption
+	VaultOption
+	VaultPaths []string `help:"path prefixes of the Vault secrets to capture, relative to --vault-mount (all secrets if empty)"`
+
+	FetchConcurrency      int     `default:"4" help:"number of concurrent fetches per kind"`
+	DescribeParametersTps float64 `default:"5" help:"maximum DescribeParameters calls per second (0 for unlimited)"`
+	GetParametersTps      float64 `default:"10" help:"maximum GetParameters calls per second (0 for unlimited)"`
+	ListSecretsTps        float64 `default:"5" help:"maximum ListSecrets calls per second (0 for unlimited)"`
+	GetSecretValueTps     float64 `default:"10" help:"maximum GetSecretValue/BatchGetSecretValue calls per second (0 for unlimited)"`
+	AppConfigTps          float64 `default:"5" help:"maximum AppConfig calls per second (0 for unlimited)"`
+	ListFunctionsTps      float64 `default:"5" help:"maximum ListFunctions calls per second (0 for unlimited)"`
+}
+
+// NewBackupCommandOption returns options set to the CLI defaults.
+func NewBackupCommandOption() *BackupCommandOption {
+	return withDefaults(&BackupCommandOption{})
+}
+
+// snapshotManifest is written next to the backups of a snapshot and, once
+// they are all written, at <key-prefix>/latest.
+type snapshotManifest struct {
+	SnapshotID string                  `json:"snapshotId"`
+	CreatedAt  time.Time               `json:"createdAt"`
+	Kinds      map[string]snapshotKind `json:"kinds"`
+}
+
+type snapshotKind struct {
+	Key   string `json:"key"`
+	Items int    `json:"items"`
+}
+
+// snapshotSource captures the items of one kind into a backup document,
+// adding the items it skips to report.
+type snapshotSource func(ctx context.Context, c *BackupCommand, report *Report) (backupDocument, error)
+
+// snapshotSources are the kinds a snapshot can capture.
+var snapshotSources = map[string]snapshotSource{
+	"parameters": func(ctx context.Context, c *BackupCommand, report *Report) (backupDocument, error) {
+		opt := NewBackupParametersCommandOption()
+		opt.OnMissing = "skip"
+		opt.Concurrency = c.opt.FetchConcurrency
+		opt.DescribeParametersTps = c.opt.DescribeParametersTps
+		opt.GetParametersTps = c.opt.GetParametersTps
+		parameters, skipped, err := c.client.backupParametersCommand(opt).fetchParameters(ctx)
+		if err != nil {
+			return backupDocument{}, err
+		}
+		for _, name := range skipped {
+			report.add(ReportItem{Source: name, Action: ReportActionSkip, Reason: "disappeared or is invalid"})
+		}
+		return newParametersDocument(parameters), nil
+	},
+	"secrets": func(ctx context.Context, c *BackupCommand, report *Report) (backupDocument, error) {
+		opt := NewBackupSecretsCommandOption()
+		opt.Concurrency = c.opt.FetchConcurrency
+		opt.ListSecretsTps = c.opt.ListSecretsTps
+		opt.GetSecretValueTps = c.opt.GetSecretValueTps
+		secrets, err := c.client.backupSecretsCommand(opt).fetchSecrets(ctx)
+		if err != nil {
+			return backupDocument{}, err
+		}
+		return newSecretsDocument(secrets), nil
+	},
+	"appconfig": func(ctx context.Context, c *BackupCommand, report *Report) (backupDocument, error) {
+		opt := NewBackupAppConfigCommandOption()
+		opt.Concurrency = c.opt.FetchConcurrency
+		opt.AppConfigTps = c.opt.AppConfigTps
+		configurations, err := c.client.backupAppConfigCommand(opt).fetchHostedConfigurations(ctx)
+		if err != nil {
+			return backupDocument{}, err
+		}
+		return newAppConfigDocument(configurations), nil
+	},
+	"lambda": func(ctx context.Context, c *BackupCommand, report *Report) (backupDocument, error) {
+		opt := NewBackupLambdaCommandOption()
+		opt.ListFunctionsTps = c.opt.ListFunctionsTps
+		variables, err := c.client.backupLambdaCommand(opt).fetchEnvironmentVariables(ctx)
+		if err != nil {
+			return backupDocument{}, err
+		}
+		return newLambdaDocument(variables), nil
+	},
+	"vault": func(ctx context.Context, c *BackupCommand, report *Report) (backupDocument, error) {
+		opt := NewBackupVaultCommandOption()
+		opt.VaultOption = c.opt.VaultOption
+		opt.VaultPaths = c.opt.VaultPaths
+		opt.Concurrency = c.opt.FetchConcurrency
+		entries, err := c.client.backupVaultCommand(opt).fetchVaultEntries(ctx)
+		if err != nil {
+			return backupDocument{}, err
+		}
+		return newVaultDocument(entries)
+	},
+}
+
+func NewBackupCommand(ctx context.Context, opt *BackupCommandOption) (*BackupCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aws config, %v", err)
+	}
+	targetAwsConfig, err := getTargetAwsConfig(ctx, opt.TargetRegion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target aws config, %v", err)
+	}
+	return NewClient(awsConfig, targetAwsConfig).backupCommand(opt), nil
+}
+
+func (c *Client) backupCommand(opt *BackupCommandOption) *BackupCommand {
+	return &BackupCommand{client: c, opt: opt}
+}
+
+// Run captures every kind first and writes the backups only when all of them
+// were read, so that a snapshot is either complete or not written at all.
+func (c *BackupCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("backup")
+	if err := c.opt.BackupObjectOption.preflight(ctx, c.client.S3, c.opt.BucketName); err != nil {
+		return report, err
+	}
+	now := time.Now().UTC()
+	snapshotID, err := newSnapshotID(now)
+	if err != nil {
+		return report, err
+	}
+	manifest := snapshotManifest{SnapshotID: snapshotID, CreatedAt: now, Kinds: map[string]snapshotKind{}}
+
+	docs := map[string]backupDocument{}
+	for _, kind := range c.opt.Kinds {
+		source, ok := snapshotSources[kind]
+		if !ok {
+			return report, fmt.Errorf("unknown kind: %s", kind)
+		}
+		doc, err := source(ctx, c, report)
+		if err != nil {
+			return report, fmt.Errorf("failed to capture %s, %v", kind, err)
+		}
+		doc.SnapshotID = snapshotID
+		doc.CreatedAt = aws.Time(manifest.CreatedAt)
+		docs[kind] = doc
+	}
+
+	dataKey, err := getDataKey(ctx, c.client.KMS, c.client.S3, c.opt.DataKeyBucketName, c.opt.DataKeyKey)
+	if err != nil {
+		return report, err
+	}
+	for _, kind := range c.opt.Kinds {
+		doc := docs[kind]
+		key := path.Join(c.opt.KeyPrefix, snapshotID, kind)
+		body, err := json.Marshal(doc)
+		if err != nil {
+			return report, err
+		}
+		if err := writeBackup(ctx, c.client.S3, c.opt.BucketName, key, dataKey, body, c.opt.BackupObjectOption); err != nil {
+			return report, err
+		}
+		manifest.Kinds[kind] = snapshotKind{Key: key, Items: len(doc.Items)}
+		for _, item := range doc.Items {
+			report.add(ReportItem{Source: item.Name, Target: key, Action: ReportActionBackup})
+		}
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return report, err
+	}
+	for _, key := range []string{path.Join(c.opt.KeyPrefix, snapshotID, "snapshot"), path.Join(c.opt.KeyPrefix, "latest")} {
+		if err := writeBackup(ctx, c.client.S3, c.opt.BucketName, key, dataKey, body, c.opt.BackupObjectOption); err != nil {
+			return report, err
+		}
+	}
+	slog.Info("took a snapshot", "snapshotId", snapshotID, "kinds", c.opt.Kinds)
+	return report, nil
+}
+
+// newSnapshotID returns an ID that sorts by the time the snapshot was taken.
+func newSnapshotID(now time.Time) (string, error) {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return now.Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix), nil
+}
+
+// loadSnapshotManifest reads the manifest of snapshotID under keyPrefix, or
+// of the latest snapshot if snapshotID is "latest" or empty.
+func loadSnapshotManifest(ctx context.Context, s3Client S3API, bucket string, keyPrefix string, snapshotID string, dataKey []byte) (snapshotManifest, error) {
+	var manifest snapshotManifest
+	key := path.Join(keyPrefix, "latest")
+	if snapshotID != "" && snapshotID != "latest" {
+		key = path.Join(keyPrefix, snapshotID, "snapshot")
+	}
+	payload, err := readBackupPayload(ctx, s3Client, bucket, key, dataKey)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read snapshot %s, %v", key, err)
+	}
+	if err := json.Unmarshal(payload, &manifest); err != nil || manifest.SnapshotID == "" {
+		return manifest, fmt.Errorf("%s is not a snapshot manifest", key)
+	}
+	return manifest, nil
+}
@@ -0,0 +1,256 @@
+package brsp
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+type BackupAllCommand struct {
+	awsConfig       aws.Config
+	targetAwsConfig aws.Config
+	s3Client        S3API
+	opt             *BackupAllCommandOption
+	// sourceClient returns the client that backs up target.
+	sourceClient func(ctx context.Context, target backupTarget) (*Client, error)
+}
+
+type BackupAllCommandOption struct {
+	commandOption
+	Accounts          []string `help:"IAM role ARNs to assume, one per account (use current credentials if empty)"`
+	Regions           []string `required:"" help:"regions to back up"`
+	Kinds             []string `default:"parameters,secrets" enum:"parameters,secrets,appconfig,lambda" help:"kinds of backups to take"`
+	TargetRegion      string   `help:"target region"`
+	BucketName        string   `help:"bucket name"`
+	KeyPrefix         string   `help:"key prefix; each backup is written to <key-prefix>/<account>/<region>/<kind>"`
+	DataKeyBucketName string   `help:"data key bucket name"`
+	DataKeyKey        string   `help:"data key key"`
+	BackupObjectOption
+	BackupGenerationOption
+	Concurrency int `default:"4" help:"number of backups to run concurrently"`
+
+	FetchConcurrency      int     `default:"4" help:"number of concurrent fetches within each backup"`
+	DescribeParametersTps float64 `default:"5" help:"maximum DescribeParameters calls per second per backup (0 for unlimited)"`
+	GetParametersTps      float64 `default:"10" help:"maximum GetParameters calls per second per backup (0 for unlimited)"`
+	ListSecretsTps        float64 `default:"5" help:"maximum ListSecrets calls per second per backup (0 for unlimited)"`
+	GetSecretValueTps     float64 `default:"10" help:"maximum GetSecretValue/BatchGetSecretValue calls per second per backup (0 for unlimited)"`
+	AppConfigTps          float64 `default:"5" help:"maximum AppConfig calls per second per backup (0 for unlimited)"`
+	ListFunctionsTps      float64 `default:"5" help:"maximum ListFunctions calls per second per backup (0 for unlimited)"`
+}
+
+// NewBackupAllCommandOption returns options set to the CLI defaults.
+func NewBackupAllCommandOption() *BackupAllCommandOption {
+	return withDefaults(&BackupAllCommandOption{})
+}
+
+type backupTarget struct {
+	RoleArn string
+	Account string
+	Region  string
+	Kind    string
+	Key     string
+}
+
+func NewBackupAllCommand(ctx context.Context, opt *BackupAllCommandOption) (*BackupAllCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aws config, %v", err)
+	}
+	targetAwsConfig, err := getTargetAwsConfig(ctx, opt.TargetRegion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target aws config, %v", err)
+	}
+	c := &BackupAllCommand{
+		awsConfig:       awsConfig,
+		targetAwsConfig: targetAwsConfig,
+		s3Client:        s3.NewFromConfig(targetAwsConfig),
+		opt:             opt,
+	}
+	c.sourceClient = c.newSourceClient
+	return c, nil
+}
+
+func (c *BackupAllCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("backup-all")
+	if err := c.opt.BackupObjectOption.preflight(ctx, c.s3Client, c.opt.BucketName); err != nil {
+		return report, err
+	}
+	targets, err := c.targets(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	concurrency := c.opt.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	items := make([]ReportItem, len(targets))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if ctx.Err() != nil {
+				items[i] = ReportItem{
+					Source: path.Join(target.Account, target.Region, target.Kind),
+					Target: target.Key,
+					Action: ReportActionSkip,
+					Reason: "not started before the interruption",
+				}
+				return
+			}
+			start := time.Now()
+			targetReport, err := c.backup(ctx, target)
+			items[i] = ReportItem{
+				Source:   path.Join(target.Account, target.Region, target.Kind),
+				Target:   target.Key,
+				Action:   ReportActionBackup,
+				Error:    errorString(err),
+				Duration: time.Since(start),
+			}
+			if targetReport != nil {
+				items[i].Reason = fmt.Sprintf("%d items", len(targetReport.Items))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, item := range items {
+		report.add(item)
+	}
+	if err := ctx.Err(); err != nil {
+		return report, fmt.Errorf("backup-all interrupted, %w", err)
+	}
+	if failed := report.Failed(); failed > 0 {
+		return report, fmt.Errorf("%d of %d backups failed", failed, len(items))
+	}
+	return report, nil
+}
+
+// targets expands accounts × regions × kinds into the list of backups to take.
+func (c *BackupAllCommand) targets(ctx context.Context) ([]backupTarget, error) {
+	roleArns := c.opt.Accounts
+	if len(roleArns) == 0 {
+		roleArns = []string{""}
+	}
+
+	targets := []backupTarget{}
+	for _, roleArn := range roleArns {
+		account, err := c.accountID(ctx, roleArn)
+		if err != nil {
+			return nil, err
+		}
+		for _, region := range c.opt.Regions {
+			for _, kind := range c.opt.Kinds {
+				targets = append(targets, backupTarget{
+					RoleArn: roleArn,
+					Account: account,
+					Region:  region,
+					Kind:    kind,
+					Key:     path.Join(c.opt.KeyPrefix, account, region, kind),
+				})
+			}
+		}
+	}
+	return targets, nil
+}
+
+func (c *BackupAllCommand) accountID(ctx context.Context, roleArn string) (string, error) {
+	if roleArn != "" {
+		parsed, err := arn.Parse(roleArn)
+		if err != nil {
+			return "", fmt.Errorf("invalid role arn %s, %v", roleArn, err)
+		}
+		return parsed.AccountID, nil
+	}
+	output, err := sts.NewFromConfig(c.awsConfig).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller identity, %v", err)
+	}
+	return *output.Account, nil
+}
+
+func (c *BackupAllCommand) newSourceClient(ctx context.Context, target backupTarget) (*Client, error) {
+	awsConfig, err := getTargetAwsConfig(ctx, target.Region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aws config, %v", err)
+	}
+	if target.RoleArn != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(c.awsConfig), target.RoleArn)
+		awsConfig.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return NewClient(awsConfig, c.targetAwsConfig), nil
+}
+
+func (c *BackupAllCommand) backup(ctx context.Context, target backupTarget) (*Report, error) {
+	client, err := c.sourceClient(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	switch target.Kind {
+	case "parameters":
+		opt := NewBackupParametersCommandOption()
+		opt.TargetRegion = c.opt.TargetRegion
+		opt.BucketName = c.opt.BucketName
+		opt.Key = target.Key
+		opt.DataKeyBucketName = c.opt.DataKeyBucketName
+		opt.DataKeyKey = c.opt.DataKeyKey
+		opt.BackupObjectOption = c.opt.BackupObjectOption
+		opt.BackupGenerationOption = c.opt.BackupGenerationOption
+		opt.Concurrency = c.opt.FetchConcurrency
+		opt.DescribeParametersTps = c.opt.DescribeParametersTps
+		opt.GetParametersTps = c.opt.GetParametersTps
+		return client.BackupParameters(ctx, opt)
+	case "secrets":
+		opt := NewBackupSecretsCommandOption()
+		opt.TargetRegion = c.opt.TargetRegion
+		opt.BucketName = c.opt.BucketName
+		opt.Key = target.Key
+		opt.DataKeyBucketName = c.opt.DataKeyBucketName
+		opt.DataKeyKey = c.opt.DataKeyKey
+		opt.BackupObjectOption = c.opt.BackupObjectOption
+		opt.BackupGenerationOption = c.opt.BackupGenerationOption
+		opt.Concurrency = c.opt.FetchConcurrency
+		opt.ListSecretsTps = c.opt.ListSecretsTps
+		opt.GetSecretValueTps = c.opt.GetSecretValueTps
+		return client.BackupSecrets(ctx, opt)
+	case "appconfig":
+		opt := NewBackupAppConfigCommandOption()
+		opt.TargetRegion = c.opt.TargetRegion
+		opt.BucketName = c.opt.BucketName
+		opt.Key = target.Key
+		opt.DataKeyBucketName = c.opt.DataKeyBucketName
+		opt.DataKeyKey = c.opt.DataKeyKey
+		opt.BackupObjectOption = c.opt.BackupObjectOption
+		opt.BackupGenerationOption = c.opt.BackupGenerationOption
+		opt.Concurrency = c.opt.FetchConcurrency
+		opt.AppConfigTps = c.opt.AppConfigTps
+		return client.BackupAppConfig(ctx, opt)
+	case "lambda":
+		opt := NewBackupLambdaCommandOption()
+		opt.TargetRegion = c.opt.TargetRegion
+		opt.BucketName = c.opt.BucketName
+		opt.Key = target.Key
+		opt.DataKeyBucketName = c.opt.DataKeyBucketName
+		opt.DataKeyKey = c.opt.DataKeyKey
+		opt.BackupObjectOption = c.opt.BackupObjectOption
+		opt.BackupGenerationOption = c.opt.BackupGenerationOption
+		opt.ListFunctionsTps = c.opt.ListFunctionsTps
+		return client.BackupLambda(ctx, opt)
+	default:
+		return nil, fmt.Errorf("unknown kind: %s", target.Kind)
+	}
+}
@@ -0,0 +1,221 @@
+package brsp
+
+import (
+	"context"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfig"
+	appconfigTypes "github.com/aws/aws-sdk-go-v2/service/appconfig/types"
+)
+
+type BackupAppConfigCommand struct {
+	appconfigClient AppConfigAPI
+	s3Client        S3API
+	kmsClient       KMSAPI
+	opt             *BackupAppConfigCommandOption
+}
+
+type BackupAppConfigCommandOption struct {
+	commandOption
+	TargetRegion      string `help:"target region"`
+	BucketName        string `help:"bucket name"`
+	Key               string `help:"key"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	KmsKey            string `help:"KMS key for encryption"`
+	BackupObjectOption
+	BackupGenerationOption
+
+	Concurrency  int     `default:"4" help:"number of concurrent GetHostedConfigurationVersion calls"`
+	AppConfigTps float64 `default:"5" help:"maximum AppConfig calls per second (0 for unlimited)"`
+}
+
+// NewBackupAppConfigCommandOption returns options set to the CLI defaults.
+func NewBackupAppConfigCommandOption() *BackupAppConfigCommandOption {
+	return withDefaults(&BackupAppConfigCommandOption{})
+}
+
+// HostedConfiguration is the latest version of a configuration profile
+// stored in the AppConfig hosted configuration store.
+type HostedConfiguration struct {
+	Application          appconfigTypes.Application
+	ConfigurationProfile appconfigTypes.ConfigurationProfileSummary
+	*appconfig.GetHostedConfigurationVersionOutput
+}
+
+// Name is the name a hosted configuration is backed up and restored by.
+func (h HostedConfiguration) Name() string {
+	return hostedConfigurationName(h.Application.Name, h.ConfigurationProfile.Name)
+}
+
+func hostedConfigurationName(applicationName *string, profileName *string) string {
+	return aws.ToString(applicationName) + "/" + aws.ToString(profileName)
+}
+
+func NewBackupAppConfigCommand(ctx context.Context, opt *BackupAppConfigCommandOption) (*BackupAppConfigCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aws config, %v", err)
+	}
+	targetAwsConfig, err := getTargetAwsConfig(ctx, opt.TargetRegion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target aws config, %v", err)
+	}
+	return NewClient(awsConfig, targetAwsConfig).backupAppConfigCommand(opt), nil
+}
+
+func (c *Client) backupAppConfigCommand(opt *BackupAppConfigCommandOption) *BackupAppConfigCommand {
+	return &BackupAppConfigCommand{
+		appconfigClient: c.AppConfig,
+		s3Client:        c.S3,
+		kmsClient:       c.KMS,
+		opt:             opt,
+	}
+}
+
+// fetchHostedConfigurations returns the latest version of every hosted
+// configuration profile. Profiles without any version are left out.
+func (c *BackupAppConfigCommand) fetchHostedConfigurations(ctx context.Context) ([]HostedConfiguration, error) {
+	limiter := newRateLimiter(c.opt.AppConfigTps)
+	profiles, err := listHostedConfigurationProfiles(ctx, c.appconfigClient, limiter)
+	if err != nil {
+		return nil, err
+	}
+
+	configurations := make([]HostedConfiguration, len(profiles))
+	err = runConcurrently(ctx, c.opt.Concurrency, len(profiles), func(ctx context.Context, i int) error {
+		version, err := latestHostedConfigurationVersion(ctx, c.appconfigClient, limiter, profiles[i].ConfigurationProfile)
+		if err != nil {
+			return err
+		}
+		configurations[i] = profiles[i]
+		configurations[i].GetHostedConfigurationVersionOutput = version
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hosted := []HostedConfiguration{}
+	for _, configuration := range configurations {
+		if configuration.GetHostedConfigurationVersionOutput == nil {
+			continue
+		}
+		if !utf8.Valid(configuration.Content) {
+			return nil, fmt.Errorf("hosted configuration %s is not text, which is not supported", configuration.Name())
+		}
+		registerSecret(string(configuration.Content))
+		hosted = append(hosted, configuration)
+	}
+	return hosted, nil
+}
+
+func (c *BackupAppConfigCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("backup-appconfig")
+	if err := c.opt.BackupObjectOption.preflight(ctx, c.s3Client, c.opt.BucketName); err != nil {
+		return report, err
+	}
+	configurations, err := c.fetchHostedConfigurations(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	dataKey, err := getDataKey(ctx, c.kmsClient, c.s3Client, c.opt.DataKeyBucketName, c.opt.DataKeyKey)
+	if err != nil {
+		return report, err
+	}
+
+	write, err := storeBackup(ctx, c.s3Client, c.opt.BucketName, c.opt.Key, dataKey, newAppConfigDocument(configurations), c.opt.BackupObjectOption, c.opt.BackupGenerationOption)
+	if err != nil {
+		return report, err
+	}
+
+	for _, configuration := range configurations {
+		report.add(write.reportItem(configuration.Name(), c.opt.Key))
+	}
+	return report, nil
+}
+
+// listHostedConfigurationProfiles returns the configuration profiles of every
+// application whose configurations are stored in the hosted store.
+func listHostedConfigurationProfiles(ctx context.Context, client AppConfigAPI, limiter *rateLimiter) ([]HostedConfiguration, error) {
+	profiles := []HostedConfiguration{}
+	applications := appconfig.NewListApplicationsPaginator(client, &appconfig.ListApplicationsInput{})
+	for applications.HasMorePages() {
+		var page *appconfig.ListApplicationsOutput
+		err := withBackoff(ctx, limiter, func() error {
+			var err error
+			page, err = applications.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, application := range page.Items {
+			paginator := appconfig.NewListConfigurationProfilesPaginator(client, &appconfig.ListConfigurationProfilesInput{
+				ApplicationId: application.Id,
+			})
+			for paginator.HasMorePages() {
+				var profilesPage *appconfig.ListConfigurationProfilesOutput
+				err := withBackoff(ctx, limiter, func() error {
+					var err error
+					profilesPage, err = paginator.NextPage(ctx)
+					return err
+				})
+				if err != nil {
+					return nil, err
+				}
+				for _, profile := range profilesPage.Items {
+					if aws.ToString(profile.LocationUri) != "hosted" {
+						continue
+					}
+					profiles = append(profiles, HostedConfiguration{Application: application, ConfigurationProfile: profile})
+				}
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// latestHostedConfigurationVersion returns the version of profile with the
+// highest version number, or nil if it has none. Every call is made under
+// limiter on its own, so that a throttled page is retried alone.
+func latestHostedConfigurationVersion(ctx context.Context, client AppConfigAPI, limiter *rateLimiter, profile appconfigTypes.ConfigurationProfileSummary) (*appconfig.GetHostedConfigurationVersionOutput, error) {
+	var latest *int32
+	paginator := appconfig.NewListHostedConfigurationVersionsPaginator(client, &appconfig.ListHostedConfigurationVersionsInput{
+		ApplicationId:          profile.ApplicationId,
+		ConfigurationProfileId: profile.Id,
+	})
+	for paginator.HasMorePages() {
+		var page *appconfig.ListHostedConfigurationVersionsOutput
+		err := withBackoff(ctx, limiter, func() error {
+			var err error
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range page.Items {
+			if latest == nil || version.VersionNumber > *latest {
+				latest = aws.Int32(version.VersionNumber)
+			}
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	var version *appconfig.GetHostedConfigurationVersionOutput
+	err := withBackoff(ctx, limiter, func() error {
+		var err error
+		version, err = client.GetHostedConfigurationVersion(ctx, &appconfig.GetHostedConfigurationVersionInput{
+			ApplicationId:          profile.ApplicationId,
+			ConfigurationProfileId: profile.Id,
+			VersionNumber:          latest,
+		})
+		return err
+	})
+	return version, err
+}
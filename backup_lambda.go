@@ -0,0 +1,168 @@
+package brsp
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdaTypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+type BackupLambdaCommand struct {
+	lambdaClient LambdaAPI
+	s3Client     S3API
+	kmsClient    KMSAPI
+	opt          *BackupLambdaCommandOption
+}
+
+type BackupLambdaCommandOption struct {
+	commandOption
+	FunctionName      string `help:"function name (all functions if empty)"`
+	TargetRegion      string `help:"target region"`
+	BucketName        string `help:"bucket name"`
+	Key               string `help:"key"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	KmsKey            string `help:"KMS key for encryption"`
+	BackupObjectOption
+	BackupGenerationOption
+
+	ListFunctionsTps float64 `default:"5" help:"maximum ListFunctions calls per second (0 for unlimited)"`
+}
+
+// NewBackupLambdaCommandOption returns options set to the CLI defaults.
+func NewBackupLambdaCommandOption() *BackupLambdaCommandOption {
+	return withDefaults(&BackupLambdaCommandOption{})
+}
+
+// EnvironmentVariable is an environment variable of a Lambda function, read
+// decrypted with the function's KMS key.
+type EnvironmentVariable struct {
+	Function *lambdaTypes.FunctionConfiguration
+	Name     string
+	Value    string
+}
+
+// ID is the name an environment variable is backed up and restored by.
+// Neither function names nor variable names contain a "/".
+func (v EnvironmentVariable) ID() string {
+	return aws.ToString(v.Function.FunctionName) + "/" + v.Name
+}
+
+func NewBackupLambdaCommand(ctx context.Context, opt *BackupLambdaCommandOption) (*BackupLambdaCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aws config, %v", err)
+	}
+	targetAwsConfig, err := getTargetAwsConfig(ctx, opt.TargetRegion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target aws config, %v", err)
+	}
+	return NewClient(awsConfig, targetAwsConfig).backupLambdaCommand(opt), nil
+}
+
+func (c *Client) backupLambdaCommand(opt *BackupLambdaCommandOption) *BackupLambdaCommand {
+	return &BackupLambdaCommand{
+		lambdaClient: c.Lambda,
+		s3Client:     c.S3,
+		kmsClient:    c.KMS,
+		opt:          opt,
+	}
+}
+
+// fetchEnvironmentVariables returns the environment variables of every
+// function (or the one given by --function-name), sorted by function and name.
+func (c *BackupLambdaCommand) fetchEnvironmentVariables(ctx context.Context) ([]EnvironmentVariable, error) {
+	limiter := newRateLimiter(c.opt.ListFunctionsTps)
+	functions := []lambdaTypes.FunctionConfiguration{}
+	if c.opt.FunctionName != "" {
+		var output *lambda.GetFunctionConfigurationOutput
+		err := withBackoff(ctx, limiter, func() error {
+			var err error
+			output, err = c.lambdaClient.GetFunctionConfiguration(ctx, &lambda.GetFunctionConfigurationInput{
+				FunctionName: aws.String(c.opt.FunctionName),
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		functions = append(functions, functionConfiguration(output))
+	} else {
+		paginator := lambda.NewListFunctionsPaginator(c.lambdaClient, &lambda.ListFunctionsInput{})
+		for paginator.HasMorePages() {
+			var page *lambda.ListFunctionsOutput
+			err := withBackoff(ctx, limiter, func() error {
+				var err error
+				page, err = paginator.NextPage(ctx)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			functions = append(functions, page.Functions...)
+		}
+	}
+	slices.SortFunc(functions, func(a, b lambdaTypes.FunctionConfiguration) int {
+		return strings.Compare(aws.ToString(a.FunctionName), aws.ToString(b.FunctionName))
+	})
+
+	variables := []EnvironmentVariable{}
+	for i := range functions {
+		function := &functions[i]
+		if function.Environment == nil {
+			continue
+		}
+		if envErr := function.Environment.Error; envErr != nil {
+			return nil, fmt.Errorf("failed to read the environment of %s, %s: %s", aws.ToString(function.FunctionName), aws.ToString(envErr.ErrorCode), aws.ToString(envErr.Message))
+		}
+		for _, name := range slices.Sorted(maps.Keys(function.Environment.Variables)) {
+			value := function.Environment.Variables[name]
+			registerSecret(value)
+			variables = append(variables, EnvironmentVariable{Function: function, Name: name, Value: value})
+		}
+	}
+	return variables, nil
+}
+
+func (c *BackupLambdaCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("backup-lambda")
+	if err := c.opt.BackupObjectOption.preflight(ctx, c.s3Client, c.opt.BucketName); err != nil {
+		return report, err
+	}
+	variables, err := c.fetchEnvironmentVariables(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	dataKey, err := getDataKey(ctx, c.kmsClient, c.s3Client, c.opt.DataKeyBucketName, c.opt.DataKeyKey)
+	if err != nil {
+		return report, err
+	}
+
+	write, err := storeBackup(ctx, c.s3Client, c.opt.BucketName, c.opt.Key, dataKey, newLambdaDocument(variables), c.opt.BackupObjectOption, c.opt.BackupGenerationOption)
+	if err != nil {
+		return report, err
+	}
+
+	for _, variable := range variables {
+		report.add(write.reportItem(variable.ID(), c.opt.Key))
+	}
+	return report, nil
+}
+
+// functionConfiguration converts the output of GetFunctionConfiguration to
+// the configuration ListFunctions returns.
+func functionConfiguration(output *lambda.GetFunctionConfigurationOutput) lambdaTypes.FunctionConfiguration {
+	return lambdaTypes.FunctionConfiguration{
+		FunctionName: output.FunctionName,
+		FunctionArn:  output.FunctionArn,
+		Environment:  output.Environment,
+		KMSKeyArn:    output.KMSKeyArn,
+		RevisionId:   output.RevisionId,
+	}
+}
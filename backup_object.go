@@ -0,0 +1,298 @@
+package brsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// backupLocation tells where a backup and the data key protecting it are read from.
+type backupLocation struct {
+	BucketName        string `json:"bucketName,omitempty"`
+	Key               string `json:"key,omitempty"`
+	DataKeyBucketName string `json:"dataKeyBucketName,omitempty"`
+	DataKeyKey        string `json:"dataKeyKey,omitempty"`
+
+	// FromFile, when set, is a local backup used instead of BucketName/Key.
+	// It is either a plaintext JSON export, a brsp backup envelope or an older
+	// brsp-encrypted file with its nonce in FromFile + ".nonce".
+	FromFile string `json:"fromFile,omitempty"`
+	// DataKeyFile is a local copy of the KMS-encrypted data key.
+	DataKeyFile string `json:"dataKeyFile,omitempty"`
+	// IdentityFile holds the base64-encoded plaintext data key, so that a
+	// local encrypted backup can be decrypted without KMS.
+	IdentityFile string `json:"identityFile,omitempty"`
+}
+
+// loadBackup returns the decrypted backup payload at loc.
+func loadBackup(ctx context.Context, s3Client S3API, kmsClient KMSAPI, loc backupLocation) ([]byte, error) {
+	if loc.FromFile != "" {
+		return loadBackupFromFile(ctx, s3Client, kmsClient, loc)
+	}
+
+	dataKey, err := loadDataKey(ctx, s3Client, kmsClient, loc)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := readBackupPayload(ctx, s3Client, loc.BucketName, loc.Key, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if manifest, ok := parseBackupManifest(payload); ok {
+		return reconstructBackup(ctx, s3Client, loc.BucketName, dataKey, manifest)
+	}
+	return payload, nil
+}
+
+// readBackupPayload returns the decrypted object at key, which is either a
+// backup or the manifest of an incremental backup.
+func readBackupPayload(ctx context.Context, s3Client S3API, bucket string, key string, dataKey []byte) ([]byte, error) {
+	data, err := getObject(ctx, s3Client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if isEnvelope(data) {
+		return openEnvelope(dataKey, data)
+	}
+
+	nonce, err := getObject(ctx, s3Client, bucket, fmt.Sprintf("%s.nonce", key))
+	if err != nil {
+		return nil, err
+	}
+	return decryptData(dataKey, nonce, data)
+}
+
+func loadBackupFromFile(ctx context.Context, s3Client S3API, kmsClient KMSAPI, loc backupLocation) ([]byte, error) {
+	data, err := os.ReadFile(loc.FromFile)
+	if err != nil {
+		return nil, err
+	}
+	if json.Valid(data) {
+		return data, nil
+	}
+	if isEnvelope(data) {
+		dataKey, err := loadDataKey(ctx, s3Client, kmsClient, loc)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := openEnvelope(dataKey, data)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := parseBackupManifest(payload); ok {
+			return nil, fmt.Errorf("%s is the manifest of an incremental backup, use download-backup to get the full backup as a file", loc.FromFile)
+		}
+		return payload, nil
+	}
+
+	nonce, err := os.ReadFile(fmt.Sprintf("%s.nonce", loc.FromFile))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not plaintext JSON and its nonce cannot be read, %v", loc.FromFile, err)
+	}
+	dataKey, err := loadDataKey(ctx, s3Client, kmsClient, loc)
+	if err != nil {
+		return nil, err
+	}
+	return decryptData(dataKey, nonce, data)
+}
+
+// loadDataKey returns the plaintext data key from the identity file, the local
+// encrypted data key or the encrypted data key stored in S3, in that order.
+func loadDataKey(ctx context.Context, s3Client S3API, kmsClient KMSAPI, loc backupLocation) ([]byte, error) {
+	if loc.IdentityFile != "" {
+		identity, err := os.ReadFile(loc.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		dataKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(identity)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode identity file %s, %v", loc.IdentityFile, err)
+		}
+		registerSecretBytes(dataKey)
+		return dataKey, nil
+	}
+
+	var encryptedDataKey []byte
+	var err error
+	if loc.DataKeyFile != "" {
+		encryptedDataKey, err = os.ReadFile(loc.DataKeyFile)
+	} else {
+		bucket := loc.DataKeyBucketName
+		if bucket == "" {
+			bucket = loc.BucketName
+		}
+		encryptedDataKey, err = getObject(ctx, s3Client, bucket, loc.DataKeyKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := kmsClient.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob: encryptedDataKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	registerSecretBytes(output.Plaintext)
+	return output.Plaintext, nil
+}
+
+// writeBackup encrypts body into an envelope and stores it at key without
+// ever exposing a partial backup there: the envelope is uploaded to a staging
+// key with a SHA-256 checksum, read back and decrypted, and only then copied
+// over key with the storage settings of objOpt. The staging object is removed
+// afterwards. The nonce object of a backup written by an older version is
+// left alone, since that backup, kept as a noncurrent version in a versioned
+// bucket, cannot be decrypted without it.
+//
+// In a bucket with Object Lock, the staging object would be locked by the
+// default retention of the bucket and could not be removed, so the backup is
+// written to key directly instead; see writeBackupDirect.
+func writeBackup(ctx context.Context, s3Client S3API, bucket string, key string, dataKey []byte, body []byte, objOpt BackupObjectOption) error {
+	envelope, err := sealEnvelope(dataKey, body, objOpt.Compression)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(envelope)
+	checksum := base64.StdEncoding.EncodeToString(sum[:])
+	if objOpt.bucketObjectLock {
+		return writeBackupDirect(ctx, s3Client, bucket, key, dataKey, body, envelope, checksum, objOpt)
+	}
+	staging := fmt.Sprintf("%s.staging-%s", key, time.Now().UTC().Format("20060102T150405.000000000Z"))
+
+	putInput := &s3.PutObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(staging),
+		Body:              bytes.NewReader(envelope),
+		ChecksumAlgorithm: s3Types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:    aws.String(checksum),
+	}
+	objOpt.applyToPut(putInput)
+	putOutput, err := s3Client.PutObject(ctx, putInput)
+	if err != nil {
+		return fmt.Errorf("failed to upload backup to %s, %v", staging, err)
+	}
+	// The staging object is deleted by the version uploaded, so that a
+	// versioned bucket keeps neither it as a noncurrent version nor a delete
+	// marker.
+	defer func() {
+		_, err := s3Client.DeleteObject(context.WithoutCancel(ctx), &s3.DeleteObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(staging),
+			VersionId: putOutput.VersionId,
+		})
+		if err != nil {
+			slog.Warn("failed to delete staging backup", "bucket", bucket, "key", staging, "error", err)
+		}
+	}()
+
+	if err := verifyBackup(ctx, s3Client, bucket, staging, putOutput.VersionId, dataKey, body, envelope); err != nil {
+		return err
+	}
+
+	// Promote the verified backup. CopyObject replaces key atomically.
+	copyInput := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(bucket + "/" + (&url.URL{Path: staging}).EscapedPath()),
+		ChecksumAlgorithm: s3Types.ChecksumAlgorithmSha256,
+	}
+	objOpt.applyToCopy(copyInput, time.Now())
+	copyOutput, err := s3Client.CopyObject(ctx, copyInput)
+	if err != nil {
+		return fmt.Errorf("failed to promote backup %s to %s, %v", staging, key, err)
+	}
+	if copyOutput.CopyObjectResult != nil && copyOutput.CopyObjectResult.ChecksumSHA256 != nil && *copyOutput.CopyObjectResult.ChecksumSHA256 != checksum {
+		return fmt.Errorf("checksum of %s does not match the uploaded backup", key)
+	}
+
+	return nil
+}
+
+// writeBackupDirect writes a backup to key in a bucket with Object Lock. S3
+// never exposes a partial upload, and the bucket is versioned, so the
+// previous backup is kept as a noncurrent version. The version written is
+// read back and verified like a staged one; if that fails, it is deleted so
+// that the previous backup is current again, unless it is already locked.
+func writeBackupDirect(ctx context.Context, s3Client S3API, bucket string, key string, dataKey []byte, body []byte, envelope []byte, checksum string, objOpt BackupObjectOption) error {
+	putInput := &s3.PutObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		Body:              bytes.NewReader(envelope),
+		ChecksumAlgorithm: s3Types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:    aws.String(checksum),
+	}
+	objOpt.applyToDirectPut(putInput, time.Now())
+	putOutput, err := s3Client.PutObject(ctx, putInput)
+	if err != nil {
+		return fmt.Errorf("failed to upload backup to %s, %v", key, err)
+	}
+	if err := verifyBackup(ctx, s3Client, bucket, key, putOutput.VersionId, dataKey, body, envelope); err != nil {
+		_, deleteErr := s3Client.DeleteObject(context.WithoutCancel(ctx), &s3.DeleteObjectInput{
+			Bucket:    aws.String(bucket),
+			Key:       aws.String(key),
+			VersionId: putOutput.VersionId,
+		})
+		if deleteErr != nil {
+			return fmt.Errorf("%v; the failed version %s could not be deleted and the previous backup is a noncurrent version, %v", err, aws.ToString(putOutput.VersionId), deleteErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// verifyBackup reads the version of the backup at key back and checks that
+// it is the uploaded envelope and decrypts to body.
+func verifyBackup(ctx context.Context, s3Client S3API, bucket string, key string, versionID *string, dataKey []byte, body []byte, envelope []byte) error {
+	stored, err := getObjectVersion(ctx, s3Client, bucket, key, versionID)
+	if err != nil {
+		return fmt.Errorf("failed to read back backup %s, %v", key, err)
+	}
+	if !bytes.Equal(stored, envelope) {
+		return fmt.Errorf("backup %s read back differs from the uploaded one", key)
+	}
+	decrypted, err := openEnvelope(dataKey, stored)
+	if err != nil {
+		return fmt.Errorf("backup %s read back cannot be decrypted, %v", key, err)
+	}
+	if !bytes.Equal(decrypted, body) {
+		return fmt.Errorf("backup %s read back decrypts to different content", key)
+	}
+	return nil
+}
+
+func getObject(ctx context.Context, s3Client S3API, bucket string, key string) ([]byte, error) {
+	return getObjectVersion(ctx, s3Client, bucket, key, nil)
+}
+
+// getObjectVersion reads the version versionID of key, or the current one if
+// versionID is nil.
+func getObjectVersion(ctx context.Context, s3Client S3API, bucket string, key string, versionID *string) ([]byte, error) {
+	output, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		VersionId:    versionID,
+		ChecksumMode: s3Types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	return io.ReadAll(output.Body)
+}
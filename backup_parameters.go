@@ -2,24 +2,22 @@ package brsp
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/kms"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 	"strings"
 )
 
 type BackupParametersCommand struct {
-	ssmClient *ssm.Client
-	s3Client  *s3.Client
-	kmsClient *kms.Client
+	ssmClient SSMAPI
+	s3Client  S3API
+	kmsClient KMSAPI
 	opt       *BackupParametersCommandOption
 }
 
 type BackupParametersCommandOption struct {
+	commandOption
 	ParameterName     string `help:"parameter name"`
 	TargetRegion      string `help:"target region"`
 	BucketName        string `help:"bucket name"`
@@ -27,6 +25,18 @@ type BackupParametersCommandOption struct {
 	DataKeyBucketName string `help:"data key bucket name"`
 	DataKeyKey        string `help:"data key key"`
 	KmsKey            string `help:"KMS key to decrypt data key"`
+	BackupObjectOption
+	BackupGenerationOption
+
+	OnMissing             string  `default:"fail" enum:"fail,skip" help:"what to do when a described parameter cannot be fetched (fail or skip)"`
+	Concurrency           int     `default:"4" help:"number of concurrent GetParameters calls"`
+	DescribeParametersTps float64 `default:"5" help:"maximum DescribeParameters calls per second (0 for unlimited)"`
+	GetParametersTps      float64 `default:"10" help:"maximum GetParameters calls per second (0 for unlimited)"`
+}
+
+// NewBackupParametersCommandOption returns options set to the CLI defaults.
+func NewBackupParametersCommandOption() *BackupParametersCommandOption {
+	return withDefaults(&BackupParametersCommandOption{})
 }
 
 type Parameter struct {
@@ -34,117 +44,177 @@ type Parameter struct {
 	KmsKey string
 }
 
-func NewBackupParametersCommand(opt *BackupParametersCommandOption) (*BackupParametersCommand, error) {
-	awsConfig, err := getAwsConfig()
+func NewBackupParametersCommand(ctx context.Context, opt *BackupParametersCommandOption) (*BackupParametersCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get aws config, %v", err)
 	}
-	targetAwsConfig, err := getTargetAwsConfig(opt.TargetRegion)
+	targetAwsConfig, err := getTargetAwsConfig(ctx, opt.TargetRegion)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get target aws config, %v", err)
 	}
+	return NewClient(awsConfig, targetAwsConfig).backupParametersCommand(opt), nil
+}
+
+func (c *Client) backupParametersCommand(opt *BackupParametersCommandOption) *BackupParametersCommand {
 	return &BackupParametersCommand{
-		s3Client:  s3.NewFromConfig(targetAwsConfig),
-		ssmClient: ssm.NewFromConfig(awsConfig),
-		kmsClient: kms.NewFromConfig(targetAwsConfig),
+		s3Client:  c.S3,
+		ssmClient: c.SSM,
+		kmsClient: c.KMS,
 		opt:       opt,
-	}, nil
+	}
 }
 
-func (c *BackupParametersCommand) Run() error {
-	paginator := ssm.NewDescribeParametersPaginator(c.ssmClient, &ssm.DescribeParametersInput{})
+// fetchParameters returns all parameters (or the one given by --parameter-name)
+// with both their decrypted and raw values, and the names skipped because they
+// disappeared or are invalid.
+func (c *BackupParametersCommand) fetchParameters(ctx context.Context) ([]Parameter, []string, error) {
+	describeLimiter := newRateLimiter(c.opt.DescribeParametersTps)
+	getLimiter := newRateLimiter(c.opt.GetParametersTps)
 	chunkSize := 10
 	parameterNames := []string{}
-	parameters := []Parameter{}
 
 	if c.opt.ParameterName != "" {
-		chunk := []string{c.opt.ParameterName}
-		getParametersWithoutDecruptionOutput, err := c.ssmClient.GetParameters(context.TODO(), &ssm.GetParametersInput{
-			Names:          chunk,
-			WithDecryption: aws.Bool(false),
-		})
-		if err != nil {
-			return err
-		}
-		getParametersOutput, err := c.ssmClient.GetParameters(context.TODO(), &ssm.GetParametersInput{
-			Names:          chunk,
-			WithDecryption: aws.Bool(true),
-		})
-		if err != nil {
-			return err
-		}
-		for i, parameter := range getParametersOutput.Parameters {
-			parameters = append(parameters, Parameter{Parameter: &parameter, KmsKey: *getParametersWithoutDecruptionOutput.Parameters[i].Value})
-		}
+		parameterNames = append(parameterNames, c.opt.ParameterName)
 	} else {
+		paginator := ssm.NewDescribeParametersPaginator(c.ssmClient, &ssm.DescribeParametersInput{})
 		for paginator.HasMorePages() {
-			page, err := paginator.NextPage(context.TODO())
-			if err != nil {
+			var page *ssm.DescribeParametersOutput
+			err := withBackoff(ctx, describeLimiter, func() error {
+				var err error
+				page, err = paginator.NextPage(ctx)
 				return err
+			})
+			if err != nil {
+				return nil, nil, err
 			}
 			for _, parameter := range page.Parameters {
 				parameterNames = append(parameterNames, *parameter.Name)
 			}
 		}
+	}
 
-		for i := 0; i < len(parameterNames); i += chunkSize {
-			end := i + chunkSize
-			if end > len(parameterNames) {
-				end = len(parameterNames)
-			}
-			chunk := parameterNames[i:end]
-			getParametersWithoutDecruptionOutput, err := c.ssmClient.GetParameters(context.TODO(), &ssm.GetParametersInput{
+	chunks := [][]string{}
+	for i := 0; i < len(parameterNames); i += chunkSize {
+		end := min(i+chunkSize, len(parameterNames))
+		chunks = append(chunks, parameterNames[i:end])
+	}
+
+	chunkParameters := make([][]Parameter, len(chunks))
+	chunkMissing := make([][]string, len(chunks))
+	err := runConcurrently(ctx, c.opt.Concurrency, len(chunks), func(ctx context.Context, i int) error {
+		chunk := chunks[i]
+		var getParametersWithoutDecruptionOutput *ssm.GetParametersOutput
+		err := withBackoff(ctx, getLimiter, func() error {
+			var err error
+			getParametersWithoutDecruptionOutput, err = c.ssmClient.GetParameters(ctx, &ssm.GetParametersInput{
 				Names:          chunk,
 				WithDecryption: aws.Bool(false),
 			})
-			if err != nil {
-				return err
-			}
-			getParametersOutput, err := c.ssmClient.GetParameters(context.TODO(), &ssm.GetParametersInput{
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		var getParametersOutput *ssm.GetParametersOutput
+		err = withBackoff(ctx, getLimiter, func() error {
+			var err error
+			getParametersOutput, err = c.ssmClient.GetParameters(ctx, &ssm.GetParametersInput{
 				Names:          chunk,
 				WithDecryption: aws.Bool(true),
 			})
-			if err != nil {
-				return err
-			}
-			for i, parameter := range getParametersOutput.Parameters {
-				parameters = append(parameters, Parameter{Parameter: &parameter, KmsKey: *getParametersWithoutDecruptionOutput.Parameters[i].Value})
-			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		ps, missing, err := c.pairParameters(chunk, getParametersOutput, getParametersWithoutDecruptionOutput)
+		if err != nil {
+			return err
 		}
+		chunkParameters[i] = ps
+		chunkMissing[i] = missing
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	body, err := json.Marshal(parameters)
-	if err != nil {
-		return err
+	parameters := []Parameter{}
+	skipped := []string{}
+	for i := range chunks {
+		parameters = append(parameters, chunkParameters[i]...)
+		skipped = append(skipped, chunkMissing[i]...)
 	}
+	return parameters, skipped, nil
+}
 
-	dataKey, err := getDataKey(context.TODO(), c.kmsClient, c.s3Client, c.opt.DataKeyBucketName, c.opt.DataKeyKey)
+func (c *BackupParametersCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("backup-parameters")
+	if err := c.opt.BackupObjectOption.preflight(ctx, c.s3Client, c.opt.BucketName); err != nil {
+		return report, err
+	}
+	parameters, skipped, err := c.fetchParameters(ctx)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	ciphertext, nonce, err := encryptData(dataKey, body)
+	dataKey, err := getDataKey(ctx, c.kmsClient, c.s3Client, c.opt.DataKeyBucketName, c.opt.DataKeyKey)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	_, err = c.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(c.opt.Key),
-		Body:   strings.NewReader(string(ciphertext)),
-	})
+	write, err := storeBackup(ctx, c.s3Client, c.opt.BucketName, c.opt.Key, dataKey, newParametersDocument(parameters), c.opt.BackupObjectOption, c.opt.BackupGenerationOption)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	_, err = c.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(fmt.Sprintf("%s.nonce", c.opt.Key)),
-		Body:   strings.NewReader(string(nonce)),
-	})
-	if err != nil {
-		return err
+	for _, parameter := range parameters {
+		report.add(write.reportItem(*parameter.Name, c.opt.Key))
+	}
+	for _, name := range skipped {
+		report.add(ReportItem{Source: name, Action: ReportActionSkip, Reason: "disappeared or is invalid"})
 	}
+	return report, nil
+}
 
-	return nil
+// pairParameters joins the decrypted and raw GetParameters results by name,
+// in the order of names. GetParameters guarantees neither the order of
+// Parameters nor that every name is returned, so names reported in
+// InvalidParameters or missing from either response are handled per --on-missing.
+func (c *BackupParametersCommand) pairParameters(names []string, decrypted *ssm.GetParametersOutput, raw *ssm.GetParametersOutput) ([]Parameter, []string, error) {
+	decryptedByName := map[string]ssmTypes.Parameter{}
+	for _, parameter := range decrypted.Parameters {
+		decryptedByName[*parameter.Name] = parameter
+	}
+	rawByName := map[string]ssmTypes.Parameter{}
+	for _, parameter := range raw.Parameters {
+		rawByName[*parameter.Name] = parameter
+	}
+	invalid := map[string]bool{}
+	for _, name := range decrypted.InvalidParameters {
+		invalid[name] = true
+	}
+	for _, name := range raw.InvalidParameters {
+		invalid[name] = true
+	}
+
+	parameters := []Parameter{}
+	missing := []string{}
+	for _, name := range names {
+		parameter, ok := decryptedByName[name]
+		rawParameter, rawOk := rawByName[name]
+		if invalid[name] || !ok || !rawOk {
+			missing = append(missing, name)
+			continue
+		}
+		registerSecret(aws.ToString(parameter.Value))
+		registerSecret(aws.ToString(rawParameter.Value))
+		parameters = append(parameters, Parameter{Parameter: &parameter, KmsKey: aws.ToString(rawParameter.Value)})
+	}
+
+	if len(missing) > 0 && (c.opt.OnMissing != "skip" || c.opt.ParameterName != "") {
+		return nil, nil, fmt.Errorf("parameters disappeared or are invalid: %s", strings.Join(missing, ", "))
+	}
+	return parameters, missing, nil
 }
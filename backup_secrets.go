@@ -2,30 +2,43 @@ package brsp
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"sync/atomic"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/kms"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	secretmanagerTypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
-	"strings"
+	"github.com/aws/smithy-go"
 )
 
 type BackupSecretsCommand struct {
-	s3Client             *s3.Client
-	secretsmanagerClient *secretsmanager.Client
-	kmsClient            *kms.Client
+	s3Client             S3API
+	secretsmanagerClient SecretsManagerAPI
+	kmsClient            KMSAPI
 	opt                  *BackupSecretsCommandOption
 }
 
 type BackupSecretsCommandOption struct {
+	commandOption
 	TargetRegion      string `help:"target region"`
 	BucketName        string `help:"bucket name"`
 	Key               string `help:"key"`
 	DataKeyBucketName string `help:"data key bucket name"`
 	DataKeyKey        string `help:"data key key"`
 	KmsKey            string `help:"KMS key for encryption"`
+	BackupObjectOption
+	BackupGenerationOption
+
+	Concurrency         int     `default:"4" help:"number of concurrent secret value fetches"`
+	ListSecretsTps      float64 `default:"5" help:"maximum ListSecrets calls per second (0 for unlimited)"`
+	GetSecretValueTps   float64 `default:"10" help:"maximum GetSecretValue/BatchGetSecretValue calls per second (0 for unlimited)"`
+	BatchGetSecretValue bool    `default:"true" negatable:"" help:"fetch secret values with BatchGetSecretValue, falling back to GetSecretValue when unavailable"`
+}
+
+// NewBackupSecretsCommandOption returns options set to the CLI defaults.
+func NewBackupSecretsCommandOption() *BackupSecretsCommandOption {
+	return withDefaults(&BackupSecretsCommandOption{})
 }
 
 type Secret struct {
@@ -33,78 +46,164 @@ type Secret struct {
 	SecretValue string
 }
 
-func NewBackupSecretsCommand(opt *BackupSecretsCommandOption) (*BackupSecretsCommand, error) {
-	awsConfig, err := getAwsConfig()
+func NewBackupSecretsCommand(ctx context.Context, opt *BackupSecretsCommandOption) (*BackupSecretsCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
 	if err != nil {
 		return nil, err
 	}
-	targetAwsConfig, err := getTargetAwsConfig(opt.TargetRegion)
+	targetAwsConfig, err := getTargetAwsConfig(ctx, opt.TargetRegion)
 	if err != nil {
 		return nil, err
 	}
+	return NewClient(awsConfig, targetAwsConfig).backupSecretsCommand(opt), nil
+}
+
+func (c *Client) backupSecretsCommand(opt *BackupSecretsCommandOption) *BackupSecretsCommand {
 	return &BackupSecretsCommand{
-		secretsmanagerClient: secretsmanager.NewFromConfig(awsConfig),
-		s3Client:             s3.NewFromConfig(targetAwsConfig),
-		kmsClient:            kms.NewFromConfig(targetAwsConfig),
+		secretsmanagerClient: c.SecretsManager,
+		s3Client:             c.S3,
+		kmsClient:            c.KMS,
 		opt:                  opt,
-	}, nil
+	}
 }
 
-func (c *BackupSecretsCommand) Run() error {
+// fetchSecrets returns all secrets with their values.
+func (c *BackupSecretsCommand) fetchSecrets(ctx context.Context) ([]Secret, error) {
+	listLimiter := newRateLimiter(c.opt.ListSecretsTps)
+	getLimiter := newRateLimiter(c.opt.GetSecretValueTps)
 	paginator := secretsmanager.NewListSecretsPaginator(c.secretsmanagerClient, &secretsmanager.ListSecretsInput{})
 	secrets := []Secret{}
 
 	for paginator.HasMorePages() {
-		page, err := paginator.NextPage(context.TODO())
-		if err != nil {
+		var page *secretsmanager.ListSecretsOutput
+		err := withBackoff(ctx, listLimiter, func() error {
+			var err error
+			page, err = paginator.NextPage(ctx)
 			return err
+		})
+		if err != nil {
+			return nil, err
 		}
 		for _, secret := range page.SecretList {
-			getSecretValueOutput, err := c.secretsmanagerClient.GetSecretValue(context.TODO(), &secretsmanager.GetSecretValueInput{
-				SecretId: aws.String(*secret.Name),
+			secrets = append(secrets, Secret{SecretListEntry: &secret})
+		}
+	}
+
+	chunkSize := 1
+	if c.opt.BatchGetSecretValue {
+		chunkSize = batchGetSecretValueMaxResults
+	}
+	var batchUnavailable atomic.Bool
+	chunks := (len(secrets) + chunkSize - 1) / chunkSize
+	err := runConcurrently(ctx, c.opt.Concurrency, chunks, func(ctx context.Context, i int) error {
+		chunk := secrets[i*chunkSize : min((i+1)*chunkSize, len(secrets))]
+		if len(chunk) > 1 && !batchUnavailable.Load() {
+			err := c.batchGetSecretValues(ctx, getLimiter, chunk)
+			if !isUnsupportedOperationError(err) {
+				return err
+			}
+			batchUnavailable.Store(true)
+		}
+		for j := range chunk {
+			err := withBackoff(ctx, getLimiter, func() error {
+				getSecretValueOutput, err := c.secretsmanagerClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+					SecretId: chunk[j].Name,
+				})
+				if err != nil {
+					return err
+				}
+				registerSecret(aws.ToString(getSecretValueOutput.SecretString))
+				chunk[j].SecretValue = aws.ToString(getSecretValueOutput.SecretString)
+				return nil
 			})
 			if err != nil {
 				return err
 			}
-			secrets = append(secrets, Secret{
-				SecretListEntry: &secret,
-				SecretValue:     *getSecretValueOutput.SecretString,
-			})
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return secrets, nil
+}
 
-	body, err := json.Marshal(secrets)
+func (c *BackupSecretsCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("backup-secrets")
+	if err := c.opt.BackupObjectOption.preflight(ctx, c.s3Client, c.opt.BucketName); err != nil {
+		return report, err
+	}
+	secrets, err := c.fetchSecrets(ctx)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	dataKey, err := getDataKey(context.TODO(), c.kmsClient, c.s3Client, c.opt.DataKeyBucketName, c.opt.DataKeyKey)
+	dataKey, err := getDataKey(ctx, c.kmsClient, c.s3Client, c.opt.DataKeyBucketName, c.opt.DataKeyKey)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	ciphertext, nonce, err := encryptData(dataKey, body)
+	write, err := storeBackup(ctx, c.s3Client, c.opt.BucketName, c.opt.Key, dataKey, newSecretsDocument(secrets), c.opt.BackupObjectOption, c.opt.BackupGenerationOption)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	_, err = c.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(c.opt.Key),
-		Body:   strings.NewReader(string(ciphertext)),
-	})
-	if err != nil {
-		return err
+	for _, secret := range secrets {
+		report.add(write.reportItem(*secret.Name, c.opt.Key))
+	}
+	return report, nil
+}
+
+const batchGetSecretValueMaxResults = 20
+
+// batchGetSecretValues fills SecretValue of secrets with a single BatchGetSecretValue call.
+func (c *BackupSecretsCommand) batchGetSecretValues(ctx context.Context, limiter *rateLimiter, secrets []Secret) error {
+	secretIds := make([]string, len(secrets))
+	for i, secret := range secrets {
+		secretIds[i] = *secret.ARN
 	}
 
-	_, err = c.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(fmt.Sprintf("%s.nonce", c.opt.Key)),
-		Body:   strings.NewReader(string(nonce)),
+	var output *secretsmanager.BatchGetSecretValueOutput
+	err := withBackoff(ctx, limiter, func() error {
+		var err error
+		output, err = c.secretsmanagerClient.BatchGetSecretValue(ctx, &secretsmanager.BatchGetSecretValueInput{
+			SecretIdList: secretIds,
+		})
+		return err
 	})
 	if err != nil {
 		return err
 	}
+	if len(output.Errors) > 0 {
+		apiErr := output.Errors[0]
+		return fmt.Errorf("failed to get secret value of %s, %s: %s", aws.ToString(apiErr.SecretId), aws.ToString(apiErr.ErrorCode), aws.ToString(apiErr.Message))
+	}
 
+	values := map[string]string{}
+	for _, value := range output.SecretValues {
+		registerSecret(aws.ToString(value.SecretString))
+		values[aws.ToString(value.ARN)] = aws.ToString(value.SecretString)
+	}
+	for i := range secrets {
+		value, ok := values[*secrets[i].ARN]
+		if !ok {
+			return fmt.Errorf("secret value of %s is missing in BatchGetSecretValue response", *secrets[i].Name)
+		}
+		secrets[i].SecretValue = value
+	}
 	return nil
 }
+
+// isUnsupportedOperationError reports whether err means BatchGetSecretValue
+// cannot be used, e.g. missing IAM permission or an emulator without support.
+func isUnsupportedOperationError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDeniedException", "UnknownOperationException", "NotImplemented":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package brsp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// BackupObjectOption tells how backup objects are stored: their compression,
+// storage class, server-side encryption and Object Lock protection.
+type BackupObjectOption struct {
+	Compression       string        `default:"zstd" enum:"none,gzip,zstd" help:"compression of the backup payload before encryption (none, gzip or zstd)"`
+	StorageClass      string        `default:"STANDARD" enum:"STANDARD,STANDARD_IA,ONEZONE_IA,INTELLIGENT_TIERING,GLACIER_IR" help:"storage class of backup objects"`
+	SseKmsKeyId       string        `help:"KMS key to encrypt backup objects with SSE-KMS (the bucket default encryption if empty)"`
+	ObjectLockMode    string        `default:"none" enum:"none,governance,compliance" help:"Object Lock retention mode of backup objects (none, governance or compliance)"`
+	Retention         time.Duration `help:"how long backup objects are locked from the time of the backup, e.g. 2160h"`
+	LegalHold         bool          `help:"place a legal hold on backup objects"`
+	RequireObjectLock bool          `help:"fail before backing up unless the bucket has versioning and Object Lock enabled (implied by --object-lock-mode and --legal-hold)"`
+
+	// bucketObjectLock is set by preflight when the bucket has Object Lock
+	// enabled, so that writeBackup writes to the key directly.
+	bucketObjectLock bool
+}
+
+func (o BackupObjectOption) locked() bool {
+	return (o.ObjectLockMode != "" && o.ObjectLockMode != "none") || o.LegalHold
+}
+
+func (o BackupObjectOption) validate() error {
+	retained := o.ObjectLockMode != "" && o.ObjectLockMode != "none"
+	if retained && o.Retention <= 0 {
+		return fmt.Errorf("--retention is required with --object-lock-mode %s", o.ObjectLockMode)
+	}
+	if !retained && o.Retention > 0 {
+		return fmt.Errorf("--retention requires --object-lock-mode governance or compliance")
+	}
+	return nil
+}
+
+// preflight validates the options and, when backups are to be locked or
+// --require-object-lock is given, checks that the bucket has versioning and
+// Object Lock enabled, so that a backup is not taken only to be rejected.
+// Otherwise it only looks up whether the bucket has Object Lock enabled.
+func (o *BackupObjectOption) preflight(ctx context.Context, s3Client S3API, bucket string) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if !o.locked() && !o.RequireObjectLock {
+		lock, err := s3Client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{
+			Bucket: aws.String(bucket),
+		})
+		var apiErr smithy.APIError
+		switch {
+		case errors.As(err, &apiErr) && apiErr.ErrorCode() == "ObjectLockConfigurationNotFoundError":
+		case err != nil:
+			// Without the permission to read it, the bucket is taken to have
+			// no default retention.
+			slog.DebugContext(ctx, "failed to get Object Lock configuration", "bucket", bucket, "error", err)
+		default:
+			o.bucketObjectLock = lock.ObjectLockConfiguration != nil && lock.ObjectLockConfiguration.ObjectLockEnabled == s3Types.ObjectLockEnabledEnabled
+		}
+		return nil
+	}
+
+	versioning, err := s3Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get versioning of bucket %s, %v", bucket, err)
+	}
+	if versioning.Status != s3Types.BucketVersioningStatusEnabled {
+		return fmt.Errorf("bucket %s does not have versioning enabled", bucket)
+	}
+
+	lock, err := s3Client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ObjectLockConfigurationNotFoundError" {
+		return fmt.Errorf("bucket %s does not have Object Lock enabled", bucket)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get Object Lock configuration of bucket %s, %v", bucket, err)
+	}
+	if lock.ObjectLockConfiguration == nil || lock.ObjectLockConfiguration.ObjectLockEnabled != s3Types.ObjectLockEnabledEnabled {
+		return fmt.Errorf("bucket %s does not have Object Lock enabled", bucket)
+	}
+	o.bucketObjectLock = true
+	return nil
+}
+
+// applyToPut encrypts the staging object the same way as the backup.
+func (o BackupObjectOption) applyToPut(input *s3.PutObjectInput) {
+	if o.SseKmsKeyId != "" {
+		input.ServerSideEncryption = s3Types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(o.SseKmsKeyId)
+	}
+}
+
+// applyToDirectPut sets the storage class, encryption and Object Lock
+// settings of a backup object written without staging.
+func (o BackupObjectOption) applyToDirectPut(input *s3.PutObjectInput, now time.Time) {
+	o.applyToPut(input)
+	if o.StorageClass != "" {
+		input.StorageClass = s3Types.StorageClass(o.StorageClass)
+	}
+	if o.ObjectLockMode != "" && o.ObjectLockMode != "none" {
+		input.ObjectLockMode = s3Types.ObjectLockMode(strings.ToUpper(o.ObjectLockMode))
+		input.ObjectLockRetainUntilDate = aws.Time(now.Add(o.Retention))
+	}
+	if o.LegalHold {
+		input.ObjectLockLegalHoldStatus = s3Types.ObjectLockLegalHoldStatusOn
+	}
+}
+
+// applyToCopy sets the storage class, encryption and Object Lock settings
+// of the backup object, which does not inherit them from the staging one.
+func (o BackupObjectOption) applyToCopy(input *s3.CopyObjectInput, now time.Time) {
+	if o.StorageClass != "" {
+		input.StorageClass = s3Types.StorageClass(o.StorageClass)
+	}
+	if o.SseKmsKeyId != "" {
+		input.ServerSideEncryption = s3Types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(o.SseKmsKeyId)
+	}
+	if o.ObjectLockMode != "" && o.ObjectLockMode != "none" {
+		input.ObjectLockMode = s3Types.ObjectLockMode(strings.ToUpper(o.ObjectLockMode))
+		input.ObjectLockRetainUntilDate = aws.Time(now.Add(o.Retention))
+	}
+	if o.LegalHold {
+		input.ObjectLockLegalHoldStatus = s3Types.ObjectLockLegalHoldStatusOn
+	}
+}
@@ -0,0 +1,215 @@
+package brsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type BackupVaultCommand struct {
+	vaultClient VaultAPI
+	s3Client    S3API
+	kmsClient   KMSAPI
+	opt         *BackupVaultCommandOption
+}
+
+type BackupVaultCommandOption struct {
+	commandOption
+	TargetRegion      string `help:"target region"`
+	BucketName        string `help:"bucket name"`
+	Key               string `help:"key"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	KmsKey            string `help:"KMS key for encryption"`
+	VaultOption
+	VaultPaths       []string `help:"path prefixes of the secrets to back up, relative to --vault-mount (all secrets if empty)"`
+	VaultAllVersions bool     `help:"also back up the previous versions of every secret, which are kept for reference and not restored"`
+	BackupObjectOption
+	BackupGenerationOption
+
+	Concurrency int `default:"4" help:"number of concurrent secret reads"`
+}
+
+// NewBackupVaultCommandOption returns options set to the CLI defaults.
+func NewBackupVaultCommandOption() *BackupVaultCommandOption {
+	return withDefaults(&BackupVaultCommandOption{})
+}
+
+// VaultEntry is a secret of a KV version 2 secrets engine: its current
+// version and, with --vault-all-versions, the previous versions that can
+// still be read, oldest first.
+type VaultEntry struct {
+	Path string
+	*VaultSecret
+	History []*VaultSecret
+}
+
+func NewBackupVaultCommand(ctx context.Context, opt *BackupVaultCommandOption) (*BackupVaultCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aws config, %v", err)
+	}
+	targetAwsConfig, err := getTargetAwsConfig(ctx, opt.TargetRegion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target aws config, %v", err)
+	}
+	return NewClient(awsConfig, targetAwsConfig).backupVaultCommand(opt), nil
+}
+
+func (c *Client) backupVaultCommand(opt *BackupVaultCommandOption) *BackupVaultCommand {
+	return &BackupVaultCommand{
+		vaultClient: c.withVault(opt.VaultOption).Vault,
+		s3Client:    c.S3,
+		kmsClient:   c.KMS,
+		opt:         opt,
+	}
+}
+
+// fetchVaultEntries returns the secrets under --vault-paths with their data.
+// Secrets whose current version is deleted are left out.
+func (c *BackupVaultCommand) fetchVaultEntries(ctx context.Context) ([]VaultEntry, error) {
+	if c.vaultClient == nil {
+		return nil, fmt.Errorf("no Vault to back up, specify --vault-addr")
+	}
+	paths, err := listVaultSecrets(ctx, c.vaultClient, c.opt.VaultPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*VaultEntry, len(paths))
+	err = runConcurrently(ctx, c.opt.Concurrency, len(paths), func(ctx context.Context, i int) error {
+		secret, err := c.vaultClient.ReadSecret(ctx, paths[i], 0)
+		var notFound *VaultNotFoundError
+		if errors.As(err, &notFound) {
+			slog.Warn("skipped a secret without a readable current version", "path", paths[i])
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s, %w", paths[i], err)
+		}
+		registerVaultSecret(secret)
+		entry := &VaultEntry{Path: paths[i], VaultSecret: secret}
+		if c.opt.VaultAllVersions {
+			if entry.History, err = c.readHistory(ctx, paths[i], secret.Metadata.Version); err != nil {
+				return err
+			}
+		}
+		entries[i] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []VaultEntry{}
+	for _, entry := range entries {
+		if entry != nil {
+			result = append(result, *entry)
+		}
+	}
+	return result, nil
+}
+
+// readHistory reads the readable versions of the secret at path before
+// current, oldest first.
+func (c *BackupVaultCommand) readHistory(ctx context.Context, path string, current int) ([]*VaultSecret, error) {
+	metadata, err := c.vaultClient.ReadMetadata(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the metadata of %s, %w", path, err)
+	}
+	versions := []int{}
+	for key, version := range metadata.Versions {
+		number, err := strconv.Atoi(key)
+		if err != nil || number == current || !version.readable() {
+			continue
+		}
+		versions = append(versions, number)
+	}
+	slices.Sort(versions)
+
+	history := []*VaultSecret{}
+	for _, version := range versions {
+		secret, err := c.vaultClient.ReadSecret(ctx, path, version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read version %d of %s, %w", version, path, err)
+		}
+		registerVaultSecret(secret)
+		history = append(history, secret)
+	}
+	return history, nil
+}
+
+func (c *BackupVaultCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("backup-vault")
+	if err := c.opt.BackupObjectOption.preflight(ctx, c.s3Client, c.opt.BucketName); err != nil {
+		return report, err
+	}
+	entries, err := c.fetchVaultEntries(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	dataKey, err := getDataKey(ctx, c.kmsClient, c.s3Client, c.opt.DataKeyBucketName, c.opt.DataKeyKey)
+	if err != nil {
+		return report, err
+	}
+
+	doc, err := newVaultDocument(entries)
+	if err != nil {
+		return report, err
+	}
+	write, err := storeBackup(ctx, c.s3Client, c.opt.BucketName, c.opt.Key, dataKey, doc, c.opt.BackupObjectOption, c.opt.BackupGenerationOption)
+	if err != nil {
+		return report, err
+	}
+
+	for _, entry := range entries {
+		report.add(write.reportItem(entry.Path, c.opt.Key))
+	}
+	return report, nil
+}
+
+// listVaultSecrets returns the sorted paths of the secrets that start with
+// one of prefixes, or of all secrets if prefixes is empty.
+func listVaultSecrets(ctx context.Context, client VaultAPI, prefixes []string) ([]string, error) {
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	paths := []string{}
+	for _, prefix := range prefixes {
+		prefix = strings.TrimPrefix(prefix, "/")
+		listed, err := client.ListSecrets(ctx, prefix[:strings.LastIndex(prefix, "/")+1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the secrets under %s, %w", prefix, err)
+		}
+		for _, path := range listed {
+			if strings.HasPrefix(path, prefix) {
+				paths = append(paths, path)
+			}
+		}
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths), nil
+}
+
+// vaultValue is the value a backup item holds for the data of a secret.
+func vaultValue(data map[string]any) (string, error) {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// registerVaultSecret redacts the data of secret, and each of its fields,
+// from logs.
+func registerVaultSecret(secret *VaultSecret) {
+	if value, err := vaultValue(secret.Data); err == nil {
+		registerSecret(value)
+	}
+}
@@ -3,26 +3,52 @@ package brsp
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/smithy-go/middleware"
 )
 
 var Version = "dev"
 var Revision = "HEAD"
 
 type GlobalOptions struct {
+	Config       string `type:"path" env:"BRSP_CONFIG" help:"config file of profiles (default: brsp.yaml, brsp.yml, brsp.json or ~/.config/brsp/config.yaml)"`
+	Profile      string `env:"BRSP_PROFILE" help:"profile in the config file to take flags from"`
+	ReportFormat string `default:"table" enum:"table,json,junit" help:"format of the result report (table, json or junit)"`
+	ReportFile   string `help:"write the result report to this file instead of stderr"`
+	LogLevel     string `default:"info" enum:"debug,info,warn,error" help:"log level (debug logs every AWS request with its request ID)"`
+	LogFormat    string `default:"text" enum:"text,json" help:"log format (text or json)"`
+
+	Timeout        time.Duration `help:"stop the command after this duration (0 for no limit)"`
+	RequestTimeout time.Duration `default:"1m" help:"timeout of each AWS and Vault request attempt (0 for no limit)"`
 }
 
 type CLI struct {
+	GlobalOptions
 	GenerateDataKey   *GenerateDataKeyCommandOption   `cmd:"generate-data-key" help:""`
 	BackupParameters  *BackupParametersCommandOption  `cmd:"backup-parameters" help:""`
 	BackupSecrets     *BackupSecretsCommandOption     `cmd:"backup-secrets" help:""`
+	BackupAppConfig   *BackupAppConfigCommandOption   `cmd:"" name:"backup-appconfig" help:"back up AppConfig hosted configurations"`
+	BackupLambda      *BackupLambdaCommandOption      `cmd:"backup-lambda" help:"back up Lambda function environment variables"`
+	BackupVault       *BackupVaultCommandOption       `cmd:"backup-vault" help:"back up secrets of a Vault KV version 2 secrets engine"`
+	BackupAll         *BackupAllCommandOption         `cmd:"backup-all" help:""`
+	Backup            *BackupCommandOption            `cmd:"backup" help:"take a snapshot of parameters, secrets, hosted configurations, environment variables and Vault secrets"`
 	DownloadBackup    *DownloadBackupCommandOption    `cmd:"download-backup" help:""`
+	DiffBackup        *DiffBackupCommandOption        `cmd:"diff-backup" help:""`
+	MigrateBackup     *MigrateBackupCommandOption     `cmd:"migrate-backup" help:""`
+	ExportTerraform   *ExportTerraformCommandOption   `cmd:"export-terraform" help:"generate Terraform configuration and import blocks for the targets of a backup"`
+	Import            *ImportCommandOption            `cmd:"import" help:"import a dotenv, YAML or JSON file, optionally encrypted with SOPS, into placeholder parameters or secrets"`
 	RestoreSecrets    *RestoreSecretsCommandOption    `cmd:"restore-secrets" help:""`
 	RestoreParameters *RestoreParametersCommandOption `cmd:"restore-parameters" help:""`
+	Restore           *RestoreCommandOption           `cmd:"restore" help:""`
+	Rollback          *RollbackCommandOption          `cmd:"rollback" help:""`
 	Version           VersionFlag                     `name:"version" help:"show version"`
 }
 
@@ -38,7 +64,7 @@ func (v VersionFlag) BeforeApply(app *kong.Kong, vars kong.Vars) error {
 
 func RunCLI(ctx context.Context, args []string) error {
 	var cli CLI
-	parser, err := kong.New(&cli)
+	parser, err := kong.New(&cli, kong.Configuration(loadConfig))
 	if err != nil {
 		return err
 	}
@@ -46,7 +72,13 @@ func RunCLI(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
-	cmd := strings.Fields(kctx.Command())[0]
+	logger, err := newLogger(os.Stderr, cli.LogFormat, cli.LogLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	cmd := strings.Join(strings.Fields(kctx.Command()), " ")
 	if cmd == "version" {
 		fmt.Println(Version)
 		return nil
@@ -57,53 +89,174 @@ func RunCLI(ctx context.Context, args []string) error {
 }
 
 func (a *App) Dispatch(ctx context.Context, command string) error {
+	if a.CLI.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.CLI.Timeout)
+		defer cancel()
+	}
+	ctx = withRequestTimeout(ctx, a.CLI.RequestTimeout)
+
+	report, err := a.run(ctx, command)
+	if report == nil {
+		return err
+	}
+	report.finish()
+	if reportErr := writeReport(report, a.CLI.ReportFormat, a.CLI.ReportFile); reportErr != nil && err == nil {
+		err = reportErr
+	}
+	return err
+}
+
+func (a *App) run(ctx context.Context, command string) (*Report, error) {
 	switch command {
 	case "generate-data-key":
-		cmd, err := NewGenerateDataKeyCommand(a.CLI.GenerateDataKey)
+		cmd, err := NewGenerateDataKeyCommand(ctx, a.CLI.GenerateDataKey)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return cmd.Run()
+		return cmd.Run(ctx)
 	case "backup-parameters":
-		cmd, err := NewBackupParametersCommand(a.CLI.BackupParameters)
+		cmd, err := NewBackupParametersCommand(ctx, a.CLI.BackupParameters)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return cmd.Run()
+		return cmd.Run(ctx)
 	case "backup-secrets":
-		cmd, err := NewBackupSecretsCommand(a.CLI.BackupSecrets)
+		cmd, err := NewBackupSecretsCommand(ctx, a.CLI.BackupSecrets)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return cmd.Run()
+		return cmd.Run(ctx)
+	case "backup-appconfig":
+		cmd, err := NewBackupAppConfigCommand(ctx, a.CLI.BackupAppConfig)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "backup-lambda":
+		cmd, err := NewBackupLambdaCommand(ctx, a.CLI.BackupLambda)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "backup-vault":
+		cmd, err := NewBackupVaultCommand(ctx, a.CLI.BackupVault)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "backup-all":
+		cmd, err := NewBackupAllCommand(ctx, a.CLI.BackupAll)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "backup":
+		cmd, err := NewBackupCommand(ctx, a.CLI.Backup)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
 	case "download-backup":
-		cmd, err := NewDownloadBackupCommand(a.CLI.DownloadBackup)
+		cmd, err := NewDownloadBackupCommand(ctx, a.CLI.DownloadBackup)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "diff-backup":
+		cmd, err := NewDiffBackupCommand(ctx, a.CLI.DiffBackup)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return cmd.Run()
+		return cmd.Run(ctx)
+	case "migrate-backup":
+		cmd, err := NewMigrateBackupCommand(ctx, a.CLI.MigrateBackup)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "export-terraform":
+		cmd, err := NewExportTerraformCommand(ctx, a.CLI.ExportTerraform)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "import":
+		cmd, err := NewImportCommand(ctx, a.CLI.Import)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
 	case "restore-secrets":
-		cmd, err := NewRestoreSecretsCommand(a.CLI.RestoreSecrets)
+		cmd, err := NewRestoreSecretsCommand(ctx, a.CLI.RestoreSecrets)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return cmd.Run()
+		return cmd.Run(ctx)
 	case "restore-parameters":
-		cmd, err := NewRestoreParametersCommand(a.CLI.RestoreParameters)
+		cmd, err := NewRestoreParametersCommand(ctx, a.CLI.RestoreParameters)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "restore plan":
+		cmd, err := NewRestorePlanCommand(ctx, a.CLI.Restore.Plan)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "restore apply":
+		cmd, err := NewRestoreApplyCommand(ctx, a.CLI.Restore.Apply)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
+	case "restore snapshot":
+		cmd, err := NewRestoreSnapshotCommand(ctx, a.CLI.Restore.Snapshot)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return cmd.Run()
+		return cmd.Run(ctx)
+	case "rollback":
+		cmd, err := NewRollbackCommand(ctx, a.CLI.Rollback)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Run(ctx)
 
 	default:
-		return fmt.Errorf("unknown command: %s", command)
+		return nil, fmt.Errorf("unknown command: %s", command)
+	}
+}
+
+type requestTimeoutKey struct{}
+
+// withRequestTimeout makes AWS configs loaded with ctx, and Vault requests
+// sent with it, time out each request attempt after timeout.
+func withRequestTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, requestTimeoutKey{}, timeout)
+}
+
+// requestTimeout returns the timeout set by withRequestTimeout, or 0.
+func requestTimeout(ctx context.Context) time.Duration {
+	timeout, _ := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	return timeout
+}
+
+func awsConfigOptions(ctx context.Context) []func(*config.LoadOptions) error {
+	opts := []func(*config.LoadOptions) error{
+		config.WithAPIOptions([]func(*middleware.Stack) error{addRequestLogging}),
+	}
+	if timeout := requestTimeout(ctx); timeout > 0 {
+		opts = append(opts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTimeout(timeout)))
 	}
+	return opts
 }
 
-func getAwsConfig() (aws.Config, error) {
-	return config.LoadDefaultConfig(context.TODO())
+func getAwsConfig(ctx context.Context) (aws.Config, error) {
+	return config.LoadDefaultConfig(ctx, awsConfigOptions(ctx)...)
 }
 
-func getTargetAwsConfig(targetRegion string) (aws.Config, error) {
-	return config.LoadDefaultConfig(context.TODO(), config.WithRegion(targetRegion))
+func getTargetAwsConfig(ctx context.Context, targetRegion string) (aws.Config, error) {
+	return config.LoadDefaultConfig(ctx, append(awsConfigOptions(ctx), config.WithRegion(targetRegion))...)
 }
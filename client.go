@@ -0,0 +1,221 @@
+package brsp
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfig"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// SSMAPI is the part of the SSM API brsp uses.
+type SSMAPI interface {
+	DescribeParameters(ctx context.Context, params *ssm.DescribeParametersInput, optFns ...func(*ssm.Options)) (*ssm.DescribeParametersOutput, error)
+	GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+	PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error)
+}
+
+// SecretsManagerAPI is the part of the Secrets Manager API brsp uses.
+type SecretsManagerAPI interface {
+	ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error)
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	BatchGetSecretValue(ctx context.Context, params *secretsmanager.BatchGetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error)
+	PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error)
+}
+
+// AppConfigAPI is the part of the AppConfig API brsp uses for hosted
+// configurations.
+type AppConfigAPI interface {
+	ListApplications(ctx context.Context, params *appconfig.ListApplicationsInput, optFns ...func(*appconfig.Options)) (*appconfig.ListApplicationsOutput, error)
+	ListConfigurationProfiles(ctx context.Context, params *appconfig.ListConfigurationProfilesInput, optFns ...func(*appconfig.Options)) (*appconfig.ListConfigurationProfilesOutput, error)
+	ListHostedConfigurationVersions(ctx context.Context, params *appconfig.ListHostedConfigurationVersionsInput, optFns ...func(*appconfig.Options)) (*appconfig.ListHostedConfigurationVersionsOutput, error)
+	GetHostedConfigurationVersion(ctx context.Context, params *appconfig.GetHostedConfigurationVersionInput, optFns ...func(*appconfig.Options)) (*appconfig.GetHostedConfigurationVersionOutput, error)
+	CreateHostedConfigurationVersion(ctx context.Context, params *appconfig.CreateHostedConfigurationVersionInput, optFns ...func(*appconfig.Options)) (*appconfig.CreateHostedConfigurationVersionOutput, error)
+}
+
+// LambdaAPI is the part of the Lambda API brsp uses for function environment
+// variables.
+type LambdaAPI interface {
+	ListFunctions(ctx context.Context, params *lambda.ListFunctionsInput, optFns ...func(*lambda.Options)) (*lambda.ListFunctionsOutput, error)
+	GetFunctionConfiguration(ctx context.Context, params *lambda.GetFunctionConfigurationInput, optFns ...func(*lambda.Options)) (*lambda.GetFunctionConfigurationOutput, error)
+	UpdateFunctionConfiguration(ctx context.Context, params *lambda.UpdateFunctionConfigurationInput, optFns ...func(*lambda.Options)) (*lambda.UpdateFunctionConfigurationOutput, error)
+}
+
+// S3API is the part of the S3 API brsp uses to store backups and data keys.
+type S3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error)
+	GetObjectLockConfiguration(ctx context.Context, params *s3.GetObjectLockConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetObjectLockConfigurationOutput, error)
+}
+
+// KMSAPI is the part of the KMS API brsp uses for data keys.
+type KMSAPI interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// Client runs brsp operations with the given clients, so that programs
+// embedding brsp can bring their own configuration, middleware or fakes.
+// SSM, SecretsManager, AppConfig, Lambda and Vault are the services whose
+// items are backed up or restored; S3 and KMS store the backups and their
+// data keys. Vault is optional; commands given --vault-addr use that Vault
+// when it is nil.
+//
+// The TargetRegion options are ignored by Client; configure S3 and KMS for
+// the target region instead.
+type Client struct {
+	SSM            SSMAPI
+	SecretsManager SecretsManagerAPI
+	AppConfig      AppConfigAPI
+	Lambda         LambdaAPI
+	Vault          VaultAPI
+	S3             S3API
+	KMS            KMSAPI
+}
+
+// NewClient returns a Client reading the backed up services with source and
+// storing backups with target.
+func NewClient(source aws.Config, target aws.Config) *Client {
+	return &Client{
+		SSM:            ssm.NewFromConfig(source),
+		SecretsManager: secretsmanager.NewFromConfig(source),
+		AppConfig:      appconfig.NewFromConfig(source),
+		Lambda:         lambda.NewFromConfig(source),
+		S3:             s3.NewFromConfig(target),
+		KMS:            kms.NewFromConfig(target),
+	}
+}
+
+func (c *Client) GenerateDataKey(ctx context.Context, opt *GenerateDataKeyCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.generateDataKeyCommand(opt).Run(ctx)
+}
+
+func (c *Client) BackupParameters(ctx context.Context, opt *BackupParametersCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.backupParametersCommand(opt).Run(ctx)
+}
+
+func (c *Client) BackupSecrets(ctx context.Context, opt *BackupSecretsCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.backupSecretsCommand(opt).Run(ctx)
+}
+
+func (c *Client) BackupAppConfig(ctx context.Context, opt *BackupAppConfigCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.backupAppConfigCommand(opt).Run(ctx)
+}
+
+func (c *Client) BackupLambda(ctx context.Context, opt *BackupLambdaCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.backupLambdaCommand(opt).Run(ctx)
+}
+
+func (c *Client) BackupVault(ctx context.Context, opt *BackupVaultCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.backupVaultCommand(opt).Run(ctx)
+}
+
+func (c *Client) Backup(ctx context.Context, opt *BackupCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.backupCommand(opt).Run(ctx)
+}
+
+func (c *Client) DownloadBackup(ctx context.Context, opt *DownloadBackupCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.downloadBackupCommand(opt).Run(ctx)
+}
+
+func (c *Client) DiffBackup(ctx context.Context, opt *DiffBackupCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.diffBackupCommand(opt).Run(ctx)
+}
+
+func (c *Client) MigrateBackup(ctx context.Context, opt *MigrateBackupCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.migrateBackupCommand(opt).Run(ctx)
+}
+
+func (c *Client) ExportTerraform(ctx context.Context, opt *ExportTerraformCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.exportTerraformCommand(opt).Run(ctx)
+}
+
+func (c *Client) Import(ctx context.Context, opt *ImportCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.importCommand(opt).Run(ctx)
+}
+
+func (c *Client) RestoreParameters(ctx context.Context, opt *RestoreParametersCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.restoreParametersCommand(opt).Run(ctx)
+}
+
+func (c *Client) RestoreSecrets(ctx context.Context, opt *RestoreSecretsCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.restoreSecretsCommand(opt).Run(ctx)
+}
+
+func (c *Client) RestorePlan(ctx context.Context, opt *RestorePlanCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.restorePlanCommand(opt).Run(ctx)
+}
+
+func (c *Client) RestoreApply(ctx context.Context, opt *RestoreApplyCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.restoreApplyCommand(opt).Run(ctx)
+}
+
+func (c *Client) RestoreSnapshot(ctx context.Context, opt *RestoreSnapshotCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.restoreSnapshotCommand(opt).Run(ctx)
+}
+
+func (c *Client) Rollback(ctx context.Context, opt *RollbackCommandOption) (*Report, error) {
+	if err := checkCommandOption(opt); err != nil {
+		return nil, err
+	}
+	return c.rollbackCommand(opt).Run(ctx)
+}
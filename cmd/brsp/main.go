@@ -2,9 +2,10 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/takaishi/brsp"
 )
@@ -13,21 +14,24 @@ var Version = "dev"
 var Revision = "HEAD"
 
 func init() {
-	Version = Version
-	Revision = Revision
+	brsp.Version = Version
+	brsp.Revision = Revision
 }
 
 func main() {
-	ctx := context.TODO()
-	ctx, stop := signal.NotifyContext(ctx, []os.Signal{os.Interrupt}...)
-	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		// Let a second signal kill the process.
+		signal.Stop(signals)
+		slog.Warn("interrupted, finishing in-flight requests; interrupt again to force quit")
+		cancel()
+	}()
 	if err := brsp.RunCLI(ctx, os.Args[1:]); err != nil {
-		log.Printf("error: %v", err)
+		slog.Error("command failed", "error", err)
 		os.Exit(1)
 	}
-	go func() {
-		<-ctx.Done()
-		_, cancel := context.WithCancel(context.Background())
-		defer cancel()
-	}()
 }
@@ -0,0 +1,258 @@
+package brsp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigPaths are searched in order when --config is not given.
+var defaultConfigPaths = []string{
+	"brsp.yaml",
+	"brsp.yml",
+	"brsp.json",
+	"~/.config/brsp/config.yaml",
+}
+
+// configFile is a YAML or JSON file of named profiles, each setting flags by
+// their long name. Flags under commands apply only to that command.
+//
+//	default-profile: prod-tokyo-to-osaka
+//	profiles:
+//	  prod-tokyo-to-osaka:
+//	    bucket-name: my-backup
+//	    data-key-key: data-key
+//	    target-region: ap-northeast-3
+//	    commands:
+//	      backup-secrets:
+//	        key: secrets/backup
+type configFile struct {
+	DefaultProfile string                   `yaml:"default-profile"`
+	Profiles       map[string]configProfile `yaml:"profiles"`
+}
+
+type configProfile struct {
+	Flags    map[string]any            `yaml:",inline"`
+	Commands map[string]map[string]any `yaml:"commands"`
+}
+
+// loadConfig is the kong.ConfigurationLoader of config files, reading JSON
+// as YAML. The profile is selected by GlobalOptions.BeforeResolve, because the
+// file and profile are themselves flags.
+func loadConfig(r io.Reader) (kong.Resolver, error) {
+	var config configFile
+	if err := yaml.NewDecoder(r).Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return &configResolver{config: config}, nil
+}
+
+// BeforeResolve loads the config file of --config, or the first one found in
+// defaultConfigPaths, through the loader given to kong.Configuration, and
+// resolves flags from its profile selected by --profile or default-profile.
+func (o *GlobalOptions) BeforeResolve(kctx *kong.Context) error {
+	path := stringFlagValue(kctx, "config")
+	name := stringFlagValue(kctx, "profile")
+	if path == "" {
+		for _, defaultPath := range defaultConfigPaths {
+			if _, err := os.Stat(kong.ExpandPath(defaultPath)); err == nil {
+				path = defaultPath
+				break
+			}
+		}
+	}
+	if path == "" {
+		if name != "" {
+			return fmt.Errorf("profile %s is selected but no config file is found", name)
+		}
+		return nil
+	}
+
+	loaded, err := kctx.Kong.LoadConfig(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s, %v", path, err)
+	}
+	resolver := loaded.(*configResolver)
+	if err := resolver.selectProfile(path, name); err != nil {
+		return err
+	}
+	kctx.AddResolver(resolver)
+	return nil
+}
+
+// configResolver resolves flags that are not set on the command line or by
+// an environment variable from the selected profile of a config file.
+type configResolver struct {
+	config  configFile
+	path    string
+	name    string
+	profile *configProfile
+}
+
+func (r *configResolver) selectProfile(path string, name string) error {
+	r.path = path
+	r.name = name
+	if r.name == "" {
+		r.name = r.config.DefaultProfile
+	}
+	if r.name == "" {
+		return nil
+	}
+	profile, ok := r.config.Profiles[r.name]
+	if !ok {
+		return fmt.Errorf("profile %s is not found in %s", r.name, r.path)
+	}
+	if err := expandProfile(&profile); err != nil {
+		return fmt.Errorf("profile %s in %s, %v", r.name, r.path, err)
+	}
+	r.profile = &profile
+	return nil
+}
+
+func (r *configResolver) Resolve(kctx *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	if r.profile == nil || flag.Name == "config" || flag.Name == "profile" {
+		return nil, nil
+	}
+	for _, env := range flag.Envs {
+		if _, ok := os.LookupEnv(env); ok {
+			return nil, nil
+		}
+	}
+
+	if parent.Command != nil {
+		if value, ok := r.profile.Commands[commandName(parent.Command)][flag.Name]; ok {
+			return configValue(value), nil
+		}
+	}
+	if value, ok := r.profile.Flags[flag.Name]; ok {
+		return configValue(value), nil
+	}
+	return nil, nil
+}
+
+// Validate rejects profiles setting flags or commands that do not exist.
+func (r *configResolver) Validate(app *kong.Application) error {
+	if r.profile == nil {
+		return nil
+	}
+
+	commands := map[string]map[string]bool{}
+	all := flagNames(app.Flags)
+	_ = kong.Visit(app.Node, func(node kong.Visitable, next kong.Next) error {
+		if n, ok := node.(*kong.Node); ok && n.Type == kong.CommandNode {
+			commands[commandName(n)] = flagNames(n.Flags)
+			for name := range commands[commandName(n)] {
+				all[name] = true
+			}
+		}
+		return next(nil)
+	})
+
+	problems := []string{}
+	for name := range r.profile.Flags {
+		if !all[name] || name == "config" || name == "profile" {
+			problems = append(problems, fmt.Sprintf("unknown flag %q", name))
+		}
+	}
+	for command, flags := range r.profile.Commands {
+		known, ok := commands[command]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown command %q", command))
+			continue
+		}
+		for name := range flags {
+			if !known[name] {
+				problems = append(problems, fmt.Sprintf("unknown flag %q for command %q", name, command))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid profile %s in %s: %s", r.name, r.path, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// expandProfile replaces $VAR and ${VAR} in the string values of profile
+// with environment variables, failing on unset ones.
+func expandProfile(profile *configProfile) error {
+	missing := map[string]bool{}
+	var expand func(value any) any
+	expand = func(value any) any {
+		switch v := value.(type) {
+		case string:
+			return os.Expand(v, func(name string) string {
+				value, ok := os.LookupEnv(name)
+				if !ok {
+					missing[name] = true
+				}
+				return value
+			})
+		case []any:
+			for i := range v {
+				v[i] = expand(v[i])
+			}
+		}
+		return value
+	}
+
+	for name, value := range profile.Flags {
+		profile.Flags[name] = expand(value)
+	}
+	for _, flags := range profile.Commands {
+		for name, value := range flags {
+			flags[name] = expand(value)
+		}
+	}
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("environment variables are not set: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// configValue converts a YAML value to what kong parses flags from.
+func configValue(value any) any {
+	switch v := value.(type) {
+	case []any:
+		values := make([]any, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func stringFlagValue(kctx *kong.Context, name string) string {
+	for _, flag := range kctx.Flags() {
+		if flag.Name == name {
+			value, _ := kctx.FlagValue(flag).(string)
+			return value
+		}
+	}
+	return ""
+}
+
+func commandName(node *kong.Node) string {
+	return strings.Join(strings.Fields(node.Path()), " ")
+}
+
+func flagNames(flags []*kong.Flag) map[string]bool {
+	names := map[string]bool{}
+	for _, flag := range flags {
+		names[flag.Name] = true
+	}
+	return names
+}
@@ -0,0 +1,178 @@
+package brsp
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kong"
+)
+
+const testConfig = `
+default-profile: tokyo
+profiles:
+  tokyo:
+    bucket-name: tokyo-backup
+    data-key-key: data-key
+    target-region: ap-northeast-1
+    vault-addr: https://vault.tokyo.example.com
+    commands:
+      backup-secrets:
+        key: secrets/backup
+        concurrency: 8
+      backup:
+        kinds: [parameters, lambda]
+  osaka:
+    bucket-name: osaka-backup
+    target-region: ap-northeast-3
+    commands:
+      backup-secrets:
+        key: ${BRSP_TEST_KEY}
+  typo:
+    bucket-nmae: backup
+  unknown-command:
+    commands:
+      backup-everything:
+        key: backup
+  unknown-command-flag:
+    commands:
+      backup-secrets:
+        kinds: [parameters]
+`
+
+// parseTestCLI parses args with the profiles of testConfig, run from an empty
+// directory so that no other config file is found.
+func parseTestCLI(t *testing.T, args ...string) (*CLI, error) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("HOME", dir)
+	if err := os.WriteFile(filepath.Join(dir, "brsp.yaml"), []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var cli CLI
+	parser, err := kong.New(&cli, kong.Configuration(loadConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parser.Parse(args)
+	return &cli, err
+}
+
+func TestConfigProfiles(t *testing.T) {
+	t.Run("default profile", func(t *testing.T) {
+		cli, err := parseTestCLI(t, "backup-secrets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt := cli.BackupSecrets
+		if opt.BucketName != "tokyo-backup" || opt.DataKeyKey != "data-key" || opt.TargetRegion != "ap-northeast-1" {
+			t.Errorf("backup-secrets options = %+v, want the flags of profile tokyo", opt)
+		}
+		if opt.Key != "secrets/backup" || opt.Concurrency != 8 {
+			t.Errorf("key %q and concurrency %d, want those of the backup-secrets section", opt.Key, opt.Concurrency)
+		}
+	})
+
+	t.Run("command line over profile", func(t *testing.T) {
+		cli, err := parseTestCLI(t, "backup-secrets", "--bucket-name", "other", "--key", "other/backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opt := cli.BackupSecrets; opt.BucketName != "other" || opt.Key != "other/backup" || opt.DataKeyKey != "data-key" {
+			t.Errorf("backup-secrets options = %+v, want the command line flags over the profile", opt)
+		}
+	})
+
+	t.Run("sections of other commands", func(t *testing.T) {
+		cli, err := parseTestCLI(t, "backup-parameters")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opt := cli.BackupParameters; opt.Key != "" || opt.Concurrency != 4 || opt.BucketName != "tokyo-backup" {
+			t.Errorf("backup-parameters options = %+v, want only the flags of the profile", opt)
+		}
+	})
+
+	t.Run("list values", func(t *testing.T) {
+		cli, err := parseTestCLI(t, "backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"parameters", "lambda"}; !reflect.DeepEqual(cli.Backup.Kinds, want) {
+			t.Errorf("kinds = %v, want %v", cli.Backup.Kinds, want)
+		}
+	})
+
+	t.Run("selected profile with environment variables", func(t *testing.T) {
+		t.Setenv("BRSP_TEST_KEY", "osaka/secrets")
+		cli, err := parseTestCLI(t, "--profile", "osaka", "backup-secrets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opt := cli.BackupSecrets; opt.BucketName != "osaka-backup" || opt.Key != "osaka/secrets" || opt.DataKeyKey != "" {
+			t.Errorf("backup-secrets options = %+v, want the flags of profile osaka alone", opt)
+		}
+	})
+
+	t.Run("environment over profile", func(t *testing.T) {
+		t.Setenv("VAULT_ADDR", "https://vault.example.com")
+		cli, err := parseTestCLI(t, "backup-vault")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cli.BackupVault.VaultAddr; got != "https://vault.example.com" {
+			t.Errorf("vault addr = %q, want that of VAULT_ADDR", got)
+		}
+		if got := cli.BackupVault.BucketName; got != "tokyo-backup" {
+			t.Errorf("bucket name = %q, want that of the profile", got)
+		}
+	})
+
+	t.Run("profile selected by the environment", func(t *testing.T) {
+		t.Setenv("BRSP_TEST_KEY", "osaka/secrets")
+		t.Setenv("BRSP_PROFILE", "osaka")
+		cli, err := parseTestCLI(t, "backup-secrets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cli.BackupSecrets.BucketName != "osaka-backup" {
+			t.Errorf("bucket name = %q, want that of the profile in BRSP_PROFILE", cli.BackupSecrets.BucketName)
+		}
+	})
+
+	t.Run("json config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "brsp.json")
+		if err := os.WriteFile(path, []byte(`{"profiles": {"kobe": {"bucket-name": "kobe-backup", "commands": {"backup": {"kinds": ["secrets"]}}}}}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cli, err := parseTestCLI(t, "--config", path, "--profile", "kobe", "backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cli.Backup.BucketName != "kobe-backup" || !reflect.DeepEqual(cli.Backup.Kinds, []string{"secrets"}) {
+			t.Errorf("backup options = %+v, want the flags of profile kobe in the JSON file", cli.Backup)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "unknown profile", args: []string{"--profile", "nagoya", "backup-secrets"}, wantErr: "profile nagoya is not found"},
+		{name: "unset environment variable", args: []string{"--profile", "osaka", "backup-secrets"}, wantErr: "BRSP_TEST_KEY"},
+		{name: "unknown flag", args: []string{"--profile", "typo", "backup-secrets"}, wantErr: `unknown flag "bucket-nmae"`},
+		{name: "unknown command", args: []string{"--profile", "unknown-command", "backup-secrets"}, wantErr: `unknown command "backup-everything"`},
+		{name: "unknown flag of a command", args: []string{"--profile", "unknown-command-flag", "backup-secrets"}, wantErr: `unknown flag "kinds" for command "backup-secrets"`},
+		{name: "missing config file", args: []string{"--config", "missing.yaml", "backup-secrets"}, wantErr: "failed to read config file"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseTestCLI(t, tt.args...); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parsing %v returned %v, want an error containing %q", tt.args, err, tt.wantErr)
+			}
+		})
+	}
+}
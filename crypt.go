@@ -4,14 +4,17 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"io"
 )
 
-func getDataKey(ctx context.Context, kmsClient *kms.Client, s3Client *s3.Client, bucket string, key string) ([]byte, error) {
+func getDataKey(ctx context.Context, kmsClient KMSAPI, s3Client S3API, bucket string, key string) ([]byte, error) {
 	getObjectOutput, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
@@ -25,12 +28,13 @@ func getDataKey(ctx context.Context, kmsClient *kms.Client, s3Client *s3.Client,
 		return nil, err
 	}
 
-	output, err := kmsClient.Decrypt(context.TODO(), &kms.DecryptInput{
+	output, err := kmsClient.Decrypt(ctx, &kms.DecryptInput{
 		CiphertextBlob: dataKey,
 	})
 	if err != nil {
 		return nil, err
 	}
+	registerSecretBytes(output.Plaintext)
 	return output.Plaintext, nil
 }
 
@@ -72,3 +76,32 @@ func decryptData(key []byte, nonce []byte, ciphertext []byte) (plaintext []byte,
 
 	return plaintext, nil
 }
+
+// deriveKey derives a key for purpose from the data key, so that the data key
+// itself is never used twice.
+func deriveKey(dataKey []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// valueHashKey derives the key of keyedValueHash from the data key.
+func valueHashKey(dataKey []byte) []byte {
+	return deriveKey(dataKey, "brsp value hash key")
+}
+
+// keyedValueHash identifies value without revealing it: unlike a plain hash,
+// it cannot be checked against guesses of low-entropy values without the data
+// key.
+func keyedValueHash(hashKey []byte, value string) string {
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// valueHash is a plain hash of value, only for places that are themselves
+// encrypted with the data key, such as the manifest of incremental backups.
+func valueHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
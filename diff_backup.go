@@ -0,0 +1,316 @@
+package brsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+type DiffBackupCommand struct {
+	client *Client
+	opt    *DiffBackupCommandOption
+}
+
+type DiffBackupCommandOption struct {
+	commandOption
+	BucketName        string `help:"S3 bucket name"`
+	Key               string `help:"S3 object key"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	KmsKey            string `help:"KMS key for decryption"`
+	CompareBucketName string `help:"S3 bucket name of the backup to compare with (defaults to --bucket-name)"`
+	CompareKey        string `help:"S3 object key of the backup to compare with; compares with the live state when empty"`
+	Kind              string `default:"auto" enum:"auto,parameters,secrets,appconfig,lambda,vault" help:"kind of the live state to compare with (auto detects it from the backup)"`
+	ShowValues        bool   `help:"show changed values instead of their hashes"`
+	Format            string `default:"text" enum:"text,json" help:"output format (text or json)"`
+	VaultOption
+	VaultPaths       []string `help:"path prefixes of the live Vault secrets to compare with, relative to --vault-mount (all secrets if empty)"`
+	VaultAllVersions bool     `help:"also compare with the previous versions of every live Vault secret, for backups taken with --vault-all-versions"`
+
+	Concurrency           int     `default:"4" help:"number of concurrent fetches of the live state"`
+	DescribeParametersTps float64 `default:"5" help:"maximum DescribeParameters calls per second (0 for unlimited)"`
+	GetParametersTps      float64 `default:"10" help:"maximum GetParameters calls per second (0 for unlimited)"`
+	ListSecretsTps        float64 `default:"5" help:"maximum ListSecrets calls per second (0 for unlimited)"`
+	GetSecretValueTps     float64 `default:"10" help:"maximum GetSecretValue/BatchGetSecretValue calls per second (0 for unlimited)"`
+	AppConfigTps          float64 `default:"5" help:"maximum AppConfig calls per second (0 for unlimited)"`
+	ListFunctionsTps      float64 `default:"5" help:"maximum ListFunctions calls per second (0 for unlimited)"`
+}
+
+// NewDiffBackupCommandOption returns options set to the CLI defaults.
+func NewDiffBackupCommandOption() *DiffBackupCommandOption {
+	return withDefaults(&DiffBackupCommandOption{})
+}
+
+type diffRecord struct {
+	Name     string
+	Value    string
+	Metadata map[string]string
+}
+
+type backupDiff struct {
+	Added   []string      `json:"added"`
+	Removed []string      `json:"removed"`
+	Changed []diffChanged `json:"changed"`
+}
+
+type diffChanged struct {
+	Name     string                `json:"name"`
+	Value    *diffChange           `json:"value,omitempty"`
+	Metadata map[string]diffChange `json:"metadata,omitempty"`
+}
+
+type diffChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+func NewDiffBackupCommand(ctx context.Context, opt *DiffBackupCommandOption) (*DiffBackupCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(awsConfig, awsConfig).diffBackupCommand(opt), nil
+}
+
+func (c *Client) diffBackupCommand(opt *DiffBackupCommandOption) *DiffBackupCommand {
+	return &DiffBackupCommand{client: c.withVault(opt.VaultOption), opt: opt}
+}
+
+func (c *DiffBackupCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("diff-backup")
+	loc := backupLocation{
+		BucketName:        c.opt.BucketName,
+		Key:               c.opt.Key,
+		DataKeyBucketName: c.opt.DataKeyBucketName,
+		DataKeyKey:        c.opt.DataKeyKey,
+	}
+	before, err := loadBackup(ctx, c.client.S3, c.client.KMS, loc)
+	if err != nil {
+		return report, err
+	}
+	// Changed values are shown as hashes keyed with the data key, which
+	// cannot be checked against guessed values by whoever reads the diff.
+	var hashKey []byte
+	if !c.opt.ShowValues {
+		dataKey, err := loadDataKey(ctx, c.client.S3, c.client.KMS, loc)
+		if err != nil {
+			return report, err
+		}
+		hashKey = valueHashKey(dataKey)
+	}
+
+	kind := c.opt.Kind
+	if kind == "auto" {
+		kind, err = detectBackupKind(before)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	var after []byte
+	if c.opt.CompareKey != "" {
+		bucket := c.opt.CompareBucketName
+		if bucket == "" {
+			bucket = c.opt.BucketName
+		}
+		after, err = loadBackup(ctx, c.client.S3, c.client.KMS, backupLocation{
+			BucketName:        bucket,
+			Key:               c.opt.CompareKey,
+			DataKeyBucketName: c.opt.DataKeyBucketName,
+			DataKeyKey:        c.opt.DataKeyKey,
+		})
+	} else {
+		after, err = c.liveState(ctx, kind)
+	}
+	if err != nil {
+		return report, err
+	}
+
+	beforeRecords, err := parseDiffRecords(before, kind)
+	if err != nil {
+		return report, err
+	}
+	afterRecords, err := parseDiffRecords(after, kind)
+	if err != nil {
+		return report, err
+	}
+	diff := diffBackups(beforeRecords, afterRecords, hashKey)
+	for _, name := range diff.Added {
+		report.add(ReportItem{Source: name, Action: ReportActionAdded})
+	}
+	for _, name := range diff.Removed {
+		report.add(ReportItem{Source: name, Action: ReportActionRemoved})
+	}
+	for _, changed := range diff.Changed {
+		report.add(ReportItem{Source: changed.Name, Action: ReportActionChanged})
+	}
+
+	if c.opt.Format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return report, encoder.Encode(diff)
+	}
+	printBackupDiff(os.Stdout, diff)
+	return report, nil
+}
+
+// liveState fetches the current items of kind in the same shape as a backup.
+func (c *DiffBackupCommand) liveState(ctx context.Context, kind string) ([]byte, error) {
+	switch kind {
+	case "parameters":
+		opt := NewBackupParametersCommandOption()
+		opt.OnMissing = "skip"
+		opt.Concurrency = c.opt.Concurrency
+		opt.DescribeParametersTps = c.opt.DescribeParametersTps
+		opt.GetParametersTps = c.opt.GetParametersTps
+		parameters, _, err := c.client.backupParametersCommand(opt).fetchParameters(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(newParametersDocument(parameters))
+	case "secrets":
+		opt := NewBackupSecretsCommandOption()
+		opt.Concurrency = c.opt.Concurrency
+		opt.ListSecretsTps = c.opt.ListSecretsTps
+		opt.GetSecretValueTps = c.opt.GetSecretValueTps
+		secrets, err := c.client.backupSecretsCommand(opt).fetchSecrets(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(newSecretsDocument(secrets))
+	case "appconfig":
+		opt := NewBackupAppConfigCommandOption()
+		opt.Concurrency = c.opt.Concurrency
+		opt.AppConfigTps = c.opt.AppConfigTps
+		configurations, err := c.client.backupAppConfigCommand(opt).fetchHostedConfigurations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(newAppConfigDocument(configurations))
+	case "lambda":
+		opt := NewBackupLambdaCommandOption()
+		opt.ListFunctionsTps = c.opt.ListFunctionsTps
+		variables, err := c.client.backupLambdaCommand(opt).fetchEnvironmentVariables(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(newLambdaDocument(variables))
+	case "vault":
+		opt := NewBackupVaultCommandOption()
+		opt.VaultOption = c.opt.VaultOption
+		opt.VaultPaths = c.opt.VaultPaths
+		opt.VaultAllVersions = c.opt.VaultAllVersions
+		opt.Concurrency = c.opt.Concurrency
+		entries, err := c.client.backupVaultCommand(opt).fetchVaultEntries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := newVaultDocument(entries)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(doc)
+	default:
+		return nil, fmt.Errorf("unknown kind: %s", kind)
+	}
+}
+
+// detectBackupKind tells the kind of items a decrypted backup holds.
+func detectBackupKind(decrypted []byte) (string, error) {
+	doc, err := decodeBackup(decrypted)
+	if err != nil {
+		return "", err
+	}
+	if doc.Kind == "" {
+		return "", fmt.Errorf("cannot detect the kind of an empty backup, specify --kind")
+	}
+	return doc.Kind, nil
+}
+
+func parseDiffRecords(decrypted []byte, kind string) (map[string]diffRecord, error) {
+	doc, err := decodeBackup(decrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]diffRecord{}
+	for _, item := range doc.Items {
+		registerSecret(item.Value)
+		records[item.Name] = diffRecord{Name: item.Name, Value: item.Value, Metadata: item.metadata(kind)}
+	}
+	return records, nil
+}
+
+// diffBackups compares before with after, showing changed values as hashes
+// keyed with hashKey, or as they are if hashKey is nil.
+func diffBackups(before map[string]diffRecord, after map[string]diffRecord, hashKey []byte) backupDiff {
+	diff := backupDiff{Added: []string{}, Removed: []string{}, Changed: []diffChanged{}}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+	for name, b := range before {
+		a, ok := after[name]
+		if !ok {
+			diff.Removed = append(diff.Removed, name)
+			continue
+		}
+
+		changed := diffChanged{Name: name, Metadata: map[string]diffChange{}}
+		if a.Value != b.Value {
+			if hashKey == nil {
+				changed.Value = &diffChange{Before: b.Value, After: a.Value}
+			} else {
+				changed.Value = &diffChange{Before: keyedValueHash(hashKey, b.Value), After: keyedValueHash(hashKey, a.Value)}
+			}
+		}
+		fields := map[string]bool{}
+		for field := range b.Metadata {
+			fields[field] = true
+		}
+		for field := range a.Metadata {
+			fields[field] = true
+		}
+		for field := range fields {
+			if b.Metadata[field] != a.Metadata[field] {
+				changed.Metadata[field] = diffChange{Before: b.Metadata[field], After: a.Metadata[field]}
+			}
+		}
+		if changed.Value != nil || len(changed.Metadata) > 0 {
+			diff.Changed = append(diff.Changed, changed)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+	return diff
+}
+
+func printBackupDiff(w io.Writer, diff backupDiff) {
+	for _, name := range diff.Added {
+		fmt.Fprintf(w, "+ %s\n", name)
+	}
+	for _, name := range diff.Removed {
+		fmt.Fprintf(w, "- %s\n", name)
+	}
+	for _, changed := range diff.Changed {
+		fmt.Fprintf(w, "~ %s\n", changed.Name)
+		if changed.Value != nil {
+			fmt.Fprintf(w, "    value: %s -> %s\n", changed.Value.Before, changed.Value.After)
+		}
+		fields := make([]string, 0, len(changed.Metadata))
+		for field := range changed.Metadata {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			fmt.Fprintf(w, "    %s: %s -> %s\n", field, changed.Metadata[field].Before, changed.Metadata[field].After)
+		}
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(diff.Added), len(diff.Removed), len(diff.Changed))
+}
@@ -1,99 +1,92 @@
 package brsp
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/kms"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
-	"io"
+	"os"
 )
 
 type DownloadBackupCommand struct {
-	ssmClient *ssm.Client
-	s3Client  *s3.Client
-	kmsClient *kms.Client
+	ssmClient SSMAPI
+	s3Client  S3API
+	kmsClient KMSAPI
 	opt       *DownloadBackupCommandOption
 }
 
 type DownloadBackupCommandOption struct {
+	commandOption
 	BucketName        string `help:"S3 bucket name"`
 	Key               string `help:"S3 object key"`
 	WithDecryption    bool   `default:"false" help:"With decryption"`
 	DataKeyBucketName string `help:"data key bucket name"`
 	DataKeyKey        string `help:"data key key"`
 	KmsKey            string `help:"KMS key for decryption"`
+	Format            string `default:"json" enum:"json,yaml,dotenv,csv,shell,tree,k8s-secret,external-secret" help:"output format (json, yaml, dotenv, csv, shell, tree, k8s-secret or external-secret)"`
+	Output            string `help:"write to this file (mode 0600) instead of stdout; with --split, the directory to write to"`
+	Split             bool   `help:"write one file per parameter or secret under --output, mirroring the name hierarchy"`
+	K8sManifestOption
 }
 
-func NewDownloadBackupCommand(opt *DownloadBackupCommandOption) (*DownloadBackupCommand, error) {
-	awsConfig, err := getAwsConfig()
+// NewDownloadBackupCommandOption returns options set to the CLI defaults.
+func NewDownloadBackupCommandOption() *DownloadBackupCommandOption {
+	return withDefaults(&DownloadBackupCommandOption{})
+}
+
+func NewDownloadBackupCommand(ctx context.Context, opt *DownloadBackupCommandOption) (*DownloadBackupCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return NewClient(awsConfig, awsConfig).downloadBackupCommand(opt), nil
+}
+
+func (c *Client) downloadBackupCommand(opt *DownloadBackupCommandOption) *DownloadBackupCommand {
 	return &DownloadBackupCommand{
-		ssmClient: ssm.NewFromConfig(awsConfig),
-		s3Client:  s3.NewFromConfig(awsConfig),
-		kmsClient: kms.NewFromConfig(awsConfig),
+		ssmClient: c.SSM,
+		s3Client:  c.S3,
+		kmsClient: c.KMS,
 		opt:       opt,
-	}, nil
-
+	}
 }
 
-func (c *DownloadBackupCommand) Run() error {
-	output, err := c.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(c.opt.Key),
+func (c *DownloadBackupCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("download-backup")
+	decrypted, err := loadBackup(ctx, c.s3Client, c.kmsClient, backupLocation{
+		BucketName:        c.opt.BucketName,
+		Key:               c.opt.Key,
+		DataKeyBucketName: c.opt.DataKeyBucketName,
+		DataKeyKey:        c.opt.DataKeyKey,
 	})
 	if err != nil {
-		return err
+		return report, err
 	}
-	defer output.Body.Close()
 
-	data, err := io.ReadAll(output.Body)
+	items, err := parseBackupItems(decrypted)
 	if err != nil {
-		return err
+		return report, err
 	}
-
-	getNonceObjectOutput, err := c.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(fmt.Sprintf("%s.nonce", c.opt.Key)),
-	})
-	if err != nil {
-		return err
+	target := c.opt.Output
+	if target == "" {
+		target = "stdout"
 	}
-	defer getNonceObjectOutput.Body.Close()
-
-	nonce, err := io.ReadAll(getNonceObjectOutput.Body)
-	if err != nil {
-		return err
-	}
-	getObjectOutput, err := c.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(c.opt.DataKeyKey),
-	})
-	if err != nil {
-		return err
+	for _, item := range items {
+		report.add(ReportItem{Source: item.Name, Target: target, Action: ReportActionDownload})
 	}
 
-	dataKey, err := io.ReadAll(getObjectOutput.Body)
-	if err != nil {
-		return err
+	if c.opt.Split {
+		if c.opt.Output == "" {
+			return report, fmt.Errorf("--split requires --output")
+		}
+		return report, writeSplit(c.opt.Output, items)
 	}
 
-	decryptOutput, err := c.kmsClient.Decrypt(context.TODO(), &kms.DecryptInput{
-		CiphertextBlob: dataKey,
-	})
-	if err != nil {
-		return err
+	if c.opt.Output == "" {
+		return report, formatBackup(os.Stdout, decrypted, c.opt)
 	}
-
-	decrypted, err := decryptData(decryptOutput.Plaintext, nonce, data)
-	if err != nil {
-		return err
+	var buf bytes.Buffer
+	if err := formatBackup(&buf, decrypted, c.opt); err != nil {
+		return report, err
 	}
-
-	fmt.Println(string(decrypted))
-
-	return nil
+	return report, writeFile(c.opt.Output, buf.Bytes())
 }
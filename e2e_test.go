@@ -0,0 +1,2307 @@
+package brsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	testBucket     = "backup-bucket"
+	testDataKeyKey = "data-key"
+)
+
+// option returns the options made by newOption, with the CLI defaults, after
+// set changed them.
+func option[T any](newOption func() *T, set func(*T)) *T {
+	opt := newOption()
+	set(opt)
+	return opt
+}
+
+func generateTestDataKey(t *testing.T, ctx context.Context, client *Client) {
+	t.Helper()
+	_, err := client.GenerateDataKey(ctx, option(NewGenerateDataKeyCommandOption, func(o *GenerateDataKeyCommandOption) {
+		o.BucketName = testBucket
+		o.Key = testDataKeyKey
+		o.EncryptionKmsKey = "backup-key"
+	}))
+	if err != nil {
+		t.Fatalf("generate-data-key failed: %v", err)
+	}
+}
+
+// downloadTestBackup downloads the backup at key as JSON and returns its values by name.
+func downloadTestBackup(t *testing.T, ctx context.Context, client *Client, key string) map[string]string {
+	t.Helper()
+	output := filepath.Join(t.TempDir(), "backup.json")
+	_, err := client.DownloadBackup(ctx, option(NewDownloadBackupCommandOption, func(o *DownloadBackupCommandOption) {
+		o.BucketName = testBucket
+		o.Key = key
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Format = "json"
+		o.Output = output
+	}))
+	if err != nil {
+		t.Fatalf("download-backup failed: %v", err)
+	}
+	body, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := parseBackupItems(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backupItemValues(items)
+}
+
+func countReportItems(report *Report, action string) int {
+	n := 0
+	for _, item := range report.Items {
+		if item.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEndToEndParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters int
+		pageSize   int
+		ghosts     []string
+		onMissing  string
+		setup      func(aws *fakeAWS)
+		wantErr    bool
+	}{
+		{name: "single page", parameters: 3, pageSize: 50},
+		{name: "paginated", parameters: 25, pageSize: 10},
+		{
+			name:       "throttled",
+			parameters: 12,
+			pageSize:   5,
+			setup: func(aws *fakeAWS) {
+				aws.ssm.throttle("DescribeParameters", 2)
+				aws.ssm.throttle("GetParameters", 3)
+			},
+		},
+		{name: "invalid parameters skipped", parameters: 5, pageSize: 50, ghosts: []string{"/app/ghost"}, onMissing: "skip"},
+		{name: "invalid parameters fail", parameters: 5, pageSize: 50, ghosts: []string{"/app/ghost"}, onMissing: "fail", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			aws := newFakeAWS()
+			client := aws.client()
+			aws.ssm.pageSize = tt.pageSize
+			want := map[string]string{}
+			for i := range tt.parameters {
+				name := fmt.Sprintf("/app/parameter-%02d", i)
+				parameterType := ssmTypes.ParameterTypeString
+				if i%2 == 0 {
+					parameterType = ssmTypes.ParameterTypeSecureString
+				}
+				want[name] = fmt.Sprintf("value-%02d", i)
+				aws.ssm.put(name, parameterType, want[name])
+			}
+			for _, ghost := range tt.ghosts {
+				aws.ssm.ghosts[ghost] = true
+			}
+			if tt.setup != nil {
+				tt.setup(aws)
+			}
+			onMissing := tt.onMissing
+			if onMissing == "" {
+				onMissing = "fail"
+			}
+
+			generateTestDataKey(t, ctx, client)
+			report, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+				o.BucketName = testBucket
+				o.Key = "parameters"
+				o.DataKeyBucketName = testBucket
+				o.DataKeyKey = testDataKeyKey
+				o.OnMissing = onMissing
+				o.Concurrency = 3
+			}))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("backup-parameters succeeded, want an error")
+				}
+				if _, ok := aws.s3.object(testBucket, "parameters"); ok {
+					t.Error("backup-parameters failed but wrote a backup")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backup-parameters failed: %v", err)
+			}
+			if got := countReportItems(report, ReportActionBackup); got != tt.parameters {
+				t.Errorf("backed up %d parameters, want %d", got, tt.parameters)
+			}
+			if got := countReportItems(report, ReportActionSkip); got != len(tt.ghosts) {
+				t.Errorf("skipped %d parameters, want %d", got, len(tt.ghosts))
+			}
+
+			got := downloadTestBackup(t, ctx, client, "parameters")
+			if len(got) != len(want) {
+				t.Errorf("backup has %d parameters, want %d", len(got), len(want))
+			}
+			for name, value := range want {
+				if got[name] != value {
+					t.Errorf("backup value of %s is %q, want %q", name, got[name], value)
+				}
+			}
+
+			// Restore into an environment where every parameter but the
+			// first is a placeholder.
+			kept := "/app/parameter-00"
+			aws.ssm.put(kept, ssmTypes.ParameterTypeSecureString, "changed")
+			for name := range want {
+				if name != kept {
+					aws.ssm.put(name, ssmTypes.ParameterTypeString, placeholderValue)
+				}
+			}
+			journal := filepath.Join(t.TempDir(), "journal.json")
+			report, err = client.RestoreParameters(ctx, option(NewRestoreParametersCommandOption, func(o *RestoreParametersCommandOption) {
+				o.BucketName = testBucket
+				o.Key = "parameters"
+				o.DataKeyBucketName = testBucket
+				o.DataKeyKey = testDataKeyKey
+				o.Journal = journal
+				o.DryRun = false
+			}))
+			if err != nil {
+				t.Fatalf("restore-parameters failed: %v", err)
+			}
+			if got := countReportItems(report, ReportActionRestore); got != tt.parameters-1 {
+				t.Errorf("restored %d parameters, want %d", got, tt.parameters-1)
+			}
+			for name, value := range want {
+				if name == kept {
+					value = "changed"
+				}
+				if got := aws.ssm.value(name); got != value {
+					t.Errorf("value of %s after restore is %q, want %q", name, got, value)
+				}
+			}
+
+			_, err = client.Rollback(ctx, option(NewRollbackCommandOption, func(o *RollbackCommandOption) {
+				o.Journal = journal
+			}))
+			if err != nil {
+				t.Fatalf("rollback failed: %v", err)
+			}
+			for name := range want {
+				value := placeholderValue
+				if name == kept {
+					value = "changed"
+				}
+				if got := aws.ssm.value(name); got != value {
+					t.Errorf("value of %s after rollback is %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestEndToEndSecrets(t *testing.T) {
+	tests := []struct {
+		name                string
+		secrets             int
+		pageSize            int
+		batchGetSecretValue bool
+		setup               func(aws *fakeAWS)
+		wantBatchCalls      bool
+	}{
+		{name: "batch", secrets: 25, pageSize: 10, batchGetSecretValue: true, wantBatchCalls: true},
+		{name: "without batch", secrets: 5, pageSize: 2, batchGetSecretValue: false},
+		{
+			name:                "batch unsupported",
+			secrets:             25,
+			pageSize:            100,
+			batchGetSecretValue: true,
+			setup: func(aws *fakeAWS) {
+				aws.secretsmanager.fail("BatchGetSecretValue", &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "denied"})
+			},
+		},
+		{
+			name:                "throttled",
+			secrets:             40,
+			pageSize:            10,
+			batchGetSecretValue: true,
+			setup: func(aws *fakeAWS) {
+				aws.secretsmanager.throttle("ListSecrets", 2)
+				aws.secretsmanager.throttle("BatchGetSecretValue", 2)
+			},
+			wantBatchCalls: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			aws := newFakeAWS()
+			client := aws.client()
+			aws.secretsmanager.pageSize = tt.pageSize
+			want := map[string]string{}
+			for i := range tt.secrets {
+				name := fmt.Sprintf("app/secret-%02d", i)
+				value, err := json.Marshal(map[string]string{"password": fmt.Sprintf("password-%02d", i)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want[name] = string(value)
+				aws.secretsmanager.put(name, want[name])
+			}
+			if tt.setup != nil {
+				tt.setup(aws)
+			}
+
+			generateTestDataKey(t, ctx, client)
+			report, err := client.BackupSecrets(ctx, option(NewBackupSecretsCommandOption, func(o *BackupSecretsCommandOption) {
+				o.BucketName = testBucket
+				o.Key = "secrets"
+				o.DataKeyBucketName = testBucket
+				o.DataKeyKey = testDataKeyKey
+				o.Concurrency = 2
+				o.BatchGetSecretValue = tt.batchGetSecretValue
+			}))
+			if err != nil {
+				t.Fatalf("backup-secrets failed: %v", err)
+			}
+			if got := countReportItems(report, ReportActionBackup); got != tt.secrets {
+				t.Errorf("backed up %d secrets, want %d", got, tt.secrets)
+			}
+			batchCalls := aws.secretsmanager.count("BatchGetSecretValue")
+			getCalls := aws.secretsmanager.count("GetSecretValue")
+			if tt.wantBatchCalls && getCalls > 0 {
+				t.Errorf("called GetSecretValue %d times, want BatchGetSecretValue only", getCalls)
+			}
+			if !tt.wantBatchCalls && getCalls != tt.secrets {
+				t.Errorf("called GetSecretValue %d times, want %d", getCalls, tt.secrets)
+			}
+			if !tt.batchGetSecretValue && batchCalls > 0 {
+				t.Errorf("called BatchGetSecretValue %d times with batching disabled", batchCalls)
+			}
+
+			got := downloadTestBackup(t, ctx, client, "secrets")
+			if len(got) != len(want) {
+				t.Errorf("backup has %d secrets, want %d", len(got), len(want))
+			}
+			for name, value := range want {
+				if got[name] != value {
+					t.Errorf("backup value of %s is %q, want %q", name, got[name], value)
+				}
+			}
+
+			// Restore into placeholder secrets named <name>_<suffix>.
+			for name := range want {
+				aws.secretsmanager.put(name+"_restored", placeholderValue)
+			}
+			report, err = client.RestoreSecrets(ctx, option(NewRestoreSecretsCommandOption, func(o *RestoreSecretsCommandOption) {
+				o.BucketName = testBucket
+				o.Key = "secrets"
+				o.DataKeyBucketName = testBucket
+				o.DataKeyKey = testDataKeyKey
+				o.Journal = filepath.Join(t.TempDir(), "journal.json")
+				o.DryRun = false
+			}))
+			if err != nil {
+				t.Fatalf("restore-secrets failed: %v", err)
+			}
+			if got := countReportItems(report, ReportActionRestore); got != tt.secrets {
+				t.Errorf("restored %d secrets, want %d", got, tt.secrets)
+			}
+			for name, value := range want {
+				if got := aws.secretsmanager.value(name + "_restored"); got != value {
+					t.Errorf("value of %s_restored after restore is %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestEndToEndBackupAll(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, "password")
+	aws.secretsmanager.put("app/api", `{"token":"token"}`)
+	aws.secretsmanager.put("app/db", `{"password":"password"}`)
+	generateTestDataKey(t, ctx, client)
+
+	opt := NewBackupAllCommandOption()
+	opt.Accounts = []string{"arn:aws:iam::111111111111:role/backup", "arn:aws:iam::222222222222:role/backup"}
+	opt.Regions = []string{"ap-northeast-1"}
+	opt.BucketName = testBucket
+	opt.KeyPrefix = "backups"
+	opt.DataKeyBucketName = testBucket
+	opt.DataKeyKey = testDataKeyKey
+	var targets []backupTarget
+	var mu sync.Mutex
+	cmd := &BackupAllCommand{
+		s3Client: aws.s3,
+		opt:      opt,
+		sourceClient: func(ctx context.Context, target backupTarget) (*Client, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			targets = append(targets, target)
+			return client, nil
+		},
+	}
+	report, err := cmd.Run(ctx)
+	if err != nil {
+		t.Fatalf("backup-all failed: %v", err)
+	}
+	if got := countReportItems(report, ReportActionBackup); got != 4 {
+		t.Errorf("took %d backups, want one of each default kind per account", got)
+	}
+	if len(targets) != 4 {
+		t.Errorf("made clients for %d targets, want 4", len(targets))
+	}
+	for _, account := range []string{"111111111111", "222222222222"} {
+		prefix := "backups/" + account + "/ap-northeast-1/"
+		if got := downloadTestBackup(t, ctx, client, prefix+"parameters"); got["/app/db"] != "password" {
+			t.Errorf("parameters backup of %s = %v, want /app/db", account, got)
+		}
+		if got := downloadTestBackup(t, ctx, client, prefix+"secrets"); got["app/api"] != `{"token":"token"}` {
+			t.Errorf("secrets backup of %s = %v, want app/api", account, got)
+		}
+	}
+	// The backups use the defaults of the backup commands, such as batched
+	// secret reads.
+	if aws.secretsmanager.count("BatchGetSecretValue") == 0 {
+		t.Error("secrets were not read with BatchGetSecretValue")
+	}
+}
+
+// captureStdout returns what fn writes to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		body, _ := io.ReadAll(r)
+		output <- body
+	}()
+	fn()
+	w.Close()
+	return string(<-output)
+}
+
+func TestEndToEndDiffBackup(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, "secret")
+	aws.ssm.put("/app/host", ssmTypes.ParameterTypeString, "db.example.com")
+	generateTestDataKey(t, ctx, client)
+	if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+	})); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, "rotated")
+	aws.ssm.put("/app/port", ssmTypes.ParameterTypeString, "5432")
+
+	var report *Report
+	var err error
+	output := captureStdout(t, func() {
+		report, err = client.DiffBackup(ctx, option(NewDiffBackupCommandOption, func(o *DiffBackupCommandOption) {
+			o.BucketName = testBucket
+			o.Key = "parameters"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Format = "json"
+			o.Concurrency = 1
+			o.GetParametersTps = 0
+		}))
+	})
+	if err != nil {
+		t.Fatalf("diff-backup failed: %v", err)
+	}
+	if countReportItems(report, ReportActionAdded) != 1 || countReportItems(report, ReportActionChanged) != 1 {
+		t.Errorf("diff report = %+v, want /app/port added and /app/db changed", report.Items)
+	}
+	var diff backupDiff
+	if err := json.Unmarshal([]byte(output), &diff); err != nil {
+		t.Fatalf("diff-backup output is not JSON: %v\n%s", err, output)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Value == nil {
+		t.Fatalf("diff = %+v, want the value of /app/db changed", diff)
+	}
+	// The value hashes are keyed with the data key, so they cannot be
+	// checked against a guess such as the plain hash of "secret".
+	before := diff.Changed[0].Value.Before
+	if !strings.HasPrefix(before, "hmac-sha256:") || before == valueHash("secret") || strings.Contains(output, "secret") {
+		t.Errorf("value of /app/db before is %q, want a keyed hash", before)
+	}
+}
+
+func TestEndToEndRestoreDryRun(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, "secret")
+	generateTestDataKey(t, ctx, client)
+	if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.OnMissing = "fail"
+		o.Concurrency = 1
+	})); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, placeholderValue)
+	report, err := client.RestoreParameters(ctx, option(NewRestoreParametersCommandOption, func(o *RestoreParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.DryRun = true
+	}))
+	if err != nil {
+		t.Fatalf("restore-parameters failed: %v", err)
+	}
+	if got := countReportItems(report, ReportActionWouldRestore); got != 1 {
+		t.Errorf("dry run reported %d parameters to restore, want 1", got)
+	}
+	if got := aws.ssm.value("/app/db"); got != placeholderValue {
+		t.Errorf("dry run changed /app/db to %q", got)
+	}
+	if got := aws.ssm.count("PutParameter"); got != 0 {
+		t.Errorf("dry run called PutParameter %d times", got)
+	}
+}
+
+// cancelingSSM cancels a context after the first PutParameter call.
+type cancelingSSM struct {
+	*fakeSSM
+	cancel context.CancelFunc
+}
+
+func (f *cancelingSSM) PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	output, err := f.fakeSSM.PutParameter(ctx, params, optFns...)
+	f.cancel()
+	return output, err
+}
+
+func TestEndToEndRestorePlaintextFileWithoutDataKey(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "parameters.json")
+	if err := os.WriteFile(file, []byte(`[{"Name":"/app/db","Type":"SecureString","Value":"secret"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, placeholderValue)
+	restore := func(plaintextJournal bool) (*Report, error) {
+		return client.RestoreParameters(ctx, option(NewRestoreParametersCommandOption, func(o *RestoreParametersCommandOption) {
+			o.FromFile = file
+			o.Journal = filepath.Join(dir, "journal.json")
+			o.PlaintextJournal = plaintextJournal
+			o.DryRun = false
+		}))
+	}
+
+	if _, err := restore(false); err == nil || !strings.Contains(err.Error(), "--plaintext-journal") {
+		t.Fatalf("restore without a data key returned %v, want an error suggesting --plaintext-journal", err)
+	}
+	if got := aws.ssm.value("/app/db"); got != placeholderValue {
+		t.Fatalf("/app/db = %q after the refused restore, want the placeholder", got)
+	}
+
+	report, err := restore(true)
+	if err != nil {
+		t.Fatalf("restore-parameters --plaintext-journal failed: %v", err)
+	}
+	if got := countReportItems(report, ReportActionRestore); got != 1 {
+		t.Errorf("restored %d parameters, want 1", got)
+	}
+	if got := aws.ssm.value("/app/db"); got != "secret" {
+		t.Errorf("/app/db = %q, want secret", got)
+	}
+	journal, err := loadRestoreJournal(filepath.Join(dir, "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !journal.Plaintext || len(journal.Entries) != 1 || string(journal.Entries[0].PreviousValue) != placeholderValue {
+		t.Errorf("journal = %+v, want a plaintext entry holding the placeholder", journal)
+	}
+
+	// Rollback needs no data key either.
+	if _, err := client.Rollback(ctx, option(NewRollbackCommandOption, func(o *RollbackCommandOption) {
+		o.Journal = filepath.Join(dir, "journal.json")
+	})); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if got := aws.ssm.value("/app/db"); got != placeholderValue {
+		t.Errorf("/app/db = %q after rollback, want the placeholder", got)
+	}
+}
+
+func TestEndToEndRestoreFromFile(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, "secret")
+	generateTestDataKey(t, ctx, client)
+	if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+	})); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+	dataKey, err := getDataKey(ctx, client.KMS, client.S3, testBucket, testDataKeyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeTestFile := func(name string, body []byte) string {
+		t.Helper()
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, body, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	envelope, _ := aws.s3.object(testBucket, "parameters")
+	encryptedDataKey, _ := aws.s3.object(testBucket, testDataKeyKey)
+	legacy, nonce, err := encryptData(dataKey, []byte(`[{"Name":"/app/db","Type":"SecureString","Value":"secret"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile("legacy.nonce", nonce)
+	files := map[string]string{
+		"plaintext": writeTestFile("plaintext.json", []byte(`{"schemaVersion":2,"kind":"parameters","items":[{"name":"/app/db","value":"secret","type":"SecureString"}]}`)),
+		"envelope":  writeTestFile("envelope", envelope),
+		"legacy":    writeTestFile("legacy", legacy),
+		"unpaired":  writeTestFile("unpaired", legacy),
+	}
+	identityFile := writeTestFile("identity", []byte(base64.StdEncoding.EncodeToString(dataKey)+"\n"))
+	dataKeyFile := writeTestFile("data-key", encryptedDataKey)
+
+	tests := []struct {
+		name    string
+		file    string
+		set     func(o *RestoreParametersCommandOption)
+		wantErr string
+	}{
+		{name: "plaintext file", file: "plaintext"},
+		{name: "envelope file", file: "envelope"},
+		{name: "legacy file with its nonce", file: "legacy"},
+		{name: "legacy file without its nonce", file: "unpaired", wantErr: "nonce cannot be read"},
+		{
+			name: "envelope file with an identity file",
+			file: "envelope",
+			set: func(o *RestoreParametersCommandOption) {
+				o.DataKeyKey = ""
+				o.IdentityFile = identityFile
+			},
+		},
+		{
+			name: "legacy file with a data key file",
+			file: "legacy",
+			set: func(o *RestoreParametersCommandOption) {
+				o.DataKeyKey = ""
+				o.DataKeyFile = dataKeyFile
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, placeholderValue)
+			report, err := client.RestoreParameters(ctx, option(NewRestoreParametersCommandOption, func(o *RestoreParametersCommandOption) {
+				o.FromFile = files[tt.file]
+				o.DataKeyBucketName = testBucket
+				o.DataKeyKey = testDataKeyKey
+				o.Journal = filepath.Join(t.TempDir(), "journal.json")
+				o.DryRun = false
+				if tt.set != nil {
+					tt.set(o)
+				}
+			}))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("restore-parameters returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				if got := aws.ssm.value("/app/db"); got != placeholderValue {
+					t.Errorf("/app/db = %q after the failed restore, want the placeholder", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("restore-parameters failed: %v", err)
+			}
+			if got := countReportItems(report, ReportActionRestore); got != 1 {
+				t.Errorf("restored %d parameters, want 1", got)
+			}
+			if got := aws.ssm.value("/app/db"); got != "secret" {
+				t.Errorf("/app/db = %q, want secret", got)
+			}
+		})
+	}
+}
+
+func TestEndToEndRestorePlanTampered(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, "secret")
+	generateTestDataKey(t, ctx, client)
+	if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+	})); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, placeholderValue)
+	dir := t.TempDir()
+	planFile := filepath.Join(dir, "plan.json")
+	if _, err := client.RestorePlan(ctx, option(NewRestorePlanCommandOption, func(o *RestorePlanCommandOption) {
+		o.Kind = "auto"
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Output = planFile
+	})); err != nil {
+		t.Fatalf("restore plan failed: %v", err)
+	}
+	body, err := os.ReadFile(planFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tamper re-points the plan at a backup and identity file of someone
+	// else's and signs it again with their key.
+	tamper := func(t *testing.T, fromFile bool) string {
+		t.Helper()
+		var plan restorePlan
+		if err := json.Unmarshal(body, &plan); err != nil {
+			t.Fatal(err)
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		identity := filepath.Join(dir, "other-identity")
+		if err := os.WriteFile(identity, []byte(base64.StdEncoding.EncodeToString(key)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		plan.Source.IdentityFile = identity
+		plan.Source.DataKeyKey = ""
+		if fromFile {
+			backup := filepath.Join(dir, "other.json")
+			if err := os.WriteFile(backup, []byte(`[{"Name":"/app/db","Type":"SecureString","Value":"injected"}]`), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			plan.Source.FromFile = backup
+			plan.Items[0].ValueHash = keyedValueHash(valueHashKey(key), "injected")
+		}
+		plan.Items[0].LiveHash = keyedValueHash(valueHashKey(key), placeholderValue)
+		if err := plan.sign(key); err != nil {
+			t.Fatal(err)
+		}
+		tampered, err := json.Marshal(plan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, "tampered.json")
+		if err := os.WriteFile(file, tampered, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	apply := func(plan string, set func(o *RestoreApplyCommandOption)) error {
+		_, err := client.RestoreApply(ctx, option(NewRestoreApplyCommandOption, func(o *RestoreApplyCommandOption) {
+			o.Plan = plan
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Journal = filepath.Join(dir, "journal.json")
+			if set != nil {
+				set(o)
+			}
+		}))
+		return err
+	}
+
+	for _, tt := range []struct {
+		name    string
+		plan    func(t *testing.T) string
+		set     func(o *RestoreApplyCommandOption)
+		wantErr string
+	}{
+		{
+			name:    "no data key",
+			plan:    func(t *testing.T) string { return planFile },
+			set:     func(o *RestoreApplyCommandOption) { o.DataKeyKey = "" },
+			wantErr: "a data key is required",
+		},
+		{
+			name:    "re-pointed at another identity file",
+			plan:    func(t *testing.T) string { return tamper(t, false) },
+			wantErr: "plan signature is invalid",
+		},
+		{
+			name:    "re-pointed at another backup file",
+			plan:    func(t *testing.T) string { return tamper(t, true) },
+			wantErr: "specify it with --from-file",
+		},
+		{
+			name: "re-pointed at another backup file given again",
+			plan: func(t *testing.T) string { return tamper(t, true) },
+			set: func(o *RestoreApplyCommandOption) {
+				o.FromFile = filepath.Join(dir, "other.json")
+			},
+			wantErr: "plan signature is invalid",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := apply(tt.plan(t), tt.set); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("restore apply returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if got := aws.ssm.value("/app/db"); got != placeholderValue {
+				t.Errorf("/app/db = %q, want the placeholder left alone", got)
+			}
+		})
+	}
+
+	if err := apply(planFile, nil); err != nil {
+		t.Fatalf("restore apply of the original plan failed: %v", err)
+	}
+	if got := aws.ssm.value("/app/db"); got != "secret" {
+		t.Errorf("/app/db = %q, want secret", got)
+	}
+}
+
+func TestEndToEndInterrupted(t *testing.T) {
+	aws := newFakeAWS()
+	client := aws.client()
+	want := map[string]string{}
+	for i := range 3 {
+		name := fmt.Sprintf("/app/parameter-%02d", i)
+		want[name] = fmt.Sprintf("value-%02d", i)
+		aws.ssm.put(name, ssmTypes.ParameterTypeString, want[name])
+	}
+	generateTestDataKey(t, context.Background(), client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.OnMissing = "fail"
+		o.Concurrency = 1
+	}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted backup-parameters returned %v, want context.Canceled", err)
+	}
+	if _, ok := aws.s3.object(testBucket, "parameters"); ok {
+		t.Error("interrupted backup-parameters wrote a backup")
+	}
+
+	if _, err := client.BackupParameters(context.Background(), option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.OnMissing = "fail"
+		o.Concurrency = 1
+	})); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+	for name := range want {
+		aws.ssm.put(name, ssmTypes.ParameterTypeString, placeholderValue)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	client.SSM = &cancelingSSM{fakeSSM: aws.ssm, cancel: cancel}
+	report, err := client.RestoreParameters(ctx, option(NewRestoreParametersCommandOption, func(o *RestoreParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Journal = filepath.Join(t.TempDir(), "journal.json")
+		o.RollbackOnFailure = true
+		o.DryRun = false
+	}))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted restore-parameters returned %v, want context.Canceled", err)
+	}
+	if got := countReportItems(report, ReportActionRestore); got != 1 {
+		t.Errorf("restored %d parameters before the interruption, want 1", got)
+	}
+	if got := countReportItems(report, ReportActionSkip); got != 2 {
+		t.Errorf("reported %d parameters as not attempted, want 2", got)
+	}
+	if got := aws.ssm.value("/app/parameter-00"); got != want["/app/parameter-00"] {
+		t.Errorf("value of /app/parameter-00 is %q, want the restored value", got)
+	}
+	for _, name := range []string{"/app/parameter-01", "/app/parameter-02"} {
+		if got := aws.ssm.value(name); got != placeholderValue {
+			t.Errorf("value of %s is %q, want it left alone after the interruption", name, got)
+		}
+	}
+}
+
+func TestEndToEndBackupIsPromotedOnlyWhenVerified(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, "first")
+	generateTestDataKey(t, ctx, client)
+	opt := option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.OnMissing = "fail"
+		o.Concurrency = 1
+	})
+	if _, err := client.BackupParameters(ctx, opt); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		setup func()
+	}{
+		{name: "corrupted at rest", setup: func() { aws.s3.corrupt = true }},
+		{name: "promotion fails", setup: func() {
+			aws.s3.fail("CopyObject", &smithy.GenericAPIError{Code: "InternalError", Message: "internal error"})
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, "second")
+			tt.setup()
+			if _, err := client.BackupParameters(ctx, opt); err == nil {
+				t.Fatal("backup-parameters succeeded, want an error")
+			}
+			aws.s3.corrupt = false
+			aws.s3.fail("CopyObject", nil)
+
+			if got := downloadTestBackup(t, ctx, client, "parameters")["/app/db"]; got != "first" {
+				t.Errorf("backup holds %q after a failed backup, want the previous backup", got)
+			}
+			for _, key := range aws.s3.keys() {
+				if strings.Contains(key, ".staging-") {
+					t.Errorf("staging object %s is left behind", key)
+				}
+			}
+		})
+	}
+}
+
+func TestEndToEndObjectLock(t *testing.T) {
+	locked := BackupObjectOption{
+		StorageClass:   "GLACIER_IR",
+		SseKmsKeyId:    "backup-object-key",
+		ObjectLockMode: "compliance",
+		Retention:      24 * time.Hour,
+		LegalHold:      true,
+	}
+	for _, tt := range []struct {
+		name       string
+		objOpt     BackupObjectOption
+		versioning bool
+		objectLock bool
+		wantErr    string
+	}{
+		{name: "locked", objOpt: locked, versioning: true, objectLock: true},
+		{name: "versioning disabled", objOpt: locked, objectLock: true, wantErr: "does not have versioning enabled"},
+		{name: "object lock disabled", objOpt: locked, versioning: true, wantErr: "does not have Object Lock enabled"},
+		{name: "required", objOpt: BackupObjectOption{RequireObjectLock: true}, versioning: true, wantErr: "does not have Object Lock enabled"},
+		{name: "mode without retention", objOpt: BackupObjectOption{ObjectLockMode: "governance"}, versioning: true, objectLock: true, wantErr: "--retention is required"},
+		{name: "unlocked", objOpt: BackupObjectOption{ObjectLockMode: "none"}},
+		{name: "bucket default retention", objOpt: BackupObjectOption{ObjectLockMode: "none"}, versioning: true, objectLock: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			aws := newFakeAWS()
+			aws.s3.versioning = tt.versioning
+			aws.s3.objectLock = tt.objectLock
+			client := aws.client()
+			aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, "value")
+			generateTestDataKey(t, ctx, client)
+
+			start := time.Now()
+			_, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+				o.BucketName = testBucket
+				o.Key = "parameters"
+				o.DataKeyBucketName = testBucket
+				o.DataKeyKey = testDataKeyKey
+				o.BackupObjectOption = tt.objOpt
+				o.OnMissing = "fail"
+				o.Concurrency = 1
+			}))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				if n := aws.ssm.count("GetParameters"); n != 0 {
+					t.Errorf("GetParameters called %d times before the preflight failed", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backup-parameters failed: %v", err)
+			}
+
+			// In a bucket with Object Lock, the backup is written directly,
+			// since a staging object would be locked too.
+			var written backupObjectSettings
+			if tt.objectLock {
+				if len(aws.s3.copies) != 0 {
+					t.Errorf("got %d CopyObject calls in a bucket with Object Lock, want none", len(aws.s3.copies))
+				}
+				for _, put := range aws.s3.puts {
+					if strings.Contains(*put.Key, ".staging-") {
+						t.Errorf("staging object %s written in a bucket with Object Lock", *put.Key)
+					}
+					if *put.Key == "parameters" {
+						written = backupObjectSettings{put.StorageClass, put.ServerSideEncryption, put.SSEKMSKeyId, put.ObjectLockMode, put.ObjectLockRetainUntilDate, put.ObjectLockLegalHoldStatus}
+					}
+				}
+			} else {
+				if len(aws.s3.copies) != 1 {
+					t.Fatalf("got %d CopyObject calls, want 1", len(aws.s3.copies))
+				}
+				copied := aws.s3.copies[0]
+				written = backupObjectSettings{copied.StorageClass, copied.ServerSideEncryption, copied.SSEKMSKeyId, copied.ObjectLockMode, copied.ObjectLockRetainUntilDate, copied.ObjectLockLegalHoldStatus}
+			}
+			if !tt.objOpt.locked() {
+				if written.lockMode != "" || written.legalHold != "" || written.sseKmsKeyId != nil {
+					t.Errorf("unlocked backup was written with %+v", written)
+				}
+				return
+			}
+			if written.storageClass != s3Types.StorageClassGlacierIr {
+				t.Errorf("storage class = %s, want GLACIER_IR", written.storageClass)
+			}
+			if written.sse != s3Types.ServerSideEncryptionAwsKms || written.sseKmsKeyId == nil || *written.sseKmsKeyId != "backup-object-key" {
+				t.Errorf("encryption = %s %v, want aws:kms backup-object-key", written.sse, written.sseKmsKeyId)
+			}
+			if written.lockMode != s3Types.ObjectLockModeCompliance {
+				t.Errorf("object lock mode = %s, want COMPLIANCE", written.lockMode)
+			}
+			if until := written.retainUntil; until == nil || until.Before(start.Add(24*time.Hour)) {
+				t.Errorf("retain until = %v, want at least 24h after the backup", until)
+			}
+			if written.legalHold != s3Types.ObjectLockLegalHoldStatusOn {
+				t.Errorf("legal hold = %s, want ON", written.legalHold)
+			}
+		})
+	}
+}
+
+// backupObjectSettings are the settings a backup object was written with.
+type backupObjectSettings struct {
+	storageClass s3Types.StorageClass
+	sse          s3Types.ServerSideEncryption
+	sseKmsKeyId  *string
+	lockMode     s3Types.ObjectLockMode
+	retainUntil  *time.Time
+	legalHold    s3Types.ObjectLockLegalHoldStatus
+}
+
+func TestEndToEndVersionedBucketCleanup(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	aws.s3.versioning = true
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, "value")
+	generateTestDataKey(t, ctx, client)
+	// The nonce of a backup written by an older version.
+	aws.s3.store(testBucket, "parameters.nonce", []byte("nonce"))
+
+	for range 2 {
+		if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+			o.BucketName = testBucket
+			o.Key = "parameters"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+		})); err != nil {
+			t.Fatalf("backup-parameters failed: %v", err)
+		}
+	}
+	if len(aws.s3.deleteMarkers) > 0 {
+		t.Errorf("objects deleted without a version ID: %v", aws.s3.deleteMarkers)
+	}
+	want := []string{testBucket + "/" + testDataKeyKey, testBucket + "/parameters", testBucket + "/parameters.nonce"}
+	if got := aws.s3.keys(); !slices.Equal(got, want) {
+		t.Errorf("objects after the backups are %v, want %v", got, want)
+	}
+	// The two staging objects.
+	if n := aws.s3.count("DeleteObject"); n != 2 {
+		t.Errorf("DeleteObject called %d times, want 2", n)
+	}
+}
+
+func TestEndToEndLegacyBackupVersionKept(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	aws.s3.versioning = true
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, "new")
+	generateTestDataKey(t, ctx, client)
+	dataKey, err := getDataKey(ctx, client.KMS, client.S3, testBucket, testDataKeyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, nonce, err := encryptData(dataKey, []byte(`[{"Name":"/app/db","Type":"String","Value":"old"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := aws.s3.store(testBucket, "parameters", ciphertext)
+	aws.s3.store(testBucket, "parameters.nonce", nonce)
+
+	if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+	})); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+	if got := downloadTestBackup(t, ctx, client, "parameters")["/app/db"]; got != "new" {
+		t.Errorf("current backup holds %q, want new", got)
+	}
+
+	// The legacy backup, now a noncurrent version, is restored with its nonce.
+	stored, err := getObjectVersion(ctx, client.S3, testBucket, "parameters", previous)
+	if err != nil {
+		t.Fatalf("failed to read the previous version: %v", err)
+	}
+	storedNonce, err := getObject(ctx, client.S3, testBucket, "parameters.nonce")
+	if err != nil {
+		t.Fatalf("nonce of the previous version is gone: %v", err)
+	}
+	decrypted, err := decryptData(dataKey, storedNonce, stored)
+	if err != nil {
+		t.Fatalf("previous version cannot be decrypted: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "previous.json")
+	if err := os.WriteFile(file, decrypted, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, placeholderValue)
+	if _, err := client.RestoreParameters(ctx, option(NewRestoreParametersCommandOption, func(o *RestoreParametersCommandOption) {
+		o.FromFile = file
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Journal = filepath.Join(t.TempDir(), "journal.json")
+		o.DryRun = false
+	})); err != nil {
+		t.Fatalf("restore of the previous version failed: %v", err)
+	}
+	if got := aws.ssm.value("/app/db"); got != "old" {
+		t.Errorf("/app/db = %q, want the value of the previous version", got)
+	}
+}
+
+func TestEndToEndIncremental(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/a", ssmTypes.ParameterTypeString, "a1")
+	aws.ssm.put("/app/b", ssmTypes.ParameterTypeSecureString, "b1")
+	aws.ssm.put("/app/c", ssmTypes.ParameterTypeString, "c1")
+	generateTestDataKey(t, ctx, client)
+
+	backup := func(t *testing.T) *Report {
+		t.Helper()
+		report, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+			o.BucketName = testBucket
+			o.Key = "parameters"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Incremental = true
+			o.FullEvery = 3
+			o.SkipUnchanged = true
+			o.OnMissing = "fail"
+			o.Concurrency = 1
+		}))
+		if err != nil {
+			t.Fatalf("backup-parameters failed: %v", err)
+		}
+		return report
+	}
+	dataKey, err := getDataKey(ctx, client.KMS, client.S3, testBucket, testDataKeyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := func(t *testing.T) backupManifest {
+		t.Helper()
+		payload, err := readBackupPayload(ctx, client.S3, testBucket, "parameters", dataKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, ok := parseBackupManifest(payload)
+		if !ok {
+			t.Fatalf("parameters is not the manifest of an incremental backup")
+		}
+		return m
+	}
+	// generation reads the generation of the current manifest with sequence.
+	generation := func(t *testing.T, sequence int) backupGeneration {
+		t.Helper()
+		m := manifest(t)
+		for _, ref := range m.Generations {
+			if ref.Sequence == sequence {
+				if want := fmt.Sprintf("parameters.generations/%s/%08d", m.ChainID, sequence); ref.Key != want {
+					t.Errorf("generation %d is at %s, want %s", sequence, ref.Key, want)
+				}
+				g, err := readGeneration(ctx, client.S3, testBucket, dataKey, m.ChainID, ref)
+				if err != nil {
+					t.Fatalf("failed to read generation %d: %v", sequence, err)
+				}
+				return g
+			}
+		}
+		t.Fatalf("manifest has no generation %d", sequence)
+		return backupGeneration{}
+	}
+	assertBackup := func(t *testing.T, want map[string]string) {
+		t.Helper()
+		got := downloadTestBackup(t, ctx, client, "parameters")
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("reconstructed backup = %v, want %v", got, want)
+		}
+	}
+
+	backup(t)
+	if g := generation(t, 1); !g.Full || len(g.Records) != 3 {
+		t.Fatalf("generation 1 = full %v with %d records, want a full snapshot of 3", g.Full, len(g.Records))
+	}
+	firstChain := manifest(t)
+
+	aws.ssm.put("/app/b", ssmTypes.ParameterTypeSecureString, "b2")
+	aws.ssm.put("/app/d", ssmTypes.ParameterTypeString, "d1")
+	aws.ssm.mu.Lock()
+	delete(aws.ssm.parameters, "/app/c")
+	aws.ssm.mu.Unlock()
+	report := backup(t)
+	g := generation(t, 2)
+	if g.Full || len(g.Records) != 2 || fmt.Sprint(g.Deleted) != "[/app/c]" {
+		t.Errorf("generation 2 = full %v with %d records deleting %v, want 2 changed records deleting /app/c", g.Full, len(g.Records), g.Deleted)
+	}
+	if n := countReportItems(report, ReportActionSkip); n != 1 {
+		t.Errorf("reported %d unchanged items, want 1", n)
+	}
+	assertBackup(t, map[string]string{"/app/a": "a1", "/app/b": "b2", "/app/d": "d1"})
+
+	puts := aws.s3.count("PutObject")
+	report = backup(t)
+	if n := aws.s3.count("PutObject"); n != puts {
+		t.Errorf("unchanged backup wrote %d objects", n-puts)
+	}
+	if n := countReportItems(report, ReportActionSkip); n != 3 {
+		t.Errorf("reported %d unchanged items, want 3", n)
+	}
+
+	aws.ssm.put("/app/a", ssmTypes.ParameterTypeString, "a2")
+	backup(t)
+	if g := generation(t, 3); g.Full || len(g.Records) != 1 {
+		t.Errorf("generation 3 = full %v with %d records, want 1 changed record", g.Full, len(g.Records))
+	}
+	aws.ssm.put("/app/a", ssmTypes.ParameterTypeString, "a3")
+	backup(t)
+	if g := generation(t, 4); !g.Full || len(g.Records) != 3 {
+		t.Errorf("generation 4 = full %v with %d records, want a full snapshot of 3 after --full-every generations", g.Full, len(g.Records))
+	}
+	if chain := manifest(t).ChainID; chain == "" || chain == firstChain.ChainID {
+		t.Errorf("full snapshot continued chain %q, want a new chain", chain)
+	}
+	assertBackup(t, map[string]string{"/app/a": "a3", "/app/b": "b2", "/app/d": "d1"})
+
+	// A chain restarted without a previous manifest, e.g. after a full
+	// backup to the same key, does not overwrite the first generation of
+	// an earlier chain.
+	first, _ := aws.s3.object(testBucket, firstChain.Generations[0].Key)
+	if err := writeBackup(ctx, client.S3, testBucket, "parameters", dataKey, []byte(`{"schemaVersion":2,"kind":"parameters","items":[]}`), BackupObjectOption{}); err != nil {
+		t.Fatal(err)
+	}
+	backup(t)
+	if g := generation(t, 1); !g.Full {
+		t.Errorf("generation 1 of the restarted chain is not a full snapshot")
+	}
+	if got, _ := aws.s3.object(testBucket, firstChain.Generations[0].Key); !bytes.Equal(got, first) {
+		t.Errorf("generation 1 of the first chain was overwritten")
+	}
+
+	// A manifest pointing at the generations of another chain is rejected.
+	tampered := manifest(t)
+	tampered.ChainID = firstChain.ChainID
+	if err := writeManifest(ctx, client.S3, testBucket, "parameters", dataKey, tampered, BackupObjectOption{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBackup(ctx, client.S3, client.KMS, backupLocation{BucketName: testBucket, Key: "parameters", DataKeyKey: testDataKeyKey}); err == nil || !strings.Contains(err.Error(), "belongs to chain") {
+		t.Errorf("loading a manifest of another chain returned %v, want a chain mismatch", err)
+	}
+}
+
+func TestEndToEndCompression(t *testing.T) {
+	for _, compression := range []string{"", "none", "gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			ctx := context.Background()
+			aws := newFakeAWS()
+			client := aws.client()
+			want := map[string]string{}
+			for i := range 50 {
+				name := fmt.Sprintf("/app/param-%02d", i)
+				aws.ssm.put(name, ssmTypes.ParameterTypeString, strings.Repeat("value", 20))
+				want[name] = strings.Repeat("value", 20)
+			}
+			generateTestDataKey(t, ctx, client)
+
+			_, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+				o.BucketName = testBucket
+				o.Key = "parameters"
+				o.DataKeyBucketName = testBucket
+				o.DataKeyKey = testDataKeyKey
+				o.Compression = compression
+				o.OnMissing = "fail"
+				o.Concurrency = 1
+			}))
+			if err != nil {
+				t.Fatalf("backup-parameters failed: %v", err)
+			}
+
+			object, _ := aws.s3.object(testBucket, "parameters")
+			header, ciphertext, err := parseEnvelope(object)
+			if err != nil {
+				t.Fatalf("backup is not an envelope: %v", err)
+			}
+			wantHeader := compression
+			if compression == "none" {
+				wantHeader = ""
+			}
+			if header.Compression != wantHeader {
+				t.Errorf("header compression = %q, want %q", header.Compression, wantHeader)
+			}
+			if wantHeader != "" && len(ciphertext) > 1024 {
+				t.Errorf("compressed backup is %d bytes", len(ciphertext))
+			}
+			if got := downloadTestBackup(t, ctx, client, "parameters"); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("downloaded backup = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestEndToEndMigrateBackup(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	generateTestDataKey(t, ctx, client)
+	dataKey, err := getDataKey(ctx, client.KMS, client.S3, testBucket, testDataKeyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Parameter := `{"Name":"/app/db","Value":"secret","Type":"SecureString","Version":3,"ARN":"arn:aws:ssm:ap-northeast-1:123456789012:parameter/app/db","KmsKey":"AQICAH"}`
+	v1Secret := `{"Name":"app","SecretValue":"{\"password\":\"p\"}","ARN":"arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:app-AbCdEf","Tags":[{"Key":"team","Value":"a"}]}`
+	migrate := func(t *testing.T, key string) *Report {
+		t.Helper()
+		report, err := client.MigrateBackup(ctx, option(NewMigrateBackupCommandOption, func(o *MigrateBackupCommandOption) {
+			o.BucketName = testBucket
+			o.Key = key
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+		}))
+		if err != nil {
+			t.Fatalf("migrate-backup failed: %v", err)
+		}
+		return report
+	}
+	assertDocument := func(t *testing.T, key string, kind string) {
+		t.Helper()
+		payload, err := readBackupPayload(ctx, client.S3, testBucket, key, dataKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var header struct {
+			SchemaVersion int `json:"schemaVersion"`
+		}
+		if err := json.Unmarshal(payload, &header); err != nil || header.SchemaVersion != backupSchemaVersion {
+			t.Fatalf("%s is not at schema version %d: %s", key, backupSchemaVersion, payload)
+		}
+		loaded, err := loadBackup(ctx, client.S3, client.KMS, backupLocation{BucketName: testBucket, Key: key, DataKeyKey: testDataKeyKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc, err := decodeBackup(loaded); err != nil || doc.Kind != kind || doc.Source.Account != "123456789012" || doc.Source.Region != "ap-northeast-1" {
+			t.Errorf("%s = kind %q, source %+v (%v), want %s from 123456789012 in ap-northeast-1", key, doc.Kind, doc.Source, err, kind)
+		}
+	}
+
+	t.Run("legacy backup", func(t *testing.T) {
+		ciphertext, nonce, err := encryptData(dataKey, []byte("["+v1Parameter+"]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aws.s3.store(testBucket, "legacy", ciphertext)
+		aws.s3.store(testBucket, "legacy.nonce", nonce)
+		if got := downloadTestBackup(t, ctx, client, "legacy")["/app/db"]; got != "secret" {
+			t.Fatalf("legacy backup holds %q before migration", got)
+		}
+
+		if n := countReportItems(migrate(t, "legacy"), ReportActionMigrate); n != 1 {
+			t.Errorf("migrated %d objects, want 1", n)
+		}
+		if object, _ := aws.s3.object(testBucket, "legacy"); !isEnvelope(object) {
+			t.Error("migrated backup is not an envelope")
+		}
+		if _, ok := aws.s3.object(testBucket, "legacy.nonce"); !ok {
+			t.Error("nonce of the backup before migration is deleted")
+		}
+		assertDocument(t, "legacy", "parameters")
+		if got := downloadTestBackup(t, ctx, client, "legacy")["/app/db"]; got != "secret" {
+			t.Errorf("migrated backup holds %q", got)
+		}
+		if n := countReportItems(migrate(t, "legacy"), ReportActionSkip); n != 1 {
+			t.Errorf("second migration skipped %d objects, want 1", n)
+		}
+	})
+
+	t.Run("incremental backup", func(t *testing.T) {
+		generations := []backupGeneration{
+			{Sequence: 1, Full: true, Records: []json.RawMessage{json.RawMessage(v1Secret)}},
+			{Sequence: 2, Records: []json.RawMessage{json.RawMessage(strings.Replace(v1Secret, `\"p\"`, `\"q\"`, 1))}},
+		}
+		manifest := backupManifest{Format: backupManifestFormat, Names: []string{"app"}, State: map[string]backupItemState{}}
+		for _, generation := range generations {
+			ref := backupGenerationRef{Sequence: generation.Sequence, Key: fmt.Sprintf("incremental.generations/%08d", generation.Sequence), Full: generation.Full}
+			if err := writeGeneration(ctx, client.S3, testBucket, ref.Key, dataKey, generation, BackupObjectOption{}); err != nil {
+				t.Fatal(err)
+			}
+			manifest.Generations = append(manifest.Generations, ref)
+		}
+		if err := writeManifest(ctx, client.S3, testBucket, "incremental", dataKey, manifest, BackupObjectOption{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := countReportItems(migrate(t, "incremental"), ReportActionMigrate); n != 3 {
+			t.Errorf("migrated %d objects, want 2 generations and the manifest", n)
+		}
+		assertDocument(t, "incremental", "secrets")
+		if got := downloadTestBackup(t, ctx, client, "incremental")["app"]; got != `{"password":"q"}` {
+			t.Errorf("migrated incremental backup holds %q", got)
+		}
+	})
+
+	t.Run("newer schema version", func(t *testing.T) {
+		if err := writeBackup(ctx, client.S3, testBucket, "newer", dataKey, []byte(`{"schemaVersion":99,"items":[]}`), BackupObjectOption{}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := client.DownloadBackup(ctx, option(NewDownloadBackupCommandOption, func(o *DownloadBackupCommandOption) {
+			o.BucketName = testBucket
+			o.Key = "newer"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Output = filepath.Join(t.TempDir(), "out.json")
+			o.Format = "json"
+		}))
+		if err == nil || !strings.Contains(err.Error(), "newer than this brsp supports") {
+			t.Errorf("got error %v, want a schema version error", err)
+		}
+	})
+}
+
+func TestEndToEndSnapshot(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeSecureString, "parameter")
+	aws.ssm.ghosts["/app/ghost"] = true
+	aws.secretsmanager.put("app", "secret")
+	aws.lambda.put("api", "DB_PASSWORD", "password")
+	generateTestDataKey(t, ctx, client)
+
+	report, err := client.Backup(ctx, option(NewBackupCommandOption, func(o *BackupCommandOption) {
+		o.Kinds = []string{"parameters", "secrets", "lambda"}
+		o.BucketName = testBucket
+		o.KeyPrefix = "snapshots"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.FetchConcurrency = 1
+	}))
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if got := countReportItems(report, ReportActionSkip); got != 1 {
+		t.Errorf("backup skipped %d parameters, want the invalid one", got)
+	}
+
+	dataKey, err := getDataKey(ctx, client.KMS, client.S3, testBucket, testDataKeyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := loadSnapshotManifest(ctx, client.S3, testBucket, "snapshots", "latest", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"parameters", "secrets"} {
+		want := fmt.Sprintf("snapshots/%s/%s", manifest.SnapshotID, kind)
+		if got := manifest.Kinds[kind].Key; got != want {
+			t.Errorf("%s are at %s, want %s", kind, got, want)
+		}
+		loaded, err := loadBackup(ctx, client.S3, client.KMS, backupLocation{BucketName: testBucket, Key: want, DataKeyKey: testDataKeyKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := decodeBackup(loaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.SnapshotID != manifest.SnapshotID || doc.CreatedAt == nil || !doc.CreatedAt.Equal(manifest.CreatedAt) {
+			t.Errorf("%s backup is of snapshot %s at %v, want %s at %v", kind, doc.SnapshotID, doc.CreatedAt, manifest.SnapshotID, manifest.CreatedAt)
+		}
+	}
+
+	aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, placeholderValue)
+	aws.secretsmanager.put("app_dr", placeholderValue)
+	journal := filepath.Join(t.TempDir(), "journal.json")
+	for _, tt := range []struct {
+		kinds       []string
+		parameter   string
+		secret      string
+		wantRestore int
+	}{
+		{kinds: []string{"secrets"}, parameter: placeholderValue, secret: "secret", wantRestore: 1},
+		{kinds: []string{"parameters", "secrets"}, parameter: "parameter", secret: "secret", wantRestore: 1},
+	} {
+		report, err := client.RestoreSnapshot(ctx, option(NewRestoreSnapshotCommandOption, func(o *RestoreSnapshotCommandOption) {
+			o.BucketName = testBucket
+			o.KeyPrefix = "snapshots"
+			o.SnapshotID = manifest.SnapshotID
+			o.Kinds = tt.kinds
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Journal = journal
+			o.DryRun = false
+		}))
+		if err != nil {
+			t.Fatalf("restore snapshot of %v failed: %v", tt.kinds, err)
+		}
+		if got := countReportItems(report, ReportActionRestore); got != tt.wantRestore {
+			t.Errorf("restore snapshot of %v restored %d targets, want %d", tt.kinds, got, tt.wantRestore)
+		}
+		if got := aws.ssm.value("/app/db"); got != tt.parameter {
+			t.Errorf("after restoring %v, /app/db = %q, want %q", tt.kinds, got, tt.parameter)
+		}
+		if got := aws.secretsmanager.value("app_dr"); got != tt.secret {
+			t.Errorf("after restoring %v, app_dr = %q, want %q", tt.kinds, got, tt.secret)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(journal), "journal-secrets.json")); err != nil {
+		t.Errorf("journal of the secrets restore is missing: %v", err)
+	}
+
+	// Without --kinds, every kind in the snapshot is restored.
+	aws.lambda.put("api", "DB_PASSWORD", placeholderValue)
+	report, err = client.RestoreSnapshot(ctx, option(NewRestoreSnapshotCommandOption, func(o *RestoreSnapshotCommandOption) {
+		o.BucketName = testBucket
+		o.KeyPrefix = "snapshots"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Journal = journal
+		o.DryRun = false
+	}))
+	if err != nil {
+		t.Fatalf("restore snapshot of all kinds failed: %v", err)
+	}
+	if got := countReportItems(report, ReportActionRestore); got != 1 {
+		t.Errorf("restore snapshot of all kinds restored %d targets, want 1", got)
+	}
+	if got := aws.lambda.value("api", "DB_PASSWORD"); got != "password" {
+		t.Errorf("after restoring all kinds, DB_PASSWORD of api = %q, want the backed up value", got)
+	}
+
+	// When a kind fails, the kinds restored before it are rolled back with
+	// --rollback-on-failure, and otherwise listed with their journals.
+	aws.secretsmanager.fail("PutSecretValue", &smithy.GenericAPIError{Code: "InternalServiceError", Message: "internal error"})
+	for _, rollbackOnFailure := range []bool{true, false} {
+		aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, placeholderValue)
+		aws.secretsmanager.put("app_dr", placeholderValue)
+		_, err := client.RestoreSnapshot(ctx, option(NewRestoreSnapshotCommandOption, func(o *RestoreSnapshotCommandOption) {
+			o.BucketName = testBucket
+			o.KeyPrefix = "snapshots"
+			o.Kinds = []string{"parameters", "secrets"}
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Journal = journal
+			o.RollbackOnFailure = rollbackOnFailure
+			o.DryRun = false
+		}))
+		if err == nil {
+			t.Fatalf("restore snapshot with rollback on failure %v succeeded although secrets failed", rollbackOnFailure)
+		}
+		want, parameter := "rolled back: parameters", placeholderValue
+		if !rollbackOnFailure {
+			want, parameter = "parameters (journal "+filepath.Join(filepath.Dir(journal), "journal-parameters.json")+")", "parameter"
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("restore snapshot with rollback on failure %v returned %v, want an error containing %q", rollbackOnFailure, err, want)
+		}
+		if got := aws.ssm.value("/app/db"); got != parameter {
+			t.Errorf("with rollback on failure %v, /app/db = %q, want %q", rollbackOnFailure, got, parameter)
+		}
+	}
+}
+
+func TestEndToEndAppConfigAndLambda(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.appconfig.put("shop", "flags", "application/json", `{"beta":false}`)
+	aws.appconfig.put("shop", "flags", "application/json", `{"beta":true}`)
+	aws.appconfig.put("shop", "empty", "text/plain", "")
+	aws.lambda.put("api", "DB_PASSWORD", "password")
+	aws.lambda.put("api", "LOG_LEVEL", "info")
+	generateTestDataKey(t, ctx, client)
+
+	// A throttled call is retried alone, without listing the versions again.
+	aws.appconfig.throttle("GetHostedConfigurationVersion", 1)
+	if _, err := client.BackupAppConfig(ctx, option(NewBackupAppConfigCommandOption, func(o *BackupAppConfigCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "appconfig"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Concurrency = 2
+	})); err != nil {
+		t.Fatalf("backup-appconfig failed: %v", err)
+	}
+	if list, get := aws.appconfig.count("ListHostedConfigurationVersions"), aws.appconfig.count("GetHostedConfigurationVersion"); list != 2 || get != 3 {
+		t.Errorf("backup-appconfig listed versions %d times and got versions %d times, want 2 and 3", list, get)
+	}
+	if got := downloadTestBackup(t, ctx, client, "appconfig"); len(got) != 2 || got["shop/flags"] != `{"beta":true}` || got["shop/empty"] != "" {
+		t.Errorf("appconfig backup = %v, want the latest version of shop/flags and shop/empty", got)
+	}
+	if _, err := client.BackupLambda(ctx, option(NewBackupLambdaCommandOption, func(o *BackupLambdaCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "lambda"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+	})); err != nil {
+		t.Fatalf("backup-lambda failed: %v", err)
+	}
+	loaded, err := loadBackup(ctx, client.S3, client.KMS, backupLocation{BucketName: testBucket, Key: "lambda", DataKeyKey: testDataKeyKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := decodeBackup(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Kind != "lambda" || doc.Source.Account != "123456789012" || len(doc.Items) != 2 {
+		t.Fatalf("lambda backup is %s of %s with %d items, want lambda of 123456789012 with 2 items", doc.Kind, doc.Source.Account, len(doc.Items))
+	}
+	if item := doc.Items[0]; item.Name != "api/DB_PASSWORD" || item.Value != "password" || item.KmsKeyId != "arn:aws:kms:ap-northeast-1:123456789012:key/api" {
+		t.Errorf("first lambda item = %+v, want api/DB_PASSWORD with the function's KMS key", item)
+	}
+
+	// Only the placeholder is restored; LOG_LEVEL was changed since.
+	aws.lambda.put("api", "DB_PASSWORD", placeholderValue)
+	aws.lambda.put("api", "LOG_LEVEL", "debug")
+	dir := t.TempDir()
+	plan := filepath.Join(dir, "plan.json")
+	if _, err := client.RestorePlan(ctx, option(NewRestorePlanCommandOption, func(o *RestorePlanCommandOption) {
+		o.Kind = "auto"
+		o.BucketName = testBucket
+		o.Key = "lambda"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Output = plan
+	})); err != nil {
+		t.Fatalf("restore plan failed: %v", err)
+	}
+	body, err := os.ReadFile(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), valueHash("password")) || !strings.Contains(string(body), `"valueHash": "hmac-sha256:`) {
+		t.Errorf("plan does not hold keyed value hashes:\n%s", body)
+	}
+	report, err := client.RestoreApply(ctx, option(NewRestoreApplyCommandOption, func(o *RestoreApplyCommandOption) {
+		o.Plan = plan
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Journal = filepath.Join(dir, "journal.json")
+	}))
+	if err != nil {
+		t.Fatalf("restore apply failed: %v", err)
+	}
+	if got := countReportItems(report, ReportActionRestore); got != 1 {
+		t.Errorf("restore apply restored %d variables, want 1", got)
+	}
+	if got := aws.lambda.value("api", "DB_PASSWORD"); got != "password" {
+		t.Errorf("DB_PASSWORD = %q, want password", got)
+	}
+	if got := aws.lambda.value("api", "LOG_LEVEL"); got != "debug" {
+		t.Errorf("LOG_LEVEL = %q, want debug", got)
+	}
+
+	if _, err := client.Backup(ctx, option(NewBackupCommandOption, func(o *BackupCommandOption) {
+		o.Kinds = []string{"appconfig"}
+		o.BucketName = testBucket
+		o.KeyPrefix = "snapshots"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.FetchConcurrency = 1
+	})); err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	aws.appconfig.put("shop", "flags", "application/json", placeholderValue)
+	if _, err := client.RestoreSnapshot(ctx, option(NewRestoreSnapshotCommandOption, func(o *RestoreSnapshotCommandOption) {
+		o.BucketName = testBucket
+		o.KeyPrefix = "snapshots"
+		o.Kinds = []string{"appconfig"}
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Journal = filepath.Join(dir, "snapshot-journal.json")
+		o.DryRun = false
+	})); err != nil {
+		t.Fatalf("restore snapshot failed: %v", err)
+	}
+	if got := aws.appconfig.latest("shop", "flags"); string(got.Content) != `{"beta":true}` || got.ContentType != "application/json" {
+		t.Errorf("latest version of shop/flags = %s (%s), want the backup as application/json", got.Content, got.ContentType)
+	}
+}
+
+func TestEndToEndVault(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	vault := newFakeVault(t)
+	vault.put("app/db", map[string]any{"password": "old"})
+	vault.put("app/db", map[string]any{"password": "new", "port": 5432})
+	vault.put("app/api", map[string]any{"token": "token"})
+	vault.put("app/removed", map[string]any{"token": "removed"})
+	vault.deleteVersion("app/removed", 1)
+	vault.put("other/service", map[string]any{"key": "value"})
+	generateTestDataKey(t, ctx, client)
+
+	if _, err := client.BackupVault(ctx, option(NewBackupVaultCommandOption, func(o *BackupVaultCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "vault"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.VaultAddr = vault.URL
+		o.VaultRoleId = "role"
+		o.VaultSecretId = "secret-id"
+		o.VaultApproleMount = "approle"
+		o.VaultMount = "secret"
+		o.VaultPaths = []string{"app/"}
+		o.VaultAllVersions = true
+		o.Concurrency = 2
+	})); err != nil {
+		t.Fatalf("backup-vault failed: %v", err)
+	}
+	loaded, err := loadBackup(ctx, client.S3, client.KMS, backupLocation{BucketName: testBucket, Key: "vault", DataKeyKey: testDataKeyKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := decodeBackup(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Kind != "vault" || len(doc.Items) != 2 || doc.Items[0].Name != "app/api" || doc.Items[1].Name != "app/db" {
+		t.Fatalf("vault backup = %+v, want app/api and app/db", doc)
+	}
+	db := doc.Items[1]
+	if db.Value != `{"password":"new","port":5432}` || db.Version != 2 {
+		t.Errorf("app/db is %s of version %d, want the data of version 2", db.Value, db.Version)
+	}
+	if len(db.History) != 1 || db.History[0].Version != 1 || db.History[0].Value != `{"password":"old"}` {
+		t.Errorf("history of app/db = %+v, want version 1", db.History)
+	}
+
+	// Only the placeholder is restored; app/api was changed since.
+	vault.put("app/db", map[string]any{"password": placeholderValue, "port": placeholderValue})
+	vault.put("app/api", map[string]any{"token": "rotated"})
+	vaultOption := VaultOption{VaultAddr: vault.URL, VaultToken: "root-token", VaultMount: "secret"}
+
+	var diffReport *Report
+	captureStdout(t, func() {
+		diffReport, err = client.DiffBackup(ctx, option(NewDiffBackupCommandOption, func(o *DiffBackupCommandOption) {
+			o.BucketName = testBucket
+			o.Key = "vault"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.VaultOption = vaultOption
+			o.VaultPaths = []string{"app/"}
+			o.VaultAllVersions = true
+		}))
+	})
+	if err != nil {
+		t.Fatalf("diff-backup with the live Vault secrets failed: %v", err)
+	}
+	if added, removed, changed := countReportItems(diffReport, ReportActionAdded), countReportItems(diffReport, ReportActionRemoved), countReportItems(diffReport, ReportActionChanged); added != 0 || removed != 0 || changed != 2 {
+		t.Errorf("diff-backup found %d added, %d removed and %d changed secrets, want app/api and app/db changed", added, removed, changed)
+	}
+
+	dir := t.TempDir()
+	plan := filepath.Join(dir, "plan.json")
+	journal := filepath.Join(dir, "journal.json")
+	if _, err := client.RestorePlan(ctx, option(NewRestorePlanCommandOption, func(o *RestorePlanCommandOption) {
+		o.Kind = "auto"
+		o.BucketName = testBucket
+		o.Key = "vault"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Output = plan
+		o.VaultOption = vaultOption
+	})); err != nil {
+		t.Fatalf("restore plan failed: %v", err)
+	}
+	report, err := client.RestoreApply(ctx, option(NewRestoreApplyCommandOption, func(o *RestoreApplyCommandOption) {
+		o.Plan = plan
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Journal = journal
+		o.VaultOption = vaultOption
+	}))
+	if err != nil {
+		t.Fatalf("restore apply failed: %v", err)
+	}
+	if got := countReportItems(report, ReportActionRestore); got != 1 {
+		t.Errorf("restore apply restored %d secrets, want 1", got)
+	}
+	if got, _ := json.Marshal(vault.latest("app/db")); string(got) != `{"password":"new","port":5432}` {
+		t.Errorf("app/db = %s, want the backup", got)
+	}
+	if got := vault.latest("app/api")["token"]; got != "rotated" {
+		t.Errorf("app/api token = %v, want rotated", got)
+	}
+
+	if _, err := client.Rollback(ctx, option(NewRollbackCommandOption, func(o *RollbackCommandOption) {
+		o.Journal = journal
+		o.VaultOption = vaultOption
+	})); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if got := vault.latest("app/db")["password"]; got != placeholderValue {
+		t.Errorf("app/db password after rollback = %v, want the placeholder", got)
+	}
+}
+
+func TestEndToEndVaultRequestTimeout(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(hung.Close)
+	vault := newVaultClient(VaultOption{VaultAddr: hung.URL, VaultToken: "static-vault-token", VaultMount: "secret"})
+	if !secrets.isSecret("static-vault-token") {
+		t.Error("static Vault token is not registered for redaction")
+	}
+
+	ctx := withRequestTimeout(context.Background(), 50*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, err := vault.ReadSecret(ctx, "app/db", 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("reading from a hung Vault returned %v, want a deadline exceeded", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("reading from a hung Vault did not time out")
+	}
+}
+
+func TestEndToEndDownloadFormats(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	values := map[string]string{
+		"/API_KEY":     "key",
+		"/DB_PASSWORD": "p\"w'd\n$HOME \\ `date`\r",
+		"/URL":         "https://example.com/?a=1&b=2 # not a comment",
+	}
+	for name, value := range values {
+		aws.ssm.put(name, ssmTypes.ParameterTypeSecureString, value)
+	}
+	generateTestDataKey(t, ctx, client)
+	if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+	})); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+	dir := t.TempDir()
+	download := func(t *testing.T, format string) string {
+		t.Helper()
+		output := filepath.Join(dir, "backup."+format)
+		if _, err := client.DownloadBackup(ctx, option(NewDownloadBackupCommandOption, func(o *DownloadBackupCommandOption) {
+			o.BucketName = testBucket
+			o.Key = "parameters"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Format = format
+			o.Output = output
+		})); err != nil {
+			t.Fatalf("download-backup --format %s failed: %v", format, err)
+		}
+		return output
+	}
+
+	t.Run("json", func(t *testing.T) {
+		body, err := os.ReadFile(download(t, "json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := decodeBackup(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Kind != "parameters" || doc.SchemaVersion != backupSchemaVersion {
+			t.Errorf("document is %s of schema version %d, want parameters of %d", doc.Kind, doc.SchemaVersion, backupSchemaVersion)
+		}
+		for _, item := range doc.Items {
+			if item.Value != values[item.Name] {
+				t.Errorf("%s = %q, want %q", item.Name, item.Value, values[item.Name])
+			}
+		}
+		if len(doc.Items) != len(values) {
+			t.Errorf("document has %d items, want %d", len(doc.Items), len(values))
+		}
+	})
+
+	t.Run("dotenv", func(t *testing.T) {
+		body, err := os.ReadFile(download(t, "dotenv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "API_KEY=\"key\"\n" +
+			"DB_PASSWORD=\"p\\\"w'd\\n\\$HOME \\\\ `date`\\r\"\n" +
+			"URL=\"https://example.com/?a=1&b=2 # not a comment\"\n"
+		if string(body) != want {
+			t.Errorf("dotenv output is\n%s\nwant\n%s", body, want)
+		}
+	})
+
+	t.Run("shell", func(t *testing.T) {
+		output := download(t, "shell")
+		for name, value := range values {
+			variable := envName(name)
+			got, err := exec.Command("sh", "-c", fmt.Sprintf(`. "$1" && printf '%%s' "$%s"`, variable), "sh", output).Output()
+			if err != nil {
+				t.Fatalf("failed to source the shell output: %v", err)
+			}
+			if string(got) != value {
+				t.Errorf("%s sourced from the shell output = %q, want %q", variable, got, value)
+			}
+		}
+	})
+
+	t.Run("dotenv round trip through import", func(t *testing.T) {
+		output := download(t, "dotenv")
+		for name := range values {
+			aws.ssm.put(name, ssmTypes.ParameterTypeSecureString, placeholderValue)
+		}
+		report, err := client.Import(ctx, option(NewImportCommandOption, func(o *ImportCommandOption) {
+			o.File = output
+			o.Format = "dotenv"
+			o.Kind = "parameters"
+			o.Prefix = "/"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Journal = filepath.Join(dir, "journal.json")
+			o.DryRun = false
+		}))
+		if err != nil {
+			t.Fatalf("import failed: %v", err)
+		}
+		if got := countReportItems(report, ReportActionRestore); got != len(values) {
+			t.Errorf("import restored %d parameters, want %d", got, len(values))
+		}
+		for name, value := range values {
+			if got := aws.ssm.value(name); got != value {
+				t.Errorf("%s = %q after the round trip, want %q", name, got, value)
+			}
+		}
+	})
+
+	t.Run("colliding names", func(t *testing.T) {
+		aws.ssm.put("/app/db", ssmTypes.ParameterTypeString, "first")
+		aws.ssm.put("/app_db", ssmTypes.ParameterTypeString, "second")
+		if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+			o.BucketName = testBucket
+			o.Key = "colliding"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+		})); err != nil {
+			t.Fatalf("backup-parameters failed: %v", err)
+		}
+		for _, format := range []string{"dotenv", "shell"} {
+			output := filepath.Join(dir, "colliding."+format)
+			_, err := client.DownloadBackup(ctx, option(NewDownloadBackupCommandOption, func(o *DownloadBackupCommandOption) {
+				o.BucketName = testBucket
+				o.Key = "colliding"
+				o.DataKeyBucketName = testBucket
+				o.DataKeyKey = testDataKeyKey
+				o.Format = format
+				o.Output = output
+			}))
+			if err == nil || !strings.Contains(err.Error(), "/app/db and /app_db map to the same environment variable APP_DB") {
+				t.Errorf("download-backup --format %s returned %v, want an error naming both parameters", format, err)
+			}
+			if _, err := os.Stat(output); err == nil {
+				t.Errorf("download-backup --format %s wrote %s despite the collision", format, output)
+			}
+		}
+	})
+}
+
+func TestEndToEndKubernetesManifests(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db/password", ssmTypes.ParameterTypeSecureString, "secret")
+	aws.ssm.put("/app/api-key", ssmTypes.ParameterTypeString, "key")
+	generateTestDataKey(t, ctx, client)
+	_, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "backups/App_Parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.OnMissing = "fail"
+		o.Concurrency = 1
+	}))
+	if err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(t *testing.T, format string, manifest K8sManifestOption) map[string]any {
+		t.Helper()
+		output := filepath.Join(t.TempDir(), "manifest.yaml")
+		_, err := client.DownloadBackup(ctx, option(NewDownloadBackupCommandOption, func(o *DownloadBackupCommandOption) {
+			o.BucketName = testBucket
+			o.Key = "backups/App_Parameters"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Format = format
+			o.Output = output
+			o.K8sManifestOption = manifest
+		}))
+		if err != nil {
+			t.Fatalf("download-backup --format %s failed: %v", format, err)
+		}
+		body, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resource map[string]any
+		if err := yaml.Unmarshal(body, &resource); err != nil {
+			t.Fatalf("manifest is not YAML: %v\n%s", err, body)
+		}
+		return resource
+	}
+
+	t.Run("secret", func(t *testing.T) {
+		secret := download(t, "k8s-secret", K8sManifestOption{K8sNamespace: "app"})
+		if secret["kind"] != "Secret" || fmt.Sprint(secret["metadata"]) != "map[name:app-parameters namespace:app]" {
+			t.Errorf("secret = %v, want Secret app/app-parameters", secret)
+		}
+		data := secret["data"].(map[string]any)
+		want := map[string]string{"app_db_password": "secret", "app_api-key": "key"}
+		if len(data) != len(want) {
+			t.Errorf("secret data = %v, want %v", data, want)
+		}
+		for key, value := range want {
+			if got, _ := base64.StdEncoding.DecodeString(fmt.Sprint(data[key])); string(got) != value {
+				t.Errorf("secret data %s = %q, want %q", key, got, value)
+			}
+		}
+	})
+
+	t.Run("sealed secret", func(t *testing.T) {
+		sealed := download(t, "k8s-secret", K8sManifestOption{K8sName: "db", K8sNamespace: "app", SealedSecretsCert: cert})
+		if sealed["kind"] != "SealedSecret" {
+			t.Fatalf("kind = %v, want SealedSecret", sealed["kind"])
+		}
+		encrypted := sealed["spec"].(map[string]any)["encryptedData"].(map[string]any)
+		ciphertext, err := base64.StdEncoding.DecodeString(fmt.Sprint(encrypted["app_db_password"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := int(binary.BigEndian.Uint16(ciphertext))
+		sessionKey, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, ciphertext[2:2+size], []byte("app/db"))
+		if err != nil {
+			t.Fatalf("session key is not sealed for app/db: %v", err)
+		}
+		block, _ := aes.NewCipher(sessionKey)
+		aead, _ := cipher.NewGCM(block)
+		plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext[2+size:], nil)
+		if err != nil || string(plaintext) != "secret" {
+			t.Errorf("unsealed value = %q, %v, want secret", plaintext, err)
+		}
+	})
+
+	t.Run("external secret", func(t *testing.T) {
+		es := download(t, "external-secret", K8sManifestOption{SecretStore: "parameter-store", SecretStoreKind: "ClusterSecretStore", RefreshInterval: "1h"})
+		spec := es["spec"].(map[string]any)
+		if es["kind"] != "ExternalSecret" || fmt.Sprint(spec["secretStoreRef"]) != "map[kind:ClusterSecretStore name:parameter-store]" {
+			t.Errorf("external secret = %v", es)
+		}
+		if got := fmt.Sprint(spec["data"]); got != "[map[remoteRef:map[key:/app/api-key] secretKey:app_api-key] map[remoteRef:map[key:/app/db/password] secretKey:app_db_password]]" {
+			t.Errorf("external secret data = %s", got)
+		}
+	})
+}
+
+func TestEndToEndExportTerraform(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	aws.ssm.put("/app/db/password", ssmTypes.ParameterTypeSecureString, "secret")
+	aws.secretsmanager.put("app/db", `{"password":"secret"}`)
+	aws.secretsmanager.put("app/api", "token")
+	generateTestDataKey(t, ctx, client)
+	if _, err := client.BackupParameters(ctx, option(NewBackupParametersCommandOption, func(o *BackupParametersCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "parameters"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.OnMissing = "fail"
+		o.Concurrency = 1
+	})); err != nil {
+		t.Fatalf("backup-parameters failed: %v", err)
+	}
+	if _, err := client.BackupSecrets(ctx, option(NewBackupSecretsCommandOption, func(o *BackupSecretsCommandOption) {
+		o.BucketName = testBucket
+		o.Key = "secrets"
+		o.DataKeyBucketName = testBucket
+		o.DataKeyKey = testDataKeyKey
+		o.Concurrency = 1
+	})); err != nil {
+		t.Fatalf("backup-secrets failed: %v", err)
+	}
+	// Only app/db has a restore target, which export-terraform imports.
+	aws.secretsmanager.put("app/db_dr", placeholderValue)
+
+	export := func(t *testing.T, key string, importTargets bool) (string, *Report) {
+		t.Helper()
+		output := filepath.Join(t.TempDir(), "main.tf")
+		report, err := client.ExportTerraform(ctx, option(NewExportTerraformCommandOption, func(o *ExportTerraformCommandOption) {
+			o.BucketName = testBucket
+			o.Key = key
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Output = output
+			o.Import = importTargets
+			o.SecretNameSuffix = "restore"
+		}))
+		if err != nil {
+			t.Fatalf("export-terraform failed: %v", err)
+		}
+		body, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range []string{`"secret"`, `"token"`, `\"password\"`} {
+			if strings.Contains(string(body), value) {
+				t.Errorf("configuration contains the backed up value %s:\n%s", value, body)
+			}
+		}
+		return string(body), report
+	}
+
+	t.Run("parameters", func(t *testing.T) {
+		body, report := export(t, "parameters", false)
+		want := `resource "aws_ssm_parameter" "app_db_password" {
+  name      = "/app/db/password"
+  type      = "SecureString"
+  data_type = "text"
+  value     = "DUMMY"
+
+  lifecycle {
+    ignore_changes = [value]
+  }
+}
+`
+		if !strings.Contains(body, want) || strings.Contains(body, "import {") {
+			t.Errorf("configuration = %s, want %s", body, want)
+		}
+		if got := countReportItems(report, ReportActionCreate); got != 1 {
+			t.Errorf("export-terraform created %d parameters, want 1", got)
+		}
+	})
+
+	t.Run("secrets", func(t *testing.T) {
+		body, report := export(t, "secrets", true)
+		for _, want := range []string{
+			"import {\n  to = aws_secretsmanager_secret.app_db_dr\n  id = \"arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:app/db_dr-AbCdEf\"\n}\n",
+			"import {\n  to = aws_secretsmanager_secret_version.app_db_dr\n  id = \"arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:app/db_dr-AbCdEf|version-3\"\n}\n",
+			"resource \"aws_secretsmanager_secret\" \"app_api_restore\" {\n  name = \"app/api_restore\"\n}\n",
+			"  secret_id     = aws_secretsmanager_secret.app_api_restore.id\n  secret_string = \"DUMMY\"\n\n  lifecycle {\n    ignore_changes = [secret_string]\n  }\n",
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("configuration does not contain %s:\n%s", want, body)
+			}
+		}
+		if got := countReportItems(report, ReportActionImport); got != 1 {
+			t.Errorf("export-terraform imported %d secrets, want 1", got)
+		}
+		if got := countReportItems(report, ReportActionCreate); got != 1 {
+			t.Errorf("export-terraform created %d secrets, want 1", got)
+		}
+	})
+}
+
+func TestEndToEndImport(t *testing.T) {
+	ctx := context.Background()
+	aws := newFakeAWS()
+	client := aws.client()
+	generateTestDataKey(t, ctx, client)
+	dir := t.TempDir()
+	write := func(name string, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("dotenv into parameters", func(t *testing.T) {
+		aws.ssm.put("/app/DB_PASSWORD", ssmTypes.ParameterTypeSecureString, placeholderValue)
+		aws.ssm.put("/app/API_KEY", ssmTypes.ParameterTypeString, "kept")
+		file := write("app.env", "# seeded values\nexport DB_PASSWORD=\"p\\\"w\\nd\"\nAPI_KEY=key # comment\nMISSING='x'\n")
+		report, err := client.Import(ctx, option(NewImportCommandOption, func(o *ImportCommandOption) {
+			o.File = file
+			o.Format = "auto"
+			o.Kind = "parameters"
+			o.Prefix = "/app/"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.DryRun = true
+		}))
+		if err != nil {
+			t.Fatalf("import failed: %v", err)
+		}
+		if got := countReportItems(report, ReportActionWouldRestore); got != 1 || aws.ssm.value("/app/DB_PASSWORD") != placeholderValue {
+			t.Errorf("dry run would restore %d parameters and left %q, want 1 and the placeholder", got, aws.ssm.value("/app/DB_PASSWORD"))
+		}
+
+		report, err = client.Import(ctx, option(NewImportCommandOption, func(o *ImportCommandOption) {
+			o.File = file
+			o.Format = "auto"
+			o.Kind = "parameters"
+			o.Prefix = "/app/"
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Journal = filepath.Join(dir, "journal.json")
+			o.DryRun = false
+		}))
+		if err != nil {
+			t.Fatalf("import failed: %v", err)
+		}
+		if got := countReportItems(report, ReportActionSkip); got != 2 {
+			t.Errorf("import skipped %d parameters, want 2", got)
+		}
+		if got := aws.ssm.value("/app/DB_PASSWORD"); got != "p\"w\nd" {
+			t.Errorf("/app/DB_PASSWORD = %q, want the imported value", got)
+		}
+		if got := aws.ssm.value("/app/API_KEY"); got != "kept" {
+			t.Errorf("/app/API_KEY = %q, want it kept", got)
+		}
+	})
+
+	t.Run("SOPS-encrypted YAML into secrets", func(t *testing.T) {
+		aws.secretsmanager.put("app/db_dr", placeholderValue)
+		file := write("secrets.yaml", "app/db: ENC[AES256_GCM,data:abc]\nsops:\n  version: 3.9.0\n")
+		decrypted := write("decrypted.yaml", "app/db:\n  password: pw\n  port: 5432\n")
+		sops := write("sops", fmt.Sprintf("#!/bin/sh\n[ \"$1\" = --decrypt ] || exit 1\ncat %s\n", decrypted))
+		if err := os.Chmod(sops, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		_, err := client.Import(ctx, option(NewImportCommandOption, func(o *ImportCommandOption) {
+			o.File = file
+			o.Format = "auto"
+			o.Kind = "secrets"
+			o.SopsBinary = sops
+			o.DataKeyBucketName = testBucket
+			o.DataKeyKey = testDataKeyKey
+			o.Journal = filepath.Join(dir, "secrets-journal.json")
+			o.DryRun = false
+		}))
+		if err != nil {
+			t.Fatalf("import failed: %v", err)
+		}
+		if got := aws.secretsmanager.value("app/db_dr"); got != `{"password":"pw","port":5432}` {
+			t.Errorf("app/db_dr = %s, want the decrypted value", got)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package brsp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// envelopeMagic starts every backup written as a single object. Older
+// backups are a bare ciphertext with the nonce in a separate object.
+var envelopeMagic = []byte("BRSP\x01")
+
+const envelopeCipher = "AES-256-GCM"
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// envelopeHeader describes how the ciphertext following it was made.
+type envelopeHeader struct {
+	Cipher string `json:"cipher"`
+	Nonce  []byte `json:"nonce"`
+	// Compression is applied to the plaintext before encryption. Empty
+	// means none.
+	Compression string `json:"compression,omitempty"`
+}
+
+// sealEnvelope compresses plaintext with compression ("", none, gzip or zstd)
+// and encrypts it with dataKey into a self-contained envelope: magic, header
+// length (uint32, big endian), JSON header, ciphertext.
+func sealEnvelope(dataKey []byte, plaintext []byte, compression string) ([]byte, error) {
+	if compression == compressionNone {
+		compression = ""
+	}
+	compressed, err := compress(compression, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, nonce, err := encryptData(dataKey, compressed)
+	if err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(envelopeHeader{Cipher: envelopeCipher, Nonce: nonce, Compression: compression})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(envelopeMagic)
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(header))); err != nil {
+		return nil, err
+	}
+	buf.Write(header)
+	buf.Write(ciphertext)
+	return buf.Bytes(), nil
+}
+
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, envelopeMagic)
+}
+
+// openEnvelope decrypts an envelope made by sealEnvelope.
+func openEnvelope(dataKey []byte, data []byte) ([]byte, error) {
+	header, ciphertext, err := parseEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := decryptData(dataKey, header.Nonce, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(header.Compression, compressed)
+}
+
+func parseEnvelope(data []byte) (envelopeHeader, []byte, error) {
+	var header envelopeHeader
+	if !isEnvelope(data) {
+		return header, nil, fmt.Errorf("not a brsp backup envelope")
+	}
+	rest := data[len(envelopeMagic):]
+	if len(rest) < 4 {
+		return header, nil, fmt.Errorf("truncated backup envelope")
+	}
+	size := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+	if uint64(size) > uint64(len(rest)) {
+		return header, nil, fmt.Errorf("truncated backup envelope")
+	}
+	if err := json.Unmarshal(rest[:size], &header); err != nil {
+		return header, nil, fmt.Errorf("invalid backup envelope header, %v", err)
+	}
+	if header.Cipher != envelopeCipher {
+		return header, nil, fmt.Errorf("unsupported backup cipher: %s", header.Cipher)
+	}
+	switch header.Compression {
+	case "", compressionGzip, compressionZstd:
+	default:
+		return header, nil, fmt.Errorf("unsupported backup compression: %s", header.Compression)
+	}
+	return header, rest[size:], nil
+}
+
+func compress(compression string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch compression {
+	case "":
+		return data, nil
+	case compressionGzip:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case compressionZstd:
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
+
+func decompress(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case "":
+		return data, nil
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress backup, %v", err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case compressionZstd:
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		decompressed, err := r.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress backup, %v", err)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
@@ -0,0 +1,268 @@
+package brsp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type ExportTerraformCommand struct {
+	client    *Client
+	s3Client  S3API
+	kmsClient KMSAPI
+	opt       *ExportTerraformCommandOption
+}
+
+type ExportTerraformCommandOption struct {
+	commandOption
+	BucketName        string `help:"S3 bucket name"`
+	Key               string `help:"S3 object key"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	KmsKey            string `help:"KMS key for decryption"`
+	FromFile          string `type:"existingfile" help:"export from a local file instead of S3"`
+	DataKeyFile       string `type:"existingfile" help:"local copy of the KMS-encrypted data key, used with --from-file"`
+	IdentityFile      string `type:"existingfile" help:"file containing the base64-encoded plaintext data key"`
+	Output            string `help:"write to this file (mode 0600) instead of stdout"`
+	Import            bool   `default:"true" negatable:"" help:"add import blocks for the restore targets that already exist"`
+	SecretNameSuffix  string `default:"restore" help:"secrets to create are named <secret>_<suffix>, so that restore finds them"`
+}
+
+// NewExportTerraformCommandOption returns options set to the CLI defaults.
+func NewExportTerraformCommandOption() *ExportTerraformCommandOption {
+	return withDefaults(&ExportTerraformCommandOption{})
+}
+
+func NewExportTerraformCommand(ctx context.Context, opt *ExportTerraformCommandOption) (*ExportTerraformCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(awsConfig, awsConfig).exportTerraformCommand(opt), nil
+}
+
+func (c *Client) exportTerraformCommand(opt *ExportTerraformCommandOption) *ExportTerraformCommand {
+	return &ExportTerraformCommand{
+		client:    c,
+		s3Client:  c.S3,
+		kmsClient: c.KMS,
+		opt:       opt,
+	}
+}
+
+// terraformResource is a restore target rendered as Terraform resources.
+// importID holds the IDs of the resources to import if the target exists.
+type terraformResource struct {
+	item     backupDocumentItem
+	name     string
+	importID []string
+}
+
+func (c *ExportTerraformCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("export-terraform")
+	decrypted, err := loadBackup(ctx, c.s3Client, c.kmsClient, backupLocation{
+		BucketName:        c.opt.BucketName,
+		Key:               c.opt.Key,
+		DataKeyBucketName: c.opt.DataKeyBucketName,
+		DataKeyKey:        c.opt.DataKeyKey,
+		FromFile:          c.opt.FromFile,
+		DataKeyFile:       c.opt.DataKeyFile,
+		IdentityFile:      c.opt.IdentityFile,
+	})
+	if err != nil {
+		return report, err
+	}
+	doc, err := decodeBackup(decrypted)
+	if err != nil {
+		return report, err
+	}
+	if doc.Kind != "parameters" && doc.Kind != "secrets" {
+		return report, fmt.Errorf("export-terraform supports parameters and secrets backups, not %q", doc.Kind)
+	}
+	for _, item := range doc.Items {
+		registerSecret(item.Value)
+	}
+
+	resources, err := c.resources(ctx, doc)
+	if err != nil {
+		return report, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by brsp export-terraform. Values are placeholders for restore.\n")
+	names := map[string]int{}
+	for _, resource := range resources {
+		// Resource names must be unique, so later ones that sanitize to the
+		// same name get a number.
+		names[resource.name]++
+		if n := names[resource.name]; n > 1 {
+			resource.name += "_" + strconv.Itoa(n)
+		}
+		buf.WriteString("\n")
+		address := writeTerraformResource(&buf, doc.Kind, resource)
+		action := ReportActionCreate
+		if len(resource.importID) > 0 {
+			action = ReportActionImport
+		}
+		report.add(ReportItem{Source: resource.item.Name, Target: address, Action: action})
+	}
+
+	if c.opt.Output == "" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return report, err
+	}
+	return report, writeFile(c.opt.Output, buf.Bytes())
+}
+
+// resources maps each item of doc to the targets restore would write it to,
+// or to a new target if there is none or --no-import is given.
+func (c *ExportTerraformCommand) resources(ctx context.Context, doc backupDocument) ([]terraformResource, error) {
+	var targets restoreTargets
+	if c.opt.Import {
+		var err error
+		if targets, err = newRestoreTargets(doc.Kind, c.client); err != nil {
+			return nil, err
+		}
+	}
+
+	resources := []terraformResource{}
+	for _, item := range doc.Items {
+		var existing []restoreTarget
+		if targets != nil {
+			var err error
+			if existing, err = targets.resolve(ctx, item.Name); err != nil {
+				return nil, fmt.Errorf("failed to find the %s targets of %s, %v", targets.noun(), item.Name, err)
+			}
+		}
+		if len(existing) == 0 {
+			resource := terraformResource{item: item, name: terraformName(item.Name)}
+			if doc.Kind == "secrets" {
+				resource.item.Name = item.Name + "_" + c.opt.SecretNameSuffix
+				resource.name = terraformName(resource.item.Name)
+			}
+			resources = append(resources, resource)
+			continue
+		}
+		for _, target := range existing {
+			resource := terraformResource{item: item, name: terraformName(target.Name), importID: []string{target.ID}}
+			resource.item.Name = target.Name
+			if doc.Kind == "secrets" {
+				// The current version is imported too, so that applying the
+				// configuration does not write the placeholder over it.
+				state, err := targets.currentValue(ctx, target)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read %s, %v", target.Name, err)
+				}
+				resource.importID = append(resource.importID, target.ID+"|"+state.Version)
+			}
+			resources = append(resources, resource)
+		}
+	}
+	return resources, nil
+}
+
+// writeTerraformResource renders resource with its value ignored once
+// created, preceded by import blocks if it exists, and returns its address.
+func writeTerraformResource(buf *bytes.Buffer, kind string, resource terraformResource) string {
+	item := resource.item
+	lifecycle := func(attribute string) {
+		fmt.Fprintf(buf, "\n  lifecycle {\n    ignore_changes = [%s]\n  }\n}\n", attribute)
+	}
+
+	if kind == "parameters" {
+		address := "aws_ssm_parameter." + resource.name
+		if len(resource.importID) > 0 {
+			writeTerraformImport(buf, address, resource.importID[0])
+		}
+		fmt.Fprintf(buf, "resource \"aws_ssm_parameter\" %q {\n", resource.name)
+		attributes := []hclAttribute{{"name", hclString(item.Name)}, {"type", hclString(item.Type)}}
+		if item.DataType != "" {
+			attributes = append(attributes, hclAttribute{"data_type", hclString(item.DataType)})
+		}
+		attributes = append(attributes, hclAttribute{"value", hclString(placeholderValue)})
+		writeHCLAttributes(buf, "  ", attributes)
+		lifecycle("value")
+		return address
+	}
+
+	address := "aws_secretsmanager_secret." + resource.name
+	if len(resource.importID) > 0 {
+		writeTerraformImport(buf, address, resource.importID[0])
+	}
+	fmt.Fprintf(buf, "resource \"aws_secretsmanager_secret\" %q {\n", resource.name)
+	attributes := []hclAttribute{{"name", hclString(item.Name)}}
+	if item.Description != "" {
+		attributes = append(attributes, hclAttribute{"description", hclString(item.Description)})
+	}
+	if item.KmsKeyId != "" {
+		attributes = append(attributes, hclAttribute{"kms_key_id", hclString(item.KmsKeyId)})
+	}
+	writeHCLAttributes(buf, "  ", attributes)
+	if len(item.Tags) > 0 {
+		buf.WriteString("\n  tags = {\n")
+		tags := []hclAttribute{}
+		for _, tag := range item.Tags {
+			tags = append(tags, hclAttribute{hclString(tag.Key), hclString(tag.Value)})
+		}
+		writeHCLAttributes(buf, "    ", tags)
+		buf.WriteString("  }\n")
+	}
+	buf.WriteString("}\n\n")
+
+	versionAddress := "aws_secretsmanager_secret_version." + resource.name
+	if len(resource.importID) > 0 {
+		writeTerraformImport(buf, versionAddress, resource.importID[1])
+	}
+	fmt.Fprintf(buf, "resource \"aws_secretsmanager_secret_version\" %q {\n", resource.name)
+	writeHCLAttributes(buf, "  ", []hclAttribute{
+		{"secret_id", address + ".id"},
+		{"secret_string", hclString(placeholderValue)},
+	})
+	lifecycle("secret_string")
+	return address
+}
+
+func writeTerraformImport(buf *bytes.Buffer, address string, id string) {
+	fmt.Fprintf(buf, "import {\n")
+	writeHCLAttributes(buf, "  ", []hclAttribute{{"to", address}, {"id", hclString(id)}})
+	fmt.Fprintf(buf, "}\n\n")
+}
+
+// hclAttribute is an attribute of an HCL block; Value is an expression.
+type hclAttribute struct {
+	Name  string
+	Value string
+}
+
+// writeHCLAttributes writes attributes with their "=" aligned, as terraform
+// fmt does.
+func writeHCLAttributes(buf *bytes.Buffer, indent string, attributes []hclAttribute) {
+	width := 0
+	for _, attribute := range attributes {
+		width = max(width, len(attribute.Name))
+	}
+	for _, attribute := range attributes {
+		fmt.Fprintf(buf, "%s%-*s = %s\n", indent, width, attribute.Name, attribute.Value)
+	}
+}
+
+// hclString quotes s as an HCL string literal, escaping template sequences.
+func hclString(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "${", "$${", "%{", "%%{")
+	return `"` + replacer.Replace(s) + `"`
+}
+
+var terraformNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// terraformName turns a parameter or secret name such as /dev/db/password
+// into a resource name such as dev_db_password.
+func terraformName(name string) string {
+	resource := strings.Trim(terraformNameInvalidChars.ReplaceAllString(name, "_"), "_")
+	if resource == "" || (resource[0] >= '0' && resource[0] <= '9') || resource[0] == '-' {
+		resource = "_" + resource
+	}
+	return resource
+}
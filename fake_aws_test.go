@@ -0,0 +1,947 @@
+package brsp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfig"
+	appconfigTypes "github.com/aws/aws-sdk-go-v2/service/appconfig/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmsTypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdaTypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	secretsmanagerTypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeFaults injects errors into fake API operations and counts the calls.
+type fakeFaults struct {
+	mu        sync.Mutex
+	throttles map[string]int
+	errors    map[string]error
+	calls     map[string]int
+}
+
+func newFakeFaults() *fakeFaults {
+	return &fakeFaults{throttles: map[string]int{}, errors: map[string]error{}, calls: map[string]int{}}
+}
+
+// throttle makes the next n calls of operation fail with ThrottlingException.
+func (f *fakeFaults) throttle(operation string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.throttles[operation] = n
+}
+
+// fail makes every call of operation fail with err.
+func (f *fakeFaults) fail(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[operation] = err
+}
+
+func (f *fakeFaults) count(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[operation]
+}
+
+func (f *fakeFaults) check(operation string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[operation]++
+	if err := f.errors[operation]; err != nil {
+		return err
+	}
+	if f.throttles[operation] > 0 {
+		f.throttles[operation]--
+		return &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	}
+	return nil
+}
+
+func fakePage[T any](items []T, token *string, maxResults int) ([]T, *string) {
+	start := 0
+	if token != nil {
+		start, _ = strconv.Atoi(*token)
+	}
+	end := min(start+maxResults, len(items))
+	if end >= len(items) {
+		return items[start:], nil
+	}
+	return items[start:end], aws.String(strconv.Itoa(end))
+}
+
+type fakeParameter struct {
+	Type    ssmTypes.ParameterType
+	Value   string
+	Version int64
+}
+
+// fakeSSM is an in-memory SSM Parameter Store.
+type fakeSSM struct {
+	*fakeFaults
+	mu         sync.Mutex
+	parameters map[string]*fakeParameter
+	pageSize   int
+	// ghosts are listed by DescribeParameters but reported as invalid by
+	// GetParameters, like parameters deleted in between.
+	ghosts map[string]bool
+}
+
+func newFakeSSM() *fakeSSM {
+	return &fakeSSM{fakeFaults: newFakeFaults(), parameters: map[string]*fakeParameter{}, pageSize: 50, ghosts: map[string]bool{}}
+}
+
+func (f *fakeSSM) put(name string, parameterType ssmTypes.ParameterType, value string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parameter, ok := f.parameters[name]
+	if !ok {
+		parameter = &fakeParameter{Type: parameterType}
+		f.parameters[name] = parameter
+	}
+	parameter.Value = value
+	parameter.Version++
+	return parameter.Version
+}
+
+func (f *fakeSSM) value(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if parameter, ok := f.parameters[name]; ok {
+		return parameter.Value
+	}
+	return ""
+}
+
+func (f *fakeSSM) names() []string {
+	names := []string{}
+	for name := range f.parameters {
+		names = append(names, name)
+	}
+	for name := range f.ghosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeSSM) parameter(name string, withDecryption bool) ssmTypes.Parameter {
+	parameter := f.parameters[name]
+	value := parameter.Value
+	if parameter.Type == ssmTypes.ParameterTypeSecureString && !withDecryption {
+		value = "AQICAH" + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return ssmTypes.Parameter{
+		Name:     aws.String(name),
+		Type:     parameter.Type,
+		Value:    aws.String(value),
+		Version:  parameter.Version,
+		DataType: aws.String("text"),
+		ARN:      aws.String("arn:aws:ssm:ap-northeast-1:123456789012:parameter" + name),
+	}
+}
+
+func (f *fakeSSM) DescribeParameters(ctx context.Context, params *ssm.DescribeParametersInput, optFns ...func(*ssm.Options)) (*ssm.DescribeParametersOutput, error) {
+	if err := f.check("DescribeParameters"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pageSize := f.pageSize
+	if params.MaxResults != nil {
+		pageSize = min(pageSize, int(*params.MaxResults))
+	}
+	names, next := fakePage(f.names(), params.NextToken, pageSize)
+	output := &ssm.DescribeParametersOutput{NextToken: next}
+	for _, name := range names {
+		output.Parameters = append(output.Parameters, ssmTypes.ParameterMetadata{Name: aws.String(name)})
+	}
+	return output, nil
+}
+
+func (f *fakeSSM) GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+	if err := f.check("GetParameters"); err != nil {
+		return nil, err
+	}
+	if len(params.Names) > 10 {
+		return nil, &smithy.GenericAPIError{Code: "ValidationException", Message: "too many names"}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ssm.GetParametersOutput{}
+	// Return parameters in reverse order, as GetParameters does not keep the order of Names.
+	for _, name := range slices.Backward(params.Names) {
+		if _, ok := f.parameters[name]; !ok {
+			output.InvalidParameters = append(output.InvalidParameters, name)
+			continue
+		}
+		output.Parameters = append(output.Parameters, f.parameter(name, aws.ToBool(params.WithDecryption)))
+	}
+	return output, nil
+}
+
+func (f *fakeSSM) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	if err := f.check("GetParameter"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := aws.ToString(params.Name)
+	if _, ok := f.parameters[name]; !ok {
+		return nil, &ssmTypes.ParameterNotFound{Message: aws.String(name)}
+	}
+	parameter := f.parameter(name, aws.ToBool(params.WithDecryption))
+	return &ssm.GetParameterOutput{Parameter: &parameter}, nil
+}
+
+func (f *fakeSSM) PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	if err := f.check("PutParameter"); err != nil {
+		return nil, err
+	}
+	name := aws.ToString(params.Name)
+	f.mu.Lock()
+	_, exists := f.parameters[name]
+	f.mu.Unlock()
+	if exists && !aws.ToBool(params.Overwrite) {
+		return nil, &ssmTypes.ParameterAlreadyExists{Message: aws.String(name)}
+	}
+	parameterType := params.Type
+	if parameterType == "" {
+		parameterType = ssmTypes.ParameterTypeString
+	}
+	return &ssm.PutParameterOutput{Version: f.put(name, parameterType, aws.ToString(params.Value))}, nil
+}
+
+type fakeSecret struct {
+	ARN         string
+	Description string
+	Value       string
+	VersionID   string
+}
+
+// fakeSecretsManager is an in-memory Secrets Manager.
+type fakeSecretsManager struct {
+	*fakeFaults
+	mu       sync.Mutex
+	secrets  map[string]*fakeSecret
+	pageSize int
+	versions int
+}
+
+func newFakeSecretsManager() *fakeSecretsManager {
+	return &fakeSecretsManager{fakeFaults: newFakeFaults(), secrets: map[string]*fakeSecret{}, pageSize: 100}
+}
+
+func (f *fakeSecretsManager) put(name string, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	secret, ok := f.secrets[name]
+	if !ok {
+		secret = &fakeSecret{ARN: fmt.Sprintf("arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:%s-AbCdEf", name)}
+		f.secrets[name] = secret
+	}
+	f.versions++
+	secret.Value = value
+	secret.VersionID = fmt.Sprintf("version-%d", f.versions)
+}
+
+func (f *fakeSecretsManager) value(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if secret, ok := f.secrets[name]; ok {
+		return secret.Value
+	}
+	return ""
+}
+
+// lookup finds a secret by name or ARN.
+func (f *fakeSecretsManager) lookup(id string) (string, *fakeSecret, error) {
+	for name, secret := range f.secrets {
+		if name == id || secret.ARN == id {
+			return name, secret, nil
+		}
+	}
+	return "", nil, &secretsmanagerTypes.ResourceNotFoundException{Message: aws.String(id)}
+}
+
+func (f *fakeSecretsManager) ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error) {
+	if err := f.check("ListSecrets"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := []string{}
+	for name := range f.secrets {
+		matched := true
+		for _, filter := range params.Filters {
+			if filter.Key == secretsmanagerTypes.FilterNameStringTypeName {
+				matched = matched && slices.ContainsFunc(filter.Values, func(prefix string) bool { return strings.HasPrefix(name, prefix) })
+			}
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	pageSize := f.pageSize
+	if params.MaxResults != nil {
+		pageSize = min(pageSize, int(*params.MaxResults))
+	}
+	names, next := fakePage(names, params.NextToken, pageSize)
+	output := &secretsmanager.ListSecretsOutput{NextToken: next}
+	for _, name := range names {
+		secret := f.secrets[name]
+		output.SecretList = append(output.SecretList, secretsmanagerTypes.SecretListEntry{
+			Name:        aws.String(name),
+			ARN:         aws.String(secret.ARN),
+			Description: aws.String(secret.Description),
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	if err := f.check("GetSecretValue"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name, secret, err := f.lookup(aws.ToString(params.SecretId))
+	if err != nil {
+		return nil, err
+	}
+	return &secretsmanager.GetSecretValueOutput{
+		Name:         aws.String(name),
+		ARN:          aws.String(secret.ARN),
+		SecretString: aws.String(secret.Value),
+		VersionId:    aws.String(secret.VersionID),
+	}, nil
+}
+
+func (f *fakeSecretsManager) BatchGetSecretValue(ctx context.Context, params *secretsmanager.BatchGetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error) {
+	if err := f.check("BatchGetSecretValue"); err != nil {
+		return nil, err
+	}
+	if len(params.SecretIdList) > 20 {
+		return nil, &smithy.GenericAPIError{Code: "InvalidParameterException", Message: "too many secret ids"}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &secretsmanager.BatchGetSecretValueOutput{}
+	for _, id := range params.SecretIdList {
+		name, secret, err := f.lookup(id)
+		if err != nil {
+			output.Errors = append(output.Errors, secretsmanagerTypes.APIErrorType{
+				SecretId:  aws.String(id),
+				ErrorCode: aws.String("ResourceNotFoundException"),
+				Message:   aws.String("secret not found"),
+			})
+			continue
+		}
+		output.SecretValues = append(output.SecretValues, secretsmanagerTypes.SecretValueEntry{
+			Name:         aws.String(name),
+			ARN:          aws.String(secret.ARN),
+			SecretString: aws.String(secret.Value),
+			VersionId:    aws.String(secret.VersionID),
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeSecretsManager) PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error) {
+	if err := f.check("PutSecretValue"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	name, _, err := f.lookup(aws.ToString(params.SecretId))
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	f.put(name, aws.ToString(params.SecretString))
+	return &secretsmanager.PutSecretValueOutput{Name: aws.String(name)}, nil
+}
+
+// fakeS3 is an in-memory S3 verifying and returning SHA-256 checksums.
+type fakeS3 struct {
+	*fakeFaults
+	mu      sync.Mutex
+	objects map[string][]byte
+	// corrupt flips a byte of every object stored after its checksum was
+	// verified, as if it rotted at rest.
+	corrupt bool
+	// versioning and objectLock are the bucket settings checked before
+	// locked backups; puts and copies record every PutObject and CopyObject
+	// call.
+	versioning bool
+	objectLock bool
+	puts       []*s3.PutObjectInput
+	copies     []*s3.CopyObjectInput
+	// With versioning, every stored object gets a version ID, and every
+	// version is kept in versions until it is deleted by its ID. Deleting
+	// an object without its version ID leaves a delete marker, recorded in
+	// deleteMarkers, and the deleted version behind.
+	versionIDs    map[string]string
+	versions      map[string][]byte
+	lastVersion   int
+	deleteMarkers []string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{fakeFaults: newFakeFaults(), objects: map[string][]byte{}, versionIDs: map[string]string{}, versions: map[string][]byte{}}
+}
+
+func (f *fakeS3) object(bucket string, key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[bucket+"/"+key]
+	return body, ok
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fakeChecksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := f.check("GetObject"); err != nil {
+		return nil, err
+	}
+	body, ok := f.object(aws.ToString(params.Bucket), aws.ToString(params.Key))
+	if params.VersionId != nil && f.versioning {
+		f.mu.Lock()
+		body, ok = f.versions[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)+"?versionId="+*params.VersionId]
+		f.mu.Unlock()
+		if !ok {
+			return nil, &smithy.GenericAPIError{Code: "NoSuchVersion", Message: "The specified version does not exist."}
+		}
+	}
+	if !ok {
+		return nil, &s3Types.NoSuchKey{Message: aws.String(aws.ToString(params.Key))}
+	}
+	output := &s3.GetObjectOutput{
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: aws.Int64(int64(len(body))),
+		LastModified:  aws.Time(time.Now()),
+	}
+	if params.ChecksumMode == s3Types.ChecksumModeEnabled {
+		output.ChecksumSHA256 = aws.String(fakeChecksum(body))
+	}
+	return output, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := f.check("PutObject"); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	checksum := fakeChecksum(body)
+	if params.ChecksumSHA256 != nil && *params.ChecksumSHA256 != checksum {
+		return nil, &smithy.GenericAPIError{Code: "BadDigest", Message: "checksum mismatch"}
+	}
+	f.mu.Lock()
+	f.puts = append(f.puts, params)
+	f.mu.Unlock()
+	versionID := f.store(aws.ToString(params.Bucket), aws.ToString(params.Key), body)
+	return &s3.PutObjectOutput{ChecksumSHA256: aws.String(checksum), VersionId: versionID}, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	if err := f.check("CopyObject"); err != nil {
+		return nil, err
+	}
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	body, ok := f.objects[source]
+	f.mu.Unlock()
+	if !ok {
+		return nil, &s3Types.NoSuchKey{Message: aws.String(source)}
+	}
+	f.mu.Lock()
+	f.copies = append(f.copies, params)
+	f.mu.Unlock()
+	versionID := f.store(aws.ToString(params.Bucket), aws.ToString(params.Key), body)
+	return &s3.CopyObjectOutput{CopyObjectResult: &s3Types.CopyObjectResult{ChecksumSHA256: aws.String(fakeChecksum(body))}, VersionId: versionID}, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if err := f.check("DeleteObject"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := aws.ToString(params.Bucket) + "/" + aws.ToString(params.Key)
+	if f.versioning {
+		if params.VersionId == nil {
+			f.deleteMarkers = append(f.deleteMarkers, key)
+		} else {
+			delete(f.versions, key+"?versionId="+*params.VersionId)
+			if *params.VersionId != f.versionIDs[key] {
+				// Deleting a version other than the current one.
+				return &s3.DeleteObjectOutput{VersionId: params.VersionId}, nil
+			}
+		}
+	}
+	delete(f.objects, key)
+	delete(f.versionIDs, key)
+	return &s3.DeleteObjectOutput{VersionId: params.VersionId}, nil
+}
+
+func (f *fakeS3) GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error) {
+	if err := f.check("GetBucketVersioning"); err != nil {
+		return nil, err
+	}
+	if !f.versioning {
+		return &s3.GetBucketVersioningOutput{}, nil
+	}
+	return &s3.GetBucketVersioningOutput{Status: s3Types.BucketVersioningStatusEnabled}, nil
+}
+
+func (f *fakeS3) GetObjectLockConfiguration(ctx context.Context, params *s3.GetObjectLockConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetObjectLockConfigurationOutput, error) {
+	if err := f.check("GetObjectLockConfiguration"); err != nil {
+		return nil, err
+	}
+	if !f.objectLock {
+		return nil, &smithy.GenericAPIError{Code: "ObjectLockConfigurationNotFoundError", Message: "Object Lock configuration does not exist for this bucket"}
+	}
+	return &s3.GetObjectLockConfigurationOutput{
+		ObjectLockConfiguration: &s3Types.ObjectLockConfiguration{ObjectLockEnabled: s3Types.ObjectLockEnabledEnabled},
+	}, nil
+}
+
+// store stores body at key and returns its version ID if the bucket is
+// versioned.
+func (f *fakeS3) store(bucket string, key string, body []byte) *string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body = slices.Clone(body)
+	if f.corrupt && len(body) > 0 {
+		body[len(body)-1] ^= 0xff
+	}
+	f.objects[bucket+"/"+key] = body
+	if !f.versioning {
+		return nil
+	}
+	f.lastVersion++
+	f.versionIDs[bucket+"/"+key] = fmt.Sprintf("v%d", f.lastVersion)
+	f.versions[bucket+"/"+key+"?versionId="+f.versionIDs[bucket+"/"+key]] = body
+	return aws.String(f.versionIDs[bucket+"/"+key])
+}
+
+// fakeKMS hands out random data keys and decrypts only the ones it issued.
+type fakeKMS struct {
+	*fakeFaults
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func newFakeKMS() *fakeKMS {
+	return &fakeKMS{fakeFaults: newFakeFaults(), keys: map[string][]byte{}}
+}
+
+func (f *fakeKMS) GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	if err := f.check("GenerateDataKey"); err != nil {
+		return nil, err
+	}
+	if params.KeySpec != kmsTypes.DataKeySpecAes256 {
+		return nil, &smithy.GenericAPIError{Code: "ValidationException", Message: "unsupported key spec"}
+	}
+	plaintext := make([]byte, 32)
+	ciphertext := make([]byte, 64)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(ciphertext); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[string(ciphertext)] = plaintext
+	return &kms.GenerateDataKeyOutput{
+		KeyId:          aws.String("arn:aws:kms:ap-northeast-1:123456789012:key/" + aws.ToString(params.KeyId)),
+		Plaintext:      plaintext,
+		CiphertextBlob: ciphertext,
+	}, nil
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	if err := f.check("Decrypt"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	plaintext, ok := f.keys[string(params.CiphertextBlob)]
+	if !ok {
+		return nil, &kmsTypes.InvalidCiphertextException{Message: aws.String("invalid ciphertext")}
+	}
+	return &kms.DecryptOutput{Plaintext: plaintext}, nil
+}
+
+type fakeHostedConfigurationVersion struct {
+	Content     []byte
+	ContentType string
+}
+
+type fakeConfigurationProfile struct {
+	ID          string
+	Name        string
+	LocationURI string
+	Versions    []fakeHostedConfigurationVersion
+}
+
+type fakeApplication struct {
+	ID       string
+	Name     string
+	Profiles []*fakeConfigurationProfile
+}
+
+// fakeAppConfig is an in-memory AppConfig with its hosted configuration
+// store. Version numbers start at 1 and are the index of a version plus one.
+type fakeAppConfig struct {
+	*fakeFaults
+	mu           sync.Mutex
+	applications []*fakeApplication
+}
+
+func newFakeAppConfig() *fakeAppConfig {
+	return &fakeAppConfig{fakeFaults: newFakeFaults()}
+}
+
+// put adds a hosted configuration version to the profile of the
+// application, creating both as needed.
+func (f *fakeAppConfig) put(applicationName string, profileName string, contentType string, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	profile := f.profile(applicationName, profileName, true)
+	profile.Versions = append(profile.Versions, fakeHostedConfigurationVersion{Content: []byte(content), ContentType: contentType})
+}
+
+func (f *fakeAppConfig) latest(applicationName string, profileName string) fakeHostedConfigurationVersion {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	profile := f.profile(applicationName, profileName, false)
+	if profile == nil || len(profile.Versions) == 0 {
+		return fakeHostedConfigurationVersion{}
+	}
+	return profile.Versions[len(profile.Versions)-1]
+}
+
+func (f *fakeAppConfig) profile(applicationName string, profileName string, create bool) *fakeConfigurationProfile {
+	var application *fakeApplication
+	for _, a := range f.applications {
+		if a.Name == applicationName {
+			application = a
+		}
+	}
+	if application == nil {
+		if !create {
+			return nil
+		}
+		application = &fakeApplication{ID: fmt.Sprintf("app%d", len(f.applications)+1), Name: applicationName}
+		f.applications = append(f.applications, application)
+	}
+	for _, profile := range application.Profiles {
+		if profile.Name == profileName {
+			return profile
+		}
+	}
+	if !create {
+		return nil
+	}
+	profile := &fakeConfigurationProfile{ID: fmt.Sprintf("%s-profile%d", application.ID, len(application.Profiles)+1), Name: profileName, LocationURI: "hosted"}
+	application.Profiles = append(application.Profiles, profile)
+	return profile
+}
+
+func (f *fakeAppConfig) lookup(applicationID *string, profileID *string) (*fakeApplication, *fakeConfigurationProfile, error) {
+	for _, application := range f.applications {
+		if application.ID != aws.ToString(applicationID) {
+			continue
+		}
+		for _, profile := range application.Profiles {
+			if profile.ID == aws.ToString(profileID) {
+				return application, profile, nil
+			}
+		}
+	}
+	return nil, nil, &appconfigTypes.ResourceNotFoundException{Message: aws.String(aws.ToString(profileID))}
+}
+
+func (f *fakeAppConfig) ListApplications(ctx context.Context, params *appconfig.ListApplicationsInput, optFns ...func(*appconfig.Options)) (*appconfig.ListApplicationsOutput, error) {
+	if err := f.check("ListApplications"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &appconfig.ListApplicationsOutput{}
+	for _, application := range f.applications {
+		output.Items = append(output.Items, appconfigTypes.Application{Id: aws.String(application.ID), Name: aws.String(application.Name)})
+	}
+	return output, nil
+}
+
+func (f *fakeAppConfig) ListConfigurationProfiles(ctx context.Context, params *appconfig.ListConfigurationProfilesInput, optFns ...func(*appconfig.Options)) (*appconfig.ListConfigurationProfilesOutput, error) {
+	if err := f.check("ListConfigurationProfiles"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &appconfig.ListConfigurationProfilesOutput{}
+	for _, application := range f.applications {
+		if application.ID != aws.ToString(params.ApplicationId) {
+			continue
+		}
+		for _, profile := range application.Profiles {
+			output.Items = append(output.Items, appconfigTypes.ConfigurationProfileSummary{
+				ApplicationId: aws.String(application.ID),
+				Id:            aws.String(profile.ID),
+				Name:          aws.String(profile.Name),
+				LocationUri:   aws.String(profile.LocationURI),
+			})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeAppConfig) ListHostedConfigurationVersions(ctx context.Context, params *appconfig.ListHostedConfigurationVersionsInput, optFns ...func(*appconfig.Options)) (*appconfig.ListHostedConfigurationVersionsOutput, error) {
+	if err := f.check("ListHostedConfigurationVersions"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, profile, err := f.lookup(params.ApplicationId, params.ConfigurationProfileId)
+	if err != nil {
+		return nil, err
+	}
+	output := &appconfig.ListHostedConfigurationVersionsOutput{}
+	for i := len(profile.Versions) - 1; i >= 0; i-- {
+		output.Items = append(output.Items, appconfigTypes.HostedConfigurationVersionSummary{
+			ApplicationId:          params.ApplicationId,
+			ConfigurationProfileId: params.ConfigurationProfileId,
+			ContentType:            aws.String(profile.Versions[i].ContentType),
+			VersionNumber:          int32(i + 1),
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeAppConfig) GetHostedConfigurationVersion(ctx context.Context, params *appconfig.GetHostedConfigurationVersionInput, optFns ...func(*appconfig.Options)) (*appconfig.GetHostedConfigurationVersionOutput, error) {
+	if err := f.check("GetHostedConfigurationVersion"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, profile, err := f.lookup(params.ApplicationId, params.ConfigurationProfileId)
+	if err != nil {
+		return nil, err
+	}
+	number := int(aws.ToInt32(params.VersionNumber))
+	if number < 1 || number > len(profile.Versions) {
+		return nil, &appconfigTypes.ResourceNotFoundException{Message: aws.String(strconv.Itoa(number))}
+	}
+	version := profile.Versions[number-1]
+	return &appconfig.GetHostedConfigurationVersionOutput{
+		ApplicationId:          params.ApplicationId,
+		ConfigurationProfileId: params.ConfigurationProfileId,
+		Content:                slices.Clone(version.Content),
+		ContentType:            aws.String(version.ContentType),
+		VersionNumber:          int32(number),
+	}, nil
+}
+
+func (f *fakeAppConfig) CreateHostedConfigurationVersion(ctx context.Context, params *appconfig.CreateHostedConfigurationVersionInput, optFns ...func(*appconfig.Options)) (*appconfig.CreateHostedConfigurationVersionOutput, error) {
+	if err := f.check("CreateHostedConfigurationVersion"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, profile, err := f.lookup(params.ApplicationId, params.ConfigurationProfileId)
+	if err != nil {
+		return nil, err
+	}
+	if params.LatestVersionNumber != nil && int(*params.LatestVersionNumber) != len(profile.Versions) {
+		return nil, &appconfigTypes.ConflictException{Message: aws.String("latest version number does not match")}
+	}
+	profile.Versions = append(profile.Versions, fakeHostedConfigurationVersion{Content: slices.Clone(params.Content), ContentType: aws.ToString(params.ContentType)})
+	return &appconfig.CreateHostedConfigurationVersionOutput{
+		ApplicationId:          params.ApplicationId,
+		ConfigurationProfileId: params.ConfigurationProfileId,
+		ContentType:            params.ContentType,
+		VersionNumber:          int32(len(profile.Versions)),
+	}, nil
+}
+
+type fakeFunction struct {
+	ARN       string
+	KMSKeyArn string
+	Variables map[string]string
+	Revision  int
+}
+
+// fakeLambda is an in-memory Lambda holding the environment variables of
+// functions.
+type fakeLambda struct {
+	*fakeFaults
+	mu        sync.Mutex
+	functions map[string]*fakeFunction
+}
+
+func newFakeLambda() *fakeLambda {
+	return &fakeLambda{fakeFaults: newFakeFaults(), functions: map[string]*fakeFunction{}}
+}
+
+func (f *fakeLambda) put(functionName string, name string, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	function, ok := f.functions[functionName]
+	if !ok {
+		function = &fakeFunction{
+			ARN:       "arn:aws:lambda:ap-northeast-1:123456789012:function:" + functionName,
+			KMSKeyArn: "arn:aws:kms:ap-northeast-1:123456789012:key/" + functionName,
+			Variables: map[string]string{},
+		}
+		f.functions[functionName] = function
+	}
+	function.Variables[name] = value
+	function.Revision++
+}
+
+func (f *fakeLambda) value(functionName string, name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if function, ok := f.functions[functionName]; ok {
+		return function.Variables[name]
+	}
+	return ""
+}
+
+func (f *fakeLambda) configuration(functionName string) lambdaTypes.FunctionConfiguration {
+	function := f.functions[functionName]
+	return lambdaTypes.FunctionConfiguration{
+		FunctionName: aws.String(functionName),
+		FunctionArn:  aws.String(function.ARN),
+		KMSKeyArn:    aws.String(function.KMSKeyArn),
+		Environment:  &lambdaTypes.EnvironmentResponse{Variables: maps.Clone(function.Variables)},
+		RevisionId:   aws.String(strconv.Itoa(function.Revision)),
+	}
+}
+
+func (f *fakeLambda) ListFunctions(ctx context.Context, params *lambda.ListFunctionsInput, optFns ...func(*lambda.Options)) (*lambda.ListFunctionsOutput, error) {
+	if err := f.check("ListFunctions"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &lambda.ListFunctionsOutput{}
+	for _, name := range slices.Sorted(maps.Keys(f.functions)) {
+		output.Functions = append(output.Functions, f.configuration(name))
+	}
+	return output, nil
+}
+
+func (f *fakeLambda) GetFunctionConfiguration(ctx context.Context, params *lambda.GetFunctionConfigurationInput, optFns ...func(*lambda.Options)) (*lambda.GetFunctionConfigurationOutput, error) {
+	if err := f.check("GetFunctionConfiguration"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := aws.ToString(params.FunctionName)
+	if _, ok := f.functions[name]; !ok {
+		return nil, &lambdaTypes.ResourceNotFoundException{Message: aws.String(name)}
+	}
+	configuration := f.configuration(name)
+	return &lambda.GetFunctionConfigurationOutput{
+		FunctionName: configuration.FunctionName,
+		FunctionArn:  configuration.FunctionArn,
+		KMSKeyArn:    configuration.KMSKeyArn,
+		Environment:  configuration.Environment,
+		RevisionId:   configuration.RevisionId,
+	}, nil
+}
+
+func (f *fakeLambda) UpdateFunctionConfiguration(ctx context.Context, params *lambda.UpdateFunctionConfigurationInput, optFns ...func(*lambda.Options)) (*lambda.UpdateFunctionConfigurationOutput, error) {
+	if err := f.check("UpdateFunctionConfiguration"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := aws.ToString(params.FunctionName)
+	function, ok := f.functions[name]
+	if !ok {
+		return nil, &lambdaTypes.ResourceNotFoundException{Message: aws.String(name)}
+	}
+	if params.RevisionId != nil && *params.RevisionId != strconv.Itoa(function.Revision) {
+		return nil, &lambdaTypes.PreconditionFailedException{Message: aws.String("revision id does not match")}
+	}
+	if params.KMSKeyArn != nil {
+		function.KMSKeyArn = *params.KMSKeyArn
+	}
+	if params.Environment != nil {
+		function.Variables = maps.Clone(params.Environment.Variables)
+	}
+	function.Revision++
+	return &lambda.UpdateFunctionConfigurationOutput{FunctionName: params.FunctionName, RevisionId: aws.String(strconv.Itoa(function.Revision))}, nil
+}
+
+// fakeAWS bundles the fakes behind a Client.
+type fakeAWS struct {
+	ssm            *fakeSSM
+	secretsmanager *fakeSecretsManager
+	appconfig      *fakeAppConfig
+	lambda         *fakeLambda
+	s3             *fakeS3
+	kms            *fakeKMS
+}
+
+func newFakeAWS() *fakeAWS {
+	return &fakeAWS{
+		ssm:            newFakeSSM(),
+		secretsmanager: newFakeSecretsManager(),
+		appconfig:      newFakeAppConfig(),
+		lambda:         newFakeLambda(),
+		s3:             newFakeS3(),
+		kms:            newFakeKMS(),
+	}
+}
+
+func (f *fakeAWS) client() *Client {
+	return &Client{SSM: f.ssm, SecretsManager: f.secretsmanager, AppConfig: f.appconfig, Lambda: f.lambda, S3: f.s3, KMS: f.kms}
+}
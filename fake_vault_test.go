@@ -0,0 +1,167 @@
+package brsp
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeVaultVersion struct {
+	Data        map[string]any
+	CreatedTime time.Time
+	Deleted     bool
+}
+
+// fakeVault is an in-memory Vault with a KV version 2 secrets engine mounted
+// at secret/ and AppRole auth, served over HTTP like a Vault dev server.
+type fakeVault struct {
+	*httptest.Server
+	mu       sync.Mutex
+	token    string
+	roleID   string
+	secretID string
+	secrets  map[string][]*fakeVaultVersion
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	f := &fakeVault{token: "root-token", roleID: "role", secretID: "secret-id", secrets: map[string][]*fakeVaultVersion{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// put writes a new version of the secret at path.
+func (f *fakeVault) put(path string, data map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[path] = append(f.secrets[path], &fakeVaultVersion{Data: maps.Clone(data), CreatedTime: time.Now().UTC()})
+}
+
+// deleteVersion soft deletes the version of the secret at path.
+func (f *fakeVault) deleteVersion(path string, version int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[path][version-1].Deleted = true
+}
+
+func (f *fakeVault) latest(path string) map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	versions := f.secrets[path]
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1].Data
+}
+
+func (f *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeJSON := func(status int, body any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+	fail := func(status int, message string) {
+		writeJSON(status, map[string][]string{"errors": {message}})
+	}
+
+	if r.Method == http.MethodPost && r.URL.Path == "/v1/auth/approle/login" {
+		var input map[string]string
+		if json.NewDecoder(r.Body).Decode(&input) != nil || input["role_id"] != f.roleID || input["secret_id"] != f.secretID {
+			fail(http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+		writeJSON(http.StatusOK, map[string]any{"auth": map[string]string{"client_token": f.token}})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != f.token {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+
+	switch {
+	case r.Method == "LIST" && strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		dir := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+		if dir != "" && !strings.HasSuffix(dir, "/") {
+			dir += "/"
+		}
+		keys := []string{}
+		for path := range f.secrets {
+			if rest, ok := strings.CutPrefix(path, dir); ok {
+				if i := strings.Index(rest, "/"); i >= 0 {
+					rest = rest[:i+1]
+				}
+				if !slices.Contains(keys, rest) {
+					keys = append(keys, rest)
+				}
+			}
+		}
+		if len(keys) == 0 {
+			fail(http.StatusNotFound, "")
+			return
+		}
+		slices.Sort(keys)
+		writeJSON(http.StatusOK, map[string]any{"data": map[string]any{"keys": keys}})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		versions, ok := f.secrets[strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")]
+		if !ok {
+			fail(http.StatusNotFound, "")
+			return
+		}
+		metadata := map[string]any{}
+		for i, version := range versions {
+			metadata[strconv.Itoa(i+1)] = map[string]any{"created_time": version.CreatedTime, "deletion_time": deletionTime(version), "destroyed": false}
+		}
+		writeJSON(http.StatusOK, map[string]any{"data": map[string]any{"current_version": len(versions), "versions": metadata}})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		versions := f.secrets[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")]
+		number := len(versions)
+		if v := r.URL.Query().Get("version"); v != "" {
+			number, _ = strconv.Atoi(v)
+		}
+		if number < 1 || number > len(versions) || versions[number-1].Deleted {
+			fail(http.StatusNotFound, "")
+			return
+		}
+		version := versions[number-1]
+		writeJSON(http.StatusOK, map[string]any{"data": map[string]any{
+			"data":     version.Data,
+			"metadata": map[string]any{"version": number, "created_time": version.CreatedTime, "deletion_time": "", "destroyed": false},
+		}})
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		var input struct {
+			Data    map[string]any `json:"data"`
+			Options struct {
+				Cas *int `json:"cas"`
+			} `json:"options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		if input.Options.Cas != nil && *input.Options.Cas != len(f.secrets[path]) {
+			fail(http.StatusBadRequest, "check-and-set parameter did not match the current version")
+			return
+		}
+		f.secrets[path] = append(f.secrets[path], &fakeVaultVersion{Data: input.Data, CreatedTime: time.Now().UTC()})
+		writeJSON(http.StatusOK, map[string]any{"data": map[string]any{"version": len(f.secrets[path])}})
+	default:
+		fail(http.StatusNotFound, "")
+	}
+}
+
+func deletionTime(version *fakeVaultVersion) string {
+	if version.Deleted {
+		return version.CreatedTime.Format(time.RFC3339Nano)
+	}
+	return ""
+}
@@ -0,0 +1,232 @@
+package brsp
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// backupItem is the name and plaintext value of a parameter or secret in a backup.
+type backupItem struct {
+	Name  string
+	Value string
+}
+
+// parseBackupItems extracts names and values from a decrypted backup of any
+// schema version.
+func parseBackupItems(decrypted []byte) ([]backupItem, error) {
+	doc, err := decodeBackup(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]backupItem, 0, len(doc.Items))
+	for _, item := range doc.Items {
+		registerSecret(item.Value)
+		items = append(items, backupItem{Name: item.Name, Value: item.Value})
+	}
+	return items, nil
+}
+
+// formatBackup renders a decrypted backup in the format of opt. json and
+// yaml render the whole document in the current schema version.
+func formatBackup(w io.Writer, decrypted []byte, opt *DownloadBackupCommandOption) error {
+	format := opt.Format
+	switch format {
+	case "k8s-secret", "external-secret":
+		doc, err := decodeBackup(decrypted)
+		if err != nil {
+			return err
+		}
+		return writeK8sManifest(w, format, doc, opt.Key, opt.K8sManifestOption)
+	case "json", "yaml":
+		doc, err := decodeBackup(decrypted)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if format == "json" {
+			_, err := fmt.Fprintln(w, string(body))
+			return err
+		}
+		var document map[string]any
+		if err := json.Unmarshal(body, &document); err != nil {
+			return err
+		}
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(document); err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+
+	items, err := parseBackupItems(decrypted)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "dotenv":
+		names, err := envNames(items)
+		if err != nil {
+			return err
+		}
+		for i, item := range items {
+			if _, err := fmt.Fprintf(w, "%s=%s\n", names[i], dotenvQuote(item.Value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "shell":
+		names, err := envNames(items)
+		if err != nil {
+			return err
+		}
+		for i, item := range items {
+			if _, err := fmt.Fprintf(w, "export %s=%s\n", names[i], shellQuote(item.Value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"name", "value"}); err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := writer.Write([]string{item.Name, item.Value}); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "tree":
+		return writeTree(w, items)
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+var envNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// envName turns a parameter or secret name such as /dev/db/password into an
+// environment variable name such as DEV_DB_PASSWORD.
+func envName(name string) string {
+	env := strings.Trim(envNameInvalidChars.ReplaceAllString(name, "_"), "_")
+	env = strings.ToUpper(env)
+	if env == "" || (env[0] >= '0' && env[0] <= '9') {
+		env = "_" + env
+	}
+	return env
+}
+
+// envNames returns the environment variable name of each item, failing if
+// two items map to the same one, which would silently overwrite the first.
+func envNames(items []backupItem) ([]string, error) {
+	names := make([]string, 0, len(items))
+	sources := map[string]string{}
+	for _, item := range items {
+		name := envName(item.Name)
+		if other, ok := sources[name]; ok {
+			return nil, fmt.Errorf("%s and %s map to the same environment variable %s", other, item.Name, name)
+		}
+		sources[name] = item.Name
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func dotenvQuote(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+type treeNode struct {
+	children map[string]*treeNode
+	value    *string
+}
+
+func writeTree(w io.Writer, items []backupItem) error {
+	root := &treeNode{children: map[string]*treeNode{}}
+	for _, item := range items {
+		node := root
+		for _, part := range strings.Split(strings.Trim(item.Name, "/"), "/") {
+			child, ok := node.children[part]
+			if !ok {
+				child = &treeNode{children: map[string]*treeNode{}}
+				node.children[part] = child
+			}
+			node = child
+		}
+		value := item.Value
+		node.value = &value
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("/\n")
+	writeTreeNode(&buf, root, "")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeTreeNode(buf *bytes.Buffer, node *treeNode, indent string) {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		child := node.children[name]
+		branch, next := "├── ", "│   "
+		if i == len(names)-1 {
+			branch, next = "└── ", "    "
+		}
+		buf.WriteString(indent + branch + name)
+		if child.value != nil {
+			fmt.Fprintf(buf, " = %q", *child.value)
+		}
+		buf.WriteString("\n")
+		writeTreeNode(buf, child, indent+next)
+	}
+}
+
+// writeFile writes data to path, readable only by the owner.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0o600)
+}
+
+// writeSplit writes the value of each item to its own file under dir,
+// mirroring the hierarchy of the item names.
+func writeSplit(dir string, items []backupItem) error {
+	for _, item := range items {
+		rel := filepath.FromSlash(strings.Trim(item.Name, "/"))
+		if rel == "" || !filepath.IsLocal(rel) {
+			return fmt.Errorf("cannot write %s under %s", item.Name, dir)
+		}
+		if err := writeFile(filepath.Join(dir, rel), []byte(item.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
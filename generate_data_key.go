@@ -3,66 +3,79 @@ package brsp
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"strings"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	kmsTypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
-	"strings"
 )
 
 type GenerateDataKeyCommand struct {
-	ssmClient *ssm.Client
-	s3Client  *s3.Client
-	kmsClient *kms.Client
+	ssmClient SSMAPI
+	s3Client  S3API
+	kmsClient KMSAPI
 	opt       *GenerateDataKeyCommandOption
 }
 
 type GenerateDataKeyCommandOption struct {
+	commandOption
 	TargetRegion     string `help:"target region"`
 	BucketName       string `help:"bucket name"`
 	Key              string `help:"key"`
 	EncryptionKmsKey string `help:"KMS key for encryption"`
 }
 
-func NewGenerateDataKeyCommand(opt *GenerateDataKeyCommandOption) (*GenerateDataKeyCommand, error) {
-	awsConfig, err := getAwsConfig()
+// NewGenerateDataKeyCommandOption returns options set to the CLI defaults.
+func NewGenerateDataKeyCommandOption() *GenerateDataKeyCommandOption {
+	return withDefaults(&GenerateDataKeyCommandOption{})
+}
+
+func NewGenerateDataKeyCommand(ctx context.Context, opt *GenerateDataKeyCommandOption) (*GenerateDataKeyCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get aws config, %v", err)
 	}
-	targetAwsConfig, err := getTargetAwsConfig(opt.TargetRegion)
+	targetAwsConfig, err := getTargetAwsConfig(ctx, opt.TargetRegion)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get target aws config, %v", err)
 	}
-	fmt.Println("region: ", targetAwsConfig.Region)
+	slog.Debug("target aws config", "region", targetAwsConfig.Region)
+	return NewClient(awsConfig, targetAwsConfig).generateDataKeyCommand(opt), nil
+}
+
+func (c *Client) generateDataKeyCommand(opt *GenerateDataKeyCommandOption) *GenerateDataKeyCommand {
 	return &GenerateDataKeyCommand{
-		s3Client:  s3.NewFromConfig(targetAwsConfig),
-		ssmClient: ssm.NewFromConfig(awsConfig),
-		kmsClient: kms.NewFromConfig(targetAwsConfig),
+		s3Client:  c.S3,
+		ssmClient: c.SSM,
+		kmsClient: c.KMS,
 		opt:       opt,
-	}, nil
+	}
 }
 
-func (c *GenerateDataKeyCommand) Run() error {
-	fmt.Printf("BucketName: %s\n", c.opt.BucketName)
+func (c *GenerateDataKeyCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("generate-data-key")
+	slog.Info("generating data key", "bucket", c.opt.BucketName, "key", c.opt.Key)
 	generateDataKeyInput := &kms.GenerateDataKeyInput{
 		KeyId:   aws.String(c.opt.EncryptionKmsKey),
 		KeySpec: kmsTypes.DataKeySpecAes256,
 	}
-	result, err := c.kmsClient.GenerateDataKey(context.TODO(), generateDataKeyInput)
+	result, err := c.kmsClient.GenerateDataKey(ctx, generateDataKeyInput)
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	_, err = c.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+	_, err = c.s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:  aws.String(c.opt.BucketName),
 		Key:     aws.String(c.opt.Key),
 		Body:    strings.NewReader(string(result.CiphertextBlob)),
 		Tagging: aws.String(fmt.Sprintf("KeyId=%s", *result.KeyId)),
 	})
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	return nil
+	report.add(ReportItem{Source: *result.KeyId, Target: c.opt.Key, Action: ReportActionGenerate})
+	return report, nil
 }
@@ -0,0 +1,265 @@
+package brsp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ImportCommand struct {
+	client *Client
+	opt    *ImportCommandOption
+}
+
+type ImportCommandOption struct {
+	commandOption
+	File              string `required:"" type:"existingfile" help:"dotenv, YAML or JSON file to import, plaintext or encrypted with SOPS"`
+	Format            string `default:"auto" enum:"auto,dotenv,yaml,json" help:"format of --file (auto detects it from the extension)"`
+	Kind              string `required:"" enum:"parameters,secrets" help:"import into parameters or secrets"`
+	Prefix            string `help:"prefix added to every name in --file, e.g. /app/"`
+	SopsBinary        string `default:"sops" help:"sops command used to decrypt a SOPS-encrypted --file"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	DataKeyFile       string `type:"existingfile" help:"local copy of the KMS-encrypted data key"`
+	IdentityFile      string `type:"existingfile" help:"file containing the base64-encoded plaintext data key"`
+	DryRun            bool   `default:"true" help:"Dry run"`
+	Journal           string `help:"path of the restore journal (default: restore-journal-<time>.json)"`
+	PlaintextJournal  bool   `help:"allow importing without a data key, writing the previous values to the journal unencrypted"`
+	RollbackOnFailure bool   `default:"true" negatable:"" help:"roll back modified targets when the import fails midway"`
+}
+
+// NewImportCommandOption returns options set to the CLI defaults.
+func NewImportCommandOption() *ImportCommandOption {
+	return withDefaults(&ImportCommandOption{})
+}
+
+func NewImportCommand(ctx context.Context, opt *ImportCommandOption) (*ImportCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(awsConfig, awsConfig).importCommand(opt), nil
+}
+
+func (c *Client) importCommand(opt *ImportCommandOption) *ImportCommand {
+	return &ImportCommand{
+		client: c,
+		opt:    opt,
+	}
+}
+
+// Run restores the values in --file like a backup: only targets holding the
+// placeholder are written, with a journal for rollback.
+func (c *ImportCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("import")
+	slog.Info("importing", "file", c.opt.File, "kind", c.opt.Kind)
+	items, err := c.readItems(ctx)
+	if err != nil {
+		return report, err
+	}
+	// The journal is encrypted with the data key like that of a restore;
+	// --file is recorded as its source.
+	loc := backupLocation{
+		DataKeyBucketName: c.opt.DataKeyBucketName,
+		DataKeyKey:        c.opt.DataKeyKey,
+		FromFile:          c.opt.File,
+		DataKeyFile:       c.opt.DataKeyFile,
+		IdentityFile:      c.opt.IdentityFile,
+	}
+	return report, restoreItems(ctx, c.client, c.opt.Kind, items, loc, c.opt.DryRun, restoreJournalOption{Path: c.opt.Journal, Plaintext: c.opt.PlaintextJournal}, c.opt.RollbackOnFailure, report)
+}
+
+// readItems reads --file, decrypting it with sops if it is encrypted, into
+// items sorted by name.
+func (c *ImportCommand) readItems(ctx context.Context) ([]backupItem, error) {
+	format := c.opt.Format
+	if format == "auto" {
+		switch strings.ToLower(filepath.Ext(c.opt.File)) {
+		case ".env":
+			format = "dotenv"
+		case ".yaml", ".yml":
+			format = "yaml"
+		case ".json":
+			format = "json"
+		default:
+			return nil, fmt.Errorf("cannot detect the format of %s, specify --format", c.opt.File)
+		}
+	}
+	body, err := os.ReadFile(c.opt.File)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+	if format == "dotenv" {
+		values, err = parseDotenv(body)
+	} else {
+		values, err = parseImportDocument(body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s, %v", c.opt.File, err)
+	}
+	if isSopsEncrypted(values) {
+		if body, err = c.sopsDecrypt(ctx, format); err != nil {
+			return nil, err
+		}
+		if format == "dotenv" {
+			values, err = parseDotenv(body)
+		} else {
+			values, err = parseImportDocument(body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the decrypted %s, %v", c.opt.File, err)
+		}
+	}
+
+	items := []backupItem{}
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		registerSecret(values[name])
+		items = append(items, backupItem{Name: c.opt.Prefix + name, Value: values[name]})
+	}
+	return items, nil
+}
+
+func (c *ImportCommand) sopsDecrypt(ctx context.Context, format string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.opt.SopsBinary, "--decrypt", "--input-type", format, "--output-type", format, c.opt.File)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s with sops, %v: %s", c.opt.File, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// isSopsEncrypted tells whether values were read from a file encrypted with
+// SOPS, which adds its metadata as the "sops" key, or as "sops_*" keys in
+// dotenv files.
+func isSopsEncrypted(values map[string]string) bool {
+	for name := range values {
+		if name == "sops" || strings.HasPrefix(name, "sops_") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseImportDocument reads a YAML or JSON object of names to values. Scalar
+// values are taken as written, and objects and arrays are encoded as JSON,
+// e.g. for secrets holding JSON.
+func parseImportDocument(body []byte) (map[string]string, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(body, &document); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	if len(document.Content) == 0 {
+		return values, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected an object of names to values")
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name, node := root.Content[i].Value, root.Content[i+1]
+		switch {
+		case node.Kind == yaml.ScalarNode && node.Tag == "!!null":
+			return nil, fmt.Errorf("value of %s is null", name)
+		case node.Kind == yaml.ScalarNode:
+			values[name] = node.Value
+		default:
+			var value any
+			if err := node.Decode(&value); err != nil {
+				return nil, fmt.Errorf("invalid value of %s, %v", name, err)
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("value of %s cannot be encoded as JSON, %v", name, err)
+			}
+			values[name] = string(encoded)
+		}
+	}
+	return values, nil
+}
+
+// parseDotenv reads NAME=value lines, optionally prefixed with export. Double
+// quoted values are unescaped as download-backup --format dotenv escapes
+// them, single quoted values are taken literally, and comments are ignored.
+func parseDotenv(body []byte) (map[string]string, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d is not NAME=value", n)
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := dotenvUnquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d, %v", n, err)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d has an unterminated quote", n)
+			}
+			value = value[1 : end+1]
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
+
+// dotenvUnquote reverses dotenvQuote, ignoring anything after the closing
+// quote such as a comment.
+func dotenvUnquote(value string) (string, error) {
+	var b strings.Builder
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if i+1 == len(value) {
+				return "", fmt.Errorf("unterminated quote")
+			}
+			i++
+			switch value[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(value[i])
+			}
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return "", fmt.Errorf("unterminated quote")
+}
@@ -0,0 +1,340 @@
+package brsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// BackupGenerationOption tells whether a backup is written in full every
+// time or as generations holding only what changed.
+type BackupGenerationOption struct {
+	Incremental   bool `help:"store only the items changed since the previous backup, with a full snapshot every --full-every generations"`
+	FullEvery     int  `default:"10" help:"number of generations from one full snapshot of an incremental backup to the next"`
+	SkipUnchanged bool `help:"write nothing when no item changed since the previous backup"`
+}
+
+const backupManifestFormat = "brsp-incremental/v1"
+
+// backupManifest is stored at the key of an incremental backup. It lists the
+// generations to replay, from the latest full snapshot on, and the state of
+// every item as of the latest generation. Kind, Source and Names are those
+// of the backup the generations replay into. Each full snapshot starts a new
+// chain of generations, stored under a unique ChainID so that a new chain
+// never overwrites the generations of an earlier one.
+type backupManifest struct {
+	Format        string                     `json:"format"`
+	SchemaVersion int                        `json:"schemaVersion,omitempty"`
+	ChainID       string                     `json:"chainId,omitempty"`
+	Kind          string                     `json:"kind,omitempty"`
+	Source        backupSource               `json:"source"`
+	Generations   []backupGenerationRef      `json:"generations"`
+	Names         []string                   `json:"names"`
+	State         map[string]backupItemState `json:"state"`
+}
+
+type backupGenerationRef struct {
+	Sequence  int       `json:"sequence"`
+	Key       string    `json:"key"`
+	Full      bool      `json:"full"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// backupGeneration holds the items added or changed in a generation, or all
+// items of a full snapshot, and the names deleted since the previous one.
+// Records are backup items of SchemaVersion, or of version 1 if it is unset.
+type backupGeneration struct {
+	SchemaVersion int               `json:"schemaVersion,omitempty"`
+	ChainID       string            `json:"chainId,omitempty"`
+	Sequence      int               `json:"sequence"`
+	Full          bool              `json:"full"`
+	Records       []json.RawMessage `json:"records"`
+	Deleted       []string          `json:"deleted,omitempty"`
+}
+
+// backupItemState is what tells whether an item changed between backups.
+type backupItemState struct {
+	ValueHash string `json:"valueHash"`
+	Version   string `json:"version,omitempty"`
+	Modified  string `json:"modified,omitempty"`
+}
+
+func itemState(item backupDocumentItem) backupItemState {
+	state := backupItemState{ValueHash: valueHash(item.Value)}
+	if item.Version != 0 {
+		state.Version = strconv.FormatInt(item.Version, 10)
+	}
+	modified := item.LastModifiedDate
+	if item.LastChangedDate != nil {
+		modified = item.LastChangedDate
+	}
+	if modified != nil {
+		state.Modified = modified.UTC().Format(time.RFC3339Nano)
+	}
+	return state
+}
+
+func documentStates(doc backupDocument) map[string]backupItemState {
+	states := map[string]backupItemState{}
+	for _, item := range doc.Items {
+		states[item.Name] = itemState(item)
+	}
+	return states
+}
+
+func parseBackupManifest(payload []byte) (backupManifest, bool) {
+	var manifest backupManifest
+	if !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("{")) {
+		return manifest, false
+	}
+	if err := json.Unmarshal(payload, &manifest); err != nil || manifest.Format != backupManifestFormat {
+		return manifest, false
+	}
+	return manifest, true
+}
+
+// reconstructBackup replays the generations of manifest into a full backup.
+func reconstructBackup(ctx context.Context, s3Client S3API, bucket string, dataKey []byte, manifest backupManifest) ([]byte, error) {
+	doc, err := replayGenerations(ctx, s3Client, bucket, dataKey, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func replayGenerations(ctx context.Context, s3Client S3API, bucket string, dataKey []byte, manifest backupManifest) (backupDocument, error) {
+	doc := backupDocument{SchemaVersion: backupSchemaVersion, Kind: manifest.Kind, Source: manifest.Source, Items: []backupDocumentItem{}}
+	if len(manifest.Generations) == 0 || !manifest.Generations[0].Full {
+		return doc, fmt.Errorf("incremental backup does not start with a full snapshot")
+	}
+	items := map[string]backupDocumentItem{}
+	for _, ref := range manifest.Generations {
+		generation, err := readGeneration(ctx, s3Client, bucket, dataKey, manifest.ChainID, ref)
+		if err != nil {
+			return doc, err
+		}
+		if generation.Full {
+			clear(items)
+		}
+		for _, raw := range generation.Records {
+			item, err := decodeBackupItem(raw, generation.SchemaVersion)
+			if err != nil {
+				return doc, fmt.Errorf("invalid backup generation %s, %v", ref.Key, err)
+			}
+			if doc.Kind == "" && generation.SchemaVersion < backupSchemaVersion {
+				doc.Kind = kindOfItem(raw)
+			}
+			items[item.Name] = item
+		}
+		for _, name := range generation.Deleted {
+			delete(items, name)
+		}
+	}
+
+	for _, name := range manifest.Names {
+		item, ok := items[name]
+		if !ok {
+			return doc, fmt.Errorf("incremental backup lost %s while replaying its generations", name)
+		}
+		doc.Items = append(doc.Items, item)
+	}
+	if doc.Source == (backupSource{}) {
+		doc.Source = documentSource(doc.Items)
+	}
+	return doc, nil
+}
+
+// kindOfItem tells the kind of a version 1 item, which manifests of that
+// version do not record.
+func kindOfItem(raw json.RawMessage) string {
+	var record backupItemV1
+	if json.Unmarshal(raw, &record) == nil && record.SecretValue != nil {
+		return "secrets"
+	}
+	return "parameters"
+}
+
+// readGeneration reads the generation ref of the chain chainID, which is
+// empty for manifests written before chains had an ID.
+func readGeneration(ctx context.Context, s3Client S3API, bucket string, dataKey []byte, chainID string, ref backupGenerationRef) (backupGeneration, error) {
+	var generation backupGeneration
+	payload, err := readBackupPayload(ctx, s3Client, bucket, ref.Key, dataKey)
+	if err != nil {
+		return generation, fmt.Errorf("failed to read backup generation %s, %v", ref.Key, err)
+	}
+	if err := json.Unmarshal(payload, &generation); err != nil {
+		return generation, fmt.Errorf("invalid backup generation %s, %v", ref.Key, err)
+	}
+	if generation.ChainID != chainID {
+		return generation, fmt.Errorf("backup generation %s belongs to chain %q, want %q", ref.Key, generation.ChainID, chainID)
+	}
+	if generation.Sequence != ref.Sequence {
+		return generation, fmt.Errorf("backup generation %s has sequence %d, want %d", ref.Key, generation.Sequence, ref.Sequence)
+	}
+	return generation, nil
+}
+
+// backupWrite tells what storeBackup wrote.
+type backupWrite struct {
+	// Skipped is set when nothing was written because nothing changed.
+	Skipped bool
+	// Unchanged are the items left out of an incremental generation.
+	Unchanged map[string]bool
+}
+
+func (w backupWrite) reportItem(name string, key string) ReportItem {
+	if w.Skipped || w.Unchanged[name] {
+		return ReportItem{Source: name, Target: key, Action: ReportActionSkip, Reason: "unchanged since the previous backup"}
+	}
+	return ReportItem{Source: name, Target: key, Action: ReportActionBackup}
+}
+
+// storeBackup writes doc at key in full or as the next generation of an
+// incremental backup, as genOpt tells.
+func storeBackup(ctx context.Context, s3Client S3API, bucket string, key string, dataKey []byte, doc backupDocument, objOpt BackupObjectOption, genOpt BackupGenerationOption) (backupWrite, error) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return backupWrite{}, err
+	}
+	if !genOpt.Incremental && !genOpt.SkipUnchanged {
+		return backupWrite{}, writeBackup(ctx, s3Client, bucket, key, dataKey, body, objOpt)
+	}
+
+	states := documentStates(doc)
+	previous, previousStates, err := readPreviousBackup(ctx, s3Client, bucket, key, dataKey)
+	if err != nil {
+		return backupWrite{}, err
+	}
+	if genOpt.SkipUnchanged && previousStates != nil && maps.Equal(states, previousStates) {
+		slog.Info("skipped the backup as nothing changed", "key", key)
+		return backupWrite{Skipped: true}, nil
+	}
+	if !genOpt.Incremental {
+		return backupWrite{}, writeBackup(ctx, s3Client, bucket, key, dataKey, body, objOpt)
+	}
+
+	// Chains without an ID are not continued, so that all generations
+	// written from now on are under a chain ID.
+	full := previous == nil || previous.ChainID == "" || len(previous.Generations) >= genOpt.FullEvery
+	generation := backupGeneration{SchemaVersion: backupSchemaVersion, Sequence: 1, Full: full}
+	manifest := backupManifest{
+		Format:        backupManifestFormat,
+		SchemaVersion: backupSchemaVersion,
+		Kind:          doc.Kind,
+		Source:        doc.Source,
+		Names:         []string{},
+		State:         states,
+	}
+	if previous != nil {
+		generation.Sequence = previous.Generations[len(previous.Generations)-1].Sequence + 1
+	}
+	if full {
+		if manifest.ChainID, err = newChainID(); err != nil {
+			return backupWrite{}, err
+		}
+	} else {
+		manifest.ChainID = previous.ChainID
+		manifest.Generations = previous.Generations
+	}
+	generation.ChainID = manifest.ChainID
+
+	write := backupWrite{Unchanged: map[string]bool{}}
+	for _, item := range doc.Items {
+		manifest.Names = append(manifest.Names, item.Name)
+		if !full && previousStates[item.Name] == states[item.Name] {
+			write.Unchanged[item.Name] = true
+			continue
+		}
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return backupWrite{}, err
+		}
+		generation.Records = append(generation.Records, raw)
+	}
+	if !full {
+		for _, name := range slices.Sorted(maps.Keys(previousStates)) {
+			if _, ok := states[name]; !ok {
+				generation.Deleted = append(generation.Deleted, name)
+			}
+		}
+	}
+
+	ref := backupGenerationRef{
+		Sequence:  generation.Sequence,
+		Key:       fmt.Sprintf("%s.generations/%s/%08d", key, manifest.ChainID, generation.Sequence),
+		Full:      full,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := writeGeneration(ctx, s3Client, bucket, ref.Key, dataKey, generation, objOpt); err != nil {
+		return backupWrite{}, err
+	}
+	manifest.Generations = append(slices.Clone(manifest.Generations), ref)
+	if err := writeManifest(ctx, s3Client, bucket, key, dataKey, manifest, objOpt); err != nil {
+		return backupWrite{}, err
+	}
+	slog.Info("wrote a backup generation", "key", ref.Key, "full", full, "records", len(generation.Records), "deleted", len(generation.Deleted))
+	return write, nil
+}
+
+// newChainID returns a unique ID for a chain of generations: the time it
+// starts, followed by random bytes in case two chains start at once.
+func newChainID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix), nil
+}
+
+func writeGeneration(ctx context.Context, s3Client S3API, bucket string, key string, dataKey []byte, generation backupGeneration, objOpt BackupObjectOption) error {
+	body, err := json.Marshal(generation)
+	if err != nil {
+		return err
+	}
+	return writeBackup(ctx, s3Client, bucket, key, dataKey, body, objOpt)
+}
+
+func writeManifest(ctx context.Context, s3Client S3API, bucket string, key string, dataKey []byte, manifest backupManifest, objOpt BackupObjectOption) error {
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeBackup(ctx, s3Client, bucket, key, dataKey, body, objOpt)
+}
+
+// readPreviousBackup returns the manifest of the incremental backup at key,
+// if it is one of the current schema version, and the item states of the
+// backup at key, or nil for both if there is no backup yet. A manifest of an
+// older version is ignored so that the next generation is a full snapshot.
+func readPreviousBackup(ctx context.Context, s3Client S3API, bucket string, key string, dataKey []byte) (*backupManifest, map[string]backupItemState, error) {
+	payload, err := readBackupPayload(ctx, s3Client, bucket, key, dataKey)
+	var noSuchKey *s3Types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the previous backup at %s, %v", key, err)
+	}
+	if manifest, ok := parseBackupManifest(payload); ok {
+		if manifest.SchemaVersion != backupSchemaVersion {
+			return nil, nil, nil
+		}
+		return &manifest, manifest.State, nil
+	}
+	doc, err := decodeBackup(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the previous backup at %s, %v", key, err)
+	}
+	return nil, documentStates(doc), nil
+}
@@ -0,0 +1,258 @@
+package brsp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// K8sManifestOption tells how download-backup renders a backup as Kubernetes
+// resources with --format k8s-secret or external-secret.
+type K8sManifestOption struct {
+	K8sName           string `help:"name of the Secret or ExternalSecret (default: derived from --key)"`
+	K8sNamespace      string `help:"namespace of the Secret or ExternalSecret"`
+	SealedSecretsCert string `type:"path" help:"seal the k8s-secret with this Sealed Secrets public key or certificate (PEM) into a SealedSecret"`
+	SecretStore       string `help:"name of the SecretStore the ExternalSecret reads from"`
+	SecretStoreKind   string `default:"ClusterSecretStore" enum:"SecretStore,ClusterSecretStore" help:"kind of --secret-store"`
+	RefreshInterval   string `default:"1h" help:"refresh interval of the ExternalSecret"`
+}
+
+type k8sMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace,omitempty"`
+}
+
+type k8sSecret struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	Data       map[string]string `yaml:"data"`
+}
+
+type sealedSecret struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   k8sMetadata `yaml:"metadata"`
+	Spec       struct {
+		EncryptedData map[string]string `yaml:"encryptedData"`
+		Template      struct {
+			Metadata k8sMetadata `yaml:"metadata"`
+			Type     string      `yaml:"type"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+type externalSecret struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   k8sMetadata `yaml:"metadata"`
+	Spec       struct {
+		RefreshInterval string `yaml:"refreshInterval"`
+		SecretStoreRef  struct {
+			Name string `yaml:"name"`
+			Kind string `yaml:"kind"`
+		} `yaml:"secretStoreRef"`
+		Target struct {
+			Name           string `yaml:"name"`
+			CreationPolicy string `yaml:"creationPolicy"`
+		} `yaml:"target"`
+		Data []externalSecretData `yaml:"data"`
+	} `yaml:"spec"`
+}
+
+type externalSecretData struct {
+	SecretKey string `yaml:"secretKey"`
+	RemoteRef struct {
+		Key string `yaml:"key"`
+	} `yaml:"remoteRef"`
+}
+
+// writeK8sManifest renders the items of doc as a Secret (or a SealedSecret
+// with --sealed-secrets-cert), or as an ExternalSecret reading each item from
+// SSM or Secrets Manager by its original name.
+func writeK8sManifest(w io.Writer, format string, doc backupDocument, key string, opt K8sManifestOption) error {
+	name := opt.K8sName
+	if name == "" {
+		name = k8sResourceName(path.Base(key))
+	}
+	if name == "" {
+		return fmt.Errorf("cannot derive a resource name from %s, specify --k8s-name", key)
+	}
+	if format != "k8s-secret" && opt.SealedSecretsCert != "" {
+		return fmt.Errorf("--sealed-secrets-cert requires --format k8s-secret")
+	}
+
+	keys := map[string]string{}
+	data := map[string]string{}
+	for _, item := range doc.Items {
+		registerSecret(item.Value)
+		k := k8sKey(item.Name)
+		if other, ok := keys[k]; ok {
+			return fmt.Errorf("%s and %s map to the same key %s", other, item.Name, k)
+		}
+		keys[k] = item.Name
+		data[k] = item.Value
+	}
+	metadata := k8sMetadata{Name: name, Namespace: opt.K8sNamespace}
+
+	var resource any
+	switch {
+	case format == "external-secret":
+		if doc.Kind != "parameters" && doc.Kind != "secrets" {
+			return fmt.Errorf("external-secret supports parameters and secrets backups, not %q", doc.Kind)
+		}
+		if opt.SecretStore == "" {
+			return fmt.Errorf("external-secret requires --secret-store")
+		}
+		es := externalSecret{APIVersion: "external-secrets.io/v1beta1", Kind: "ExternalSecret", Metadata: metadata}
+		es.Spec.RefreshInterval = opt.RefreshInterval
+		es.Spec.SecretStoreRef.Name = opt.SecretStore
+		es.Spec.SecretStoreRef.Kind = opt.SecretStoreKind
+		es.Spec.Target.Name = name
+		es.Spec.Target.CreationPolicy = "Owner"
+		es.Spec.Data = []externalSecretData{}
+		for _, item := range doc.Items {
+			ref := externalSecretData{SecretKey: k8sKey(item.Name)}
+			ref.RemoteRef.Key = item.Name
+			es.Spec.Data = append(es.Spec.Data, ref)
+		}
+		resource = es
+	case opt.SealedSecretsCert != "":
+		publicKey, err := readSealedSecretsCert(opt.SealedSecretsCert)
+		if err != nil {
+			return err
+		}
+		if metadata.Namespace == "" {
+			metadata.Namespace = "default"
+		}
+		sealed := sealedSecret{APIVersion: "bitnami.com/v1alpha1", Kind: "SealedSecret", Metadata: metadata}
+		sealed.Spec.Template.Metadata = metadata
+		sealed.Spec.Template.Type = "Opaque"
+		sealed.Spec.EncryptedData = map[string]string{}
+		// Sealed with the default strict scope, so the SealedSecret can only
+		// be unsealed under this name and namespace.
+		label := []byte(metadata.Namespace + "/" + metadata.Name)
+		for k, value := range data {
+			ciphertext, err := sealValue(publicKey, []byte(value), label)
+			if err != nil {
+				return fmt.Errorf("failed to seal %s, %v", keys[k], err)
+			}
+			sealed.Spec.EncryptedData[k] = base64.StdEncoding.EncodeToString(ciphertext)
+		}
+		resource = sealed
+	default:
+		secret := k8sSecret{APIVersion: "v1", Kind: "Secret", Metadata: metadata, Type: "Opaque", Data: map[string]string{}}
+		for k, value := range data {
+			secret.Data[k] = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+		resource = secret
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(resource); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+var (
+	k8sKeyInvalidChars  = regexp.MustCompile(`[^-._a-zA-Z0-9]+`)
+	k8sNameInvalidChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+)
+
+// k8sKey turns a parameter or secret name such as /dev/db/password into a
+// valid key of a Secret such as dev_db_password.
+func k8sKey(name string) string {
+	key := k8sKeyInvalidChars.ReplaceAllString(strings.Trim(name, "/"), "_")
+	if key == "" || key == "." || key == ".." {
+		key = "_" + key
+	}
+	if len(key) > 253 {
+		key = key[len(key)-253:]
+	}
+	return key
+}
+
+// k8sResourceName turns s into a DNS subdomain name, as resource names must
+// be, or "" if nothing is left.
+func k8sResourceName(s string) string {
+	name := k8sNameInvalidChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return strings.Trim(name, "-.")
+}
+
+// readSealedSecretsCert reads the RSA public key of the Sealed Secrets
+// controller, as printed by kubeseal --fetch-cert.
+func readSealedSecretsCert(file string) (*rsa.PublicKey, error) {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", file)
+	}
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s, %v", file, err)
+		}
+		key = cert.PublicKey
+	case "PUBLIC KEY":
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid public key in %s, %v", file, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s holds a %s, not a certificate or public key", file, block.Type)
+	}
+	publicKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA key", file)
+	}
+	return publicKey, nil
+}
+
+// sealValue encrypts plaintext the way kubeseal does: a random AES-256-GCM
+// session key encrypted with RSA-OAEP under label, prefixed with its length,
+// followed by the plaintext sealed with the session key and a zero nonce.
+func sealValue(publicKey *rsa.PublicKey, plaintext []byte, label []byte) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := binary.BigEndian.AppendUint16(nil, uint16(len(encryptedKey)))
+	ciphertext = append(ciphertext, encryptedKey...)
+	return aead.Seal(ciphertext, make([]byte, aead.NonceSize()), plaintext, nil), nil
+}
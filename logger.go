@@ -0,0 +1,227 @@
+package brsp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go/middleware"
+)
+
+const redactedValue = "[REDACTED]"
+
+// minSecretLength is the shortest secret that is also scrubbed from inside
+// longer strings. Shorter ones are only redacted when they are a whole value,
+// otherwise any log line containing e.g. "a" would be mangled.
+const minSecretLength = 4
+
+// sensitiveKeys are attribute keys whose values are always redacted,
+// compared case-insensitively and ignoring "-" and "_".
+var sensitiveKeys = map[string]bool{
+	"value":        true,
+	"secretvalue":  true,
+	"secretstring": true,
+	"secretbinary": true,
+	"plaintext":    true,
+	"datakey":      true,
+	"password":     true,
+	"token":        true,
+}
+
+// secrets holds every decrypted value brsp has seen so that the log handler
+// can scrub them wherever they appear.
+var secrets = &secretRegistry{values: map[string]bool{}}
+
+type secretRegistry struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+// registerSecret marks value as a secret that must never be logged. Values
+// that are JSON objects also register their string fields, so that a field
+// of a secret cannot be logged on its own either.
+func registerSecret(value string) {
+	if value == "" || value == placeholderValue {
+		return
+	}
+	secrets.add(value)
+
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(value), &fields); err == nil {
+		for _, field := range fields {
+			if s, ok := field.(string); ok && s != "" && s != placeholderValue {
+				secrets.add(s)
+			}
+		}
+	}
+}
+
+// registerSecretBytes registers binary secrets such as data keys, in their
+// raw and base64 forms.
+func registerSecretBytes(value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	secrets.add(string(value))
+	secrets.add(base64.StdEncoding.EncodeToString(value))
+}
+
+func (r *secretRegistry) add(value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values[value] {
+		return
+	}
+	r.values[value] = true
+	r.replacer = nil
+}
+
+func (r *secretRegistry) isSecret(value string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.values[value]
+}
+
+// scrub replaces every registered secret in s, longest first.
+func (r *secretRegistry) scrub(s string) string {
+	if r.isSecret(s) {
+		return redactedValue
+	}
+
+	r.mu.Lock()
+	if r.replacer == nil {
+		values := make([]string, 0, len(r.values))
+		for value := range r.values {
+			if len(value) >= minSecretLength {
+				values = append(values, value)
+			}
+		}
+		sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+		pairs := make([]string, 0, len(values)*2)
+		for _, value := range values {
+			pairs = append(pairs, value, redactedValue)
+		}
+		r.replacer = strings.NewReplacer(pairs...)
+	}
+	replacer := r.replacer
+	r.mu.Unlock()
+	return replacer.Replace(s)
+}
+
+// newLogger returns a logger writing to w whose output is always redacted.
+func newLogger(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %s, %v", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+	return slog.New(&redactHandler{next: handler, secrets: secrets}), nil
+}
+
+// redactHandler removes secrets from the message and the attributes of every
+// record before passing it on.
+type redactHandler struct {
+	next    slog.Handler
+	secrets *secretRegistry
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.secrets.scrub(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, h.redactAttr(attr))
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted), secrets: h.secrets}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name), secrets: h.secrets}
+}
+
+func (h *redactHandler) redactAttr(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	if sensitiveKeys[strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(attr.Key))] {
+		return slog.String(attr.Key, redactedValue)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, h.secrets.scrub(attr.Value.String()))
+	case slog.KindGroup:
+		group := attr.Value.Group()
+		redacted := make([]any, 0, len(group))
+		for _, member := range group {
+			redacted = append(redacted, h.redactAttr(member))
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindAny:
+		// Arbitrary values are flattened to a string so that secrets inside
+		// structs, slices and errors can be scrubbed.
+		value := attr.Value.Any()
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		return slog.String(attr.Key, h.secrets.scrub(fmt.Sprintf("%+v", value)))
+	default:
+		return attr
+	}
+}
+
+// addRequestLogging logs every AWS API call with its request ID at debug level.
+func addRequestLogging(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("brspRequestLogging", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+
+		requestID, _ := awsmiddleware.GetRequestIDMetadata(metadata)
+		var responseErr *awshttp.ResponseError
+		if requestID == "" && errors.As(err, &responseErr) {
+			requestID = responseErr.ServiceRequestID()
+		}
+		attrs := []any{
+			"service", awsmiddleware.GetServiceID(ctx),
+			"operation", awsmiddleware.GetOperationName(ctx),
+			"requestId", requestID,
+			"duration", time.Since(start),
+		}
+		if err != nil {
+			slog.DebugContext(ctx, "aws request failed", append(attrs, "error", err)...)
+		} else {
+			slog.DebugContext(ctx, "aws request", attrs...)
+		}
+		return out, metadata, err
+	}), middleware.Before)
+}
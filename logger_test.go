@@ -0,0 +1,98 @@
+package brsp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func newTestLogger(t *testing.T, format string) (*slog.Logger, *bytes.Buffer) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	logger, err := newLogger(buf, format, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger, buf
+}
+
+func TestLoggerRedactsRegisteredSecrets(t *testing.T) {
+	parameterValue := "parameter-value-0123"
+	secretString := `{"username":"admin-user","password":"hunter2-hunter2"}`
+	dataKey := []byte("0123456789abcdef0123456789abcdef")
+	registerSecret(parameterValue)
+	registerSecret(secretString)
+	registerSecretBytes(dataKey)
+
+	type record struct {
+		Name  string
+		Value string
+	}
+	leaks := []string{parameterValue, secretString, "admin-user", "hunter2-hunter2", string(dataKey), "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}
+
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			logger, buf := newTestLogger(t, format)
+			logger.Info("restoring " + parameterValue)
+			logger.Info("attr", "current", parameterValue)
+			logger.Info("embedded", "message", "value is "+parameterValue+"!")
+			logger.Info("secret field", "username", "admin-user")
+			logger.Info("group", slog.Group("target", "previous", secretString))
+			logger.Info("struct", "record", record{Name: "/app/db", Value: parameterValue})
+			logger.Info("pointer", "record", &record{Name: "/app/db", Value: parameterValue})
+			logger.Info("bytes", "key", dataKey)
+			logger.Info("base64", "key", "key is MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+			logger.Info("error", "error", fmt.Errorf("failed to put %s", parameterValue))
+			logger.Info("wrapped", "error", fmt.Errorf("wrapped, %w", errors.New(secretString)))
+			logger.With("previous", parameterValue).Info("with attrs")
+			logger.WithGroup("g").Info("with group", "current", parameterValue)
+
+			output := buf.String()
+			for _, leak := range leaks {
+				if strings.Contains(output, leak) {
+					t.Errorf("log output contains the secret %q:\n%s", leak, output)
+				}
+			}
+			if !strings.Contains(output, redactedValue) {
+				t.Errorf("log output does not contain %s:\n%s", redactedValue, output)
+			}
+		})
+	}
+}
+
+func TestLoggerRedactsSensitiveKeys(t *testing.T) {
+	logger, buf := newTestLogger(t, "json")
+	unregistered := "never-registered-value"
+	for _, key := range []string{"value", "Value", "secretValue", "SecretString", "secret_binary", "plaintext", "dataKey", "data-key", "password", "token"} {
+		logger.Info("sensitive key", key, unregistered)
+	}
+	if strings.Contains(buf.String(), unregistered) {
+		t.Errorf("log output contains a value logged under a sensitive key:\n%s", buf.String())
+	}
+}
+
+func TestLoggerKeepsNonSecrets(t *testing.T) {
+	registerSecret("abc")
+	registerSecret(placeholderValue)
+	logger, buf := newTestLogger(t, "text")
+	logger.Info("restoring", "name", "/app/abcdef", "status", placeholderValue, "count", 3)
+
+	output := buf.String()
+	for _, want := range []string{"name=/app/abcdef", "status=" + placeholderValue, "count=3"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("log output does not contain %q:\n%s", want, output)
+		}
+	}
+}
+
+func TestLoggerRedactsShortSecretsAsWholeValues(t *testing.T) {
+	registerSecret("xyz")
+	logger, buf := newTestLogger(t, "text")
+	logger.Info("short", "current", "xyz")
+	if strings.Contains(buf.String(), "current=xyz") {
+		t.Errorf("log output contains a short secret:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,171 @@
+package brsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+type MigrateBackupCommand struct {
+	s3Client  S3API
+	kmsClient KMSAPI
+	opt       *MigrateBackupCommandOption
+}
+
+type MigrateBackupCommandOption struct {
+	commandOption
+	BucketName        string `help:"S3 bucket name"`
+	Key               string `help:"S3 object key of the backup or the manifest of an incremental backup"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	BackupObjectOption
+}
+
+// NewMigrateBackupCommandOption returns options set to the CLI defaults.
+func NewMigrateBackupCommandOption() *MigrateBackupCommandOption {
+	return withDefaults(&MigrateBackupCommandOption{})
+}
+
+func NewMigrateBackupCommand(ctx context.Context, opt *MigrateBackupCommandOption) (*MigrateBackupCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aws config, %v", err)
+	}
+	return NewClient(awsConfig, awsConfig).migrateBackupCommand(opt), nil
+}
+
+func (c *Client) migrateBackupCommand(opt *MigrateBackupCommandOption) *MigrateBackupCommand {
+	return &MigrateBackupCommand{
+		s3Client:  c.S3,
+		kmsClient: c.KMS,
+		opt:       opt,
+	}
+}
+
+// Run rewrites the backup at --key, and every generation of an incremental
+// backup, in the current schema version and envelope format. Objects already
+// up to date are left alone.
+func (c *MigrateBackupCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("migrate-backup")
+	if err := c.opt.BackupObjectOption.preflight(ctx, c.s3Client, c.opt.BucketName); err != nil {
+		return report, err
+	}
+	dataKey, err := loadDataKey(ctx, c.s3Client, c.kmsClient, backupLocation{
+		BucketName:        c.opt.BucketName,
+		Key:               c.opt.Key,
+		DataKeyBucketName: c.opt.DataKeyBucketName,
+		DataKeyKey:        c.opt.DataKeyKey,
+	})
+	if err != nil {
+		return report, err
+	}
+
+	legacy, payload, err := c.read(ctx, c.opt.Key, dataKey)
+	if err != nil {
+		return report, err
+	}
+	manifest, ok := parseBackupManifest(payload)
+	if !ok {
+		return report, c.migrateBackup(ctx, report, dataKey, legacy, payload)
+	}
+	return report, c.migrateIncremental(ctx, report, dataKey, legacy, manifest)
+}
+
+// read returns the decrypted object at key and whether it is in the older
+// format with a separate nonce.
+func (c *MigrateBackupCommand) read(ctx context.Context, key string, dataKey []byte) (bool, []byte, error) {
+	data, err := getObject(ctx, c.s3Client, c.opt.BucketName, key)
+	if err != nil {
+		return false, nil, err
+	}
+	payload, err := readBackupPayload(ctx, c.s3Client, c.opt.BucketName, key, dataKey)
+	if err != nil {
+		return false, nil, err
+	}
+	return !isEnvelope(data), payload, nil
+}
+
+func (c *MigrateBackupCommand) migrateBackup(ctx context.Context, report *Report, dataKey []byte, legacy bool, payload []byte) error {
+	doc, err := decodeBackup(payload)
+	if err != nil {
+		return err
+	}
+	if !legacy && !bytes.HasPrefix(bytes.TrimSpace(payload), []byte("[")) {
+		report.add(c.upToDate(c.opt.Key))
+		return nil
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := writeBackup(ctx, c.s3Client, c.opt.BucketName, c.opt.Key, dataKey, body, c.opt.BackupObjectOption); err != nil {
+		return err
+	}
+	report.add(ReportItem{Source: c.opt.Key, Target: c.opt.Key, Action: ReportActionMigrate})
+	return nil
+}
+
+// migrateIncremental rewrites the generations from the latest full snapshot
+// on, then the manifest with the states recomputed from them. Generations
+// before the snapshot are no longer read and are left as they are.
+func (c *MigrateBackupCommand) migrateIncremental(ctx context.Context, report *Report, dataKey []byte, legacy bool, manifest backupManifest) error {
+	// Replay the generations as they are, as only version 1 records tell the
+	// kind a version 1 manifest does not record.
+	doc, err := replayGenerations(ctx, c.s3Client, c.opt.BucketName, dataKey, manifest)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range manifest.Generations {
+		generation, err := readGeneration(ctx, c.s3Client, c.opt.BucketName, dataKey, manifest.ChainID, ref)
+		if err != nil {
+			return err
+		}
+		data, err := getObject(ctx, c.s3Client, c.opt.BucketName, ref.Key)
+		if err != nil {
+			return err
+		}
+		if generation.SchemaVersion == backupSchemaVersion && isEnvelope(data) {
+			report.add(c.upToDate(ref.Key))
+			continue
+		}
+
+		records := make([]json.RawMessage, 0, len(generation.Records))
+		for _, raw := range generation.Records {
+			item, err := decodeBackupItem(raw, generation.SchemaVersion)
+			if err != nil {
+				return fmt.Errorf("invalid backup generation %s, %v", ref.Key, err)
+			}
+			record, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		generation.SchemaVersion = backupSchemaVersion
+		generation.Records = records
+		if err := writeGeneration(ctx, c.s3Client, c.opt.BucketName, ref.Key, dataKey, generation, c.opt.BackupObjectOption); err != nil {
+			return err
+		}
+		report.add(ReportItem{Source: ref.Key, Target: ref.Key, Action: ReportActionMigrate})
+	}
+
+	if manifest.SchemaVersion == backupSchemaVersion && !legacy {
+		report.add(c.upToDate(c.opt.Key))
+		return nil
+	}
+	manifest.SchemaVersion = backupSchemaVersion
+	manifest.Kind = doc.Kind
+	manifest.Source = doc.Source
+	manifest.State = documentStates(doc)
+	if err := writeManifest(ctx, c.s3Client, c.opt.BucketName, c.opt.Key, dataKey, manifest, c.opt.BackupObjectOption); err != nil {
+		return err
+	}
+	report.add(ReportItem{Source: c.opt.Key, Target: c.opt.Key, Action: ReportActionMigrate})
+	return nil
+}
+
+func (c *MigrateBackupCommand) upToDate(key string) ReportItem {
+	return ReportItem{Source: key, Target: key, Action: ReportActionSkip, Reason: fmt.Sprintf("already at schema version %d", backupSchemaVersion)}
+}
@@ -0,0 +1,109 @@
+package brsp
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandOption is embedded in every command option struct. The Client
+// methods only accept options made by their New...CommandOption constructor,
+// so that library callers get the same defaults as the CLI, such as dry runs
+// and rollback on failure, instead of zero values.
+type commandOption struct {
+	defaulted bool
+}
+
+func (o *commandOption) markDefaulted()    { o.defaulted = true }
+func (o *commandOption) hasDefaults() bool { return o.defaulted }
+
+type defaultedOption interface {
+	markDefaulted()
+	hasDefaults() bool
+}
+
+// withDefaults sets every field of opt, including those of embedded structs,
+// to the value of its default tag, as kong does for the CLI.
+func withDefaults[T any](opt *T) *T {
+	if err := setDefaults(reflect.ValueOf(opt).Elem()); err != nil {
+		// The tags are constant, so this is caught by the tests.
+		panic(fmt.Sprintf("invalid default of %T, %v", opt, err))
+	}
+	if o, ok := any(opt).(defaultedOption); ok {
+		o.markDefaulted()
+	}
+	return opt
+}
+
+func setDefaults(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := setDefaults(v.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := field.Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+		if err := setDefault(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s, %v", field.Name, err)
+		}
+	}
+	return nil
+}
+
+func setDefault(v reflect.Value, value string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.CanInt():
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.CanFloat():
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		v.Set(reflect.ValueOf(strings.Split(value, ",")))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// checkCommandOption returns an error unless opt was made by its constructor.
+func checkCommandOption(opt defaultedOption) error {
+	if reflect.ValueOf(opt).IsNil() {
+		return fmt.Errorf("no command option given")
+	}
+	if !opt.hasDefaults() {
+		name := strings.TrimPrefix(fmt.Sprintf("%T", opt), "*brsp.")
+		return fmt.Errorf("%s must be made with New%s, which sets the defaults of the CLI", name, name)
+	}
+	return nil
+}
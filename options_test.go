@@ -0,0 +1,81 @@
+package brsp
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kong"
+)
+
+func TestCommandOptionDefaultsMatchCLI(t *testing.T) {
+	constructors := map[string]defaultedOption{
+		"generate-data-key":  NewGenerateDataKeyCommandOption(),
+		"backup-parameters":  NewBackupParametersCommandOption(),
+		"backup-secrets":     NewBackupSecretsCommandOption(),
+		"backup-appconfig":   NewBackupAppConfigCommandOption(),
+		"backup-lambda":      NewBackupLambdaCommandOption(),
+		"backup-vault":       NewBackupVaultCommandOption(),
+		"backup-all":         NewBackupAllCommandOption(),
+		"backup":             NewBackupCommandOption(),
+		"download-backup":    NewDownloadBackupCommandOption(),
+		"diff-backup":        NewDiffBackupCommandOption(),
+		"migrate-backup":     NewMigrateBackupCommandOption(),
+		"export-terraform":   NewExportTerraformCommandOption(),
+		"import":             NewImportCommandOption(),
+		"restore-secrets":    NewRestoreSecretsCommandOption(),
+		"restore-parameters": NewRestoreParametersCommandOption(),
+		"restore plan":       NewRestorePlanCommandOption(),
+		"restore apply":      NewRestoreApplyCommandOption(),
+		"restore snapshot":   NewRestoreSnapshotCommandOption(),
+		"rollback":           NewRollbackCommandOption(),
+	}
+
+	var cli CLI
+	parser, err := kong.New(&cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range parser.Model.Leaves(false) {
+		command := node.Path()
+		if command == "version" {
+			continue
+		}
+		t.Run(command, func(t *testing.T) {
+			opt, ok := constructors[command]
+			if !ok {
+				t.Fatalf("no constructor for %s", command)
+			}
+			if !opt.hasDefaults() {
+				t.Errorf("options of %s are not marked as made by their constructor", command)
+			}
+			kctx, err := kong.Trace(parser, strings.Fields(command))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := kctx.Reset(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The CLI options are not made by the constructor, so mark them
+			// before comparing.
+			got := node.Target.Addr().Interface().(defaultedOption)
+			got.markDefaulted()
+			if !reflect.DeepEqual(got, opt) {
+				t.Errorf("CLI defaults of %s are\n%+v\nwant\n%+v", command, got, opt)
+			}
+		})
+	}
+}
+
+func TestClientRequiresOptionConstructors(t *testing.T) {
+	client := newFakeAWS().client()
+	_, err := client.RestoreParameters(context.Background(), &RestoreParametersCommandOption{BucketName: testBucket, Key: "parameters"})
+	if err == nil || !strings.Contains(err.Error(), "NewRestoreParametersCommandOption") {
+		t.Errorf("restore-parameters with a zero-value option returned %v, want an error naming the constructor", err)
+	}
+	if _, err := client.RestoreParameters(context.Background(), nil); err == nil {
+		t.Error("restore-parameters with no option succeeded")
+	}
+}
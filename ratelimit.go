@@ -0,0 +1,134 @@
+package brsp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+const (
+	backoffMaxAttempts = 8
+	backoffBaseDelay   = 200 * time.Millisecond
+	backoffMaxDelay    = 20 * time.Second
+)
+
+// rateLimiter is a token bucket limiting calls to a single AWS API. Its rate is
+// halved whenever the API throttles us and recovers gradually on success.
+// A nil rateLimiter does not limit anything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	maxRate float64
+	minRate float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+}
+
+func newRateLimiter(tps float64) *rateLimiter {
+	if tps <= 0 {
+		return nil
+	}
+	burst := max(tps, 1)
+	return &rateLimiter{
+		rate:    tps,
+		maxRate: tps,
+		minRate: tps / 16,
+		burst:   burst,
+		tokens:  burst,
+		last:    time.Now(),
+	}
+}
+
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *rateLimiter) throttled() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = max(l.rate/2, l.minRate)
+}
+
+func (l *rateLimiter) succeeded() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = min(l.rate+l.maxRate/20, l.maxRate)
+}
+
+// withBackoff calls fn under limiter, retrying with exponential backoff and
+// jitter while AWS reports throttling.
+func withBackoff(ctx context.Context, limiter *rateLimiter, fn func() error) error {
+	delay := backoffBaseDelay
+	for attempt := 1; ; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		err := fn()
+		if !isThrottlingError(err) {
+			if err == nil {
+				limiter.succeeded()
+			}
+			return err
+		}
+		limiter.throttled()
+		if attempt >= backoffMaxAttempts {
+			return fmt.Errorf("still throttled after %d attempts, %w", attempt, err)
+		}
+
+		timer := time.NewTimer(delay/2 + rand.N(delay/2+1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay = min(delay*2, backoffMaxDelay)
+	}
+}
+
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ThrottlingException", "Throttling", "TooManyRequestsException", "RequestLimitExceeded":
+		return true
+	}
+	return false
+}
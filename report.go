@@ -0,0 +1,212 @@
+package brsp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	ReportActionBackup       = "backup"
+	ReportActionRestore      = "restore"
+	ReportActionWouldRestore = "would-restore"
+	ReportActionRollback     = "rollback"
+	ReportActionSkip         = "skip"
+	ReportActionDownload     = "download"
+	ReportActionGenerate     = "generate"
+	ReportActionAdded        = "added"
+	ReportActionRemoved      = "removed"
+	ReportActionChanged      = "changed"
+	ReportActionMigrate      = "migrate"
+	ReportActionCreate       = "create"
+	ReportActionImport       = "import"
+)
+
+// Report is the outcome of a command, one item per parameter, secret or
+// backup it handled.
+type Report struct {
+	Command   string        `json:"command"`
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"-"`
+	Items     []ReportItem  `json:"items"`
+
+	mu sync.Mutex
+}
+
+type ReportItem struct {
+	Source   string        `json:"source,omitempty"`
+	Target   string        `json:"target,omitempty"`
+	Action   string        `json:"action"`
+	Reason   string        `json:"reason,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+}
+
+func newReport(command string) *Report {
+	return &Report{Command: command, StartedAt: time.Now().UTC(), Items: []ReportItem{}}
+}
+
+func (r *Report) add(item ReportItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Items = append(r.Items, item)
+}
+
+func (r *Report) finish() {
+	r.Duration = time.Since(r.StartedAt)
+}
+
+// Failed returns the number of items that ended with an error.
+func (r *Report) Failed() int {
+	failed := 0
+	for _, item := range r.Items {
+		if item.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+func (r *Report) MarshalJSON() ([]byte, error) {
+	type reportJSON struct {
+		Command         string       `json:"command"`
+		StartedAt       time.Time    `json:"startedAt"`
+		DurationSeconds float64      `json:"durationSeconds"`
+		Failed          int          `json:"failed"`
+		Items           []ReportItem `json:"items"`
+	}
+	return json.Marshal(reportJSON{
+		Command:         r.Command,
+		StartedAt:       r.StartedAt,
+		DurationSeconds: r.Duration.Seconds(),
+		Failed:          r.Failed(),
+		Items:           r.Items,
+	})
+}
+
+func (i ReportItem) MarshalJSON() ([]byte, error) {
+	type item ReportItem
+	return json.Marshal(struct {
+		item
+		DurationSeconds float64 `json:"durationSeconds"`
+	}{item(i), i.Duration.Seconds()})
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// writeReport renders report in format to path, or to stderr when path is
+// empty so that it never mixes with the output of a command.
+func writeReport(report *Report, format string, path string) error {
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "table":
+		return writeReportTable(w, report)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "junit":
+		return writeReportJUnit(w, report)
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+func writeReportTable(w io.Writer, report *Report) error {
+	if len(report.Items) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tTARGET\tACTION\tREASON\tERROR\tDURATION")
+	for _, item := range report.Items {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", item.Source, item.Target, item.Action, item.Reason, item.Error, item.Duration.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func writeReportJUnit(w io.Writer, report *Report) error {
+	suite := junitTestSuite{
+		Name:      report.Command,
+		Tests:     len(report.Items),
+		Time:      fmt.Sprintf("%.3f", report.Duration.Seconds()),
+		Timestamp: report.StartedAt.Format(time.RFC3339),
+		Cases:     []junitTestCase{},
+	}
+	for _, item := range report.Items {
+		name := item.Source
+		if item.Target != "" && item.Target != item.Source {
+			name = fmt.Sprintf("%s -> %s", item.Source, item.Target)
+		}
+		testCase := junitTestCase{
+			ClassName: fmt.Sprintf("%s.%s", report.Command, item.Action),
+			Name:      name,
+			Time:      fmt.Sprintf("%.3f", item.Duration.Seconds()),
+		}
+		switch {
+		case item.Error != "":
+			testCase.Failure = &junitMessage{Message: item.Error}
+			suite.Failures++
+		case item.Action == ReportActionSkip:
+			testCase.Skipped = &junitMessage{Message: item.Reason}
+			suite.Skipped++
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
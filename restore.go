@@ -0,0 +1,544 @@
+package brsp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfig"
+	appconfigTypes "github.com/aws/aws-sdk-go-v2/service/appconfig/types"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdaTypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	secretsmanagerTypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// placeholderValue is the value of targets that are waiting to be restored.
+// Only targets holding it are overwritten.
+const placeholderValue = "DUMMY"
+
+const (
+	restoreActionRestore = "restore"
+	restoreActionSkip    = "skip"
+)
+
+// restoreTarget is a parameter, secret, hosted configuration, environment
+// variable or Vault secret a backup item is restored to.
+type restoreTarget struct {
+	Name string
+	ID   string
+}
+
+// targetState is the value of a restore target and the version holding it.
+type targetState struct {
+	Value   string
+	Version string
+}
+
+// restoreTargets finds, reads and writes the restore targets of one kind.
+type restoreTargets interface {
+	// noun is the singular name of the kind used in messages.
+	noun() string
+	resolve(ctx context.Context, name string) ([]restoreTarget, error)
+	currentValue(ctx context.Context, target restoreTarget) (targetState, error)
+	putValue(ctx context.Context, target restoreTarget, value string) error
+}
+
+// placeholderTargets is implemented by restore targets whose placeholders
+// are not the placeholder value itself.
+type placeholderTargets interface {
+	isPlaceholder(value string) bool
+}
+
+func isPlaceholder(targets restoreTargets, value string) bool {
+	if t, ok := targets.(placeholderTargets); ok {
+		return t.isPlaceholder(value)
+	}
+	return value == placeholderValue
+}
+
+func newRestoreTargets(kind string, client *Client) (restoreTargets, error) {
+	switch kind {
+	case "parameters":
+		return &parameterTargets{ssmClient: client.SSM}, nil
+	case "secrets":
+		return &secretTargets{secretsmanagerClient: client.SecretsManager}, nil
+	case "appconfig":
+		return &hostedConfigurationTargets{appconfigClient: client.AppConfig}, nil
+	case "lambda":
+		return &environmentVariableTargets{lambdaClient: client.Lambda}, nil
+	case "vault":
+		if client.Vault == nil {
+			return nil, fmt.Errorf("no Vault to restore to, specify --vault-addr")
+		}
+		return &vaultTargets{vaultClient: client.Vault}, nil
+	default:
+		return nil, fmt.Errorf("unknown kind: %s", kind)
+	}
+}
+
+// parameterTargets restores a parameter to the parameter of the same name.
+type parameterTargets struct {
+	ssmClient SSMAPI
+}
+
+func (t *parameterTargets) noun() string { return "parameter" }
+
+func (t *parameterTargets) resolve(ctx context.Context, name string) ([]restoreTarget, error) {
+	getParametersOutput, err := t.ssmClient.GetParameters(ctx, &ssm.GetParametersInput{
+		Names: []string{name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	targets := []restoreTarget{}
+	for _, p := range getParametersOutput.Parameters {
+		targets = append(targets, restoreTarget{Name: *p.Name, ID: *p.Name})
+	}
+	return targets, nil
+}
+
+func (t *parameterTargets) currentValue(ctx context.Context, target restoreTarget) (targetState, error) {
+	getParameterOutput, err := t.ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(target.ID),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return targetState{}, err
+	}
+	registerSecret(aws.ToString(getParameterOutput.Parameter.Value))
+	return targetState{
+		Value:   aws.ToString(getParameterOutput.Parameter.Value),
+		Version: strconv.FormatInt(getParameterOutput.Parameter.Version, 10),
+	}, nil
+}
+
+func (t *parameterTargets) putValue(ctx context.Context, target restoreTarget, value string) error {
+	return retry(ctx, 3, 2*time.Second, func() error {
+		_, err := t.ssmClient.PutParameter(ctx, &ssm.PutParameterInput{
+			Name:      aws.String(target.ID),
+			Value:     aws.String(value),
+			Overwrite: aws.Bool(true),
+		})
+		return err
+	})
+}
+
+// secretTargets restores a secret to the secrets whose names start with its name followed by "_".
+type secretTargets struct {
+	secretsmanagerClient SecretsManagerAPI
+}
+
+func (t *secretTargets) noun() string { return "secret" }
+
+func (t *secretTargets) resolve(ctx context.Context, name string) ([]restoreTarget, error) {
+	listSecretsOutput, err := t.secretsmanagerClient.ListSecrets(ctx, &secretsmanager.ListSecretsInput{
+		Filters: []secretsmanagerTypes.Filter{
+			{
+				Key:    secretsmanagerTypes.FilterNameStringTypeName,
+				Values: []string{name + "_"},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	targets := []restoreTarget{}
+	for _, s := range listSecretsOutput.SecretList {
+		targets = append(targets, restoreTarget{Name: *s.Name, ID: *s.ARN})
+	}
+	return targets, nil
+}
+
+func (t *secretTargets) currentValue(ctx context.Context, target restoreTarget) (targetState, error) {
+	getSecretValueOutput, err := t.secretsmanagerClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(target.ID),
+	})
+	if err != nil {
+		return targetState{}, err
+	}
+	registerSecret(aws.ToString(getSecretValueOutput.SecretString))
+	return targetState{
+		Value:   aws.ToString(getSecretValueOutput.SecretString),
+		Version: aws.ToString(getSecretValueOutput.VersionId),
+	}, nil
+}
+
+func (t *secretTargets) putValue(ctx context.Context, target restoreTarget, value string) error {
+	_, err := t.secretsmanagerClient.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(target.ID),
+		SecretString: aws.String(value),
+	})
+	return err
+}
+
+// hostedConfigurationTargets restores a hosted configuration to the hosted
+// configuration profile of the same application and profile name, as a new
+// version with the content type of its current one.
+type hostedConfigurationTargets struct {
+	appconfigClient AppConfigAPI
+	profiles        []HostedConfiguration
+}
+
+func (t *hostedConfigurationTargets) noun() string { return "hosted configuration" }
+
+func (t *hostedConfigurationTargets) resolve(ctx context.Context, name string) ([]restoreTarget, error) {
+	if t.profiles == nil {
+		profiles, err := listHostedConfigurationProfiles(ctx, t.appconfigClient, newRateLimiter(0))
+		if err != nil {
+			return nil, err
+		}
+		t.profiles = profiles
+	}
+	targets := []restoreTarget{}
+	for _, profile := range t.profiles {
+		if profile.Name() == name {
+			targets = append(targets, restoreTarget{
+				Name: name,
+				ID:   aws.ToString(profile.Application.Id) + "/" + aws.ToString(profile.ConfigurationProfile.Id),
+			})
+		}
+	}
+	return targets, nil
+}
+
+func (t *hostedConfigurationTargets) latest(ctx context.Context, target restoreTarget) (*appconfig.GetHostedConfigurationVersionOutput, appconfigTypes.ConfigurationProfileSummary, error) {
+	applicationID, profileID, _ := strings.Cut(target.ID, "/")
+	profile := appconfigTypes.ConfigurationProfileSummary{ApplicationId: aws.String(applicationID), Id: aws.String(profileID)}
+	version, err := latestHostedConfigurationVersion(ctx, t.appconfigClient, newRateLimiter(0), profile)
+	return version, profile, err
+}
+
+func (t *hostedConfigurationTargets) currentValue(ctx context.Context, target restoreTarget) (targetState, error) {
+	version, _, err := t.latest(ctx, target)
+	if err != nil || version == nil {
+		return targetState{}, err
+	}
+	registerSecret(string(version.Content))
+	return targetState{
+		Value:   string(version.Content),
+		Version: strconv.FormatInt(int64(version.VersionNumber), 10),
+	}, nil
+}
+
+func (t *hostedConfigurationTargets) putValue(ctx context.Context, target restoreTarget, value string) error {
+	version, profile, err := t.latest(ctx, target)
+	if err != nil {
+		return err
+	}
+	input := &appconfig.CreateHostedConfigurationVersionInput{
+		ApplicationId:          profile.ApplicationId,
+		ConfigurationProfileId: profile.Id,
+		Content:                []byte(value),
+		ContentType:            aws.String("text/plain"),
+	}
+	if version != nil {
+		input.ContentType = version.ContentType
+		input.LatestVersionNumber = aws.Int32(version.VersionNumber)
+	}
+	_, err = t.appconfigClient.CreateHostedConfigurationVersion(ctx, input)
+	return err
+}
+
+// environmentVariableTargets restores an environment variable to the
+// variable of the same name of the function of the same name. Lambda keeps
+// encrypting it with the function's KMS key.
+type environmentVariableTargets struct {
+	lambdaClient LambdaAPI
+}
+
+func (t *environmentVariableTargets) noun() string { return "environment variable" }
+
+func (t *environmentVariableTargets) function(ctx context.Context, functionName string) (*lambda.GetFunctionConfigurationOutput, error) {
+	output, err := t.lambdaClient.GetFunctionConfiguration(ctx, &lambda.GetFunctionConfigurationInput{
+		FunctionName: aws.String(functionName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.Environment != nil && output.Environment.Error != nil {
+		return nil, fmt.Errorf("failed to read the environment of %s, %s: %s", functionName, aws.ToString(output.Environment.Error.ErrorCode), aws.ToString(output.Environment.Error.Message))
+	}
+	return output, nil
+}
+
+func (t *environmentVariableTargets) resolve(ctx context.Context, name string) ([]restoreTarget, error) {
+	functionName, variable, ok := strings.Cut(name, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid environment variable name %s, want <function>/<variable>", name)
+	}
+	output, err := t.function(ctx, functionName)
+	var notFound *lambdaTypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return []restoreTarget{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if output.Environment == nil {
+		return []restoreTarget{}, nil
+	}
+	if _, ok := output.Environment.Variables[variable]; !ok {
+		return []restoreTarget{}, nil
+	}
+	return []restoreTarget{{Name: name, ID: name}}, nil
+}
+
+func (t *environmentVariableTargets) currentValue(ctx context.Context, target restoreTarget) (targetState, error) {
+	functionName, variable, _ := strings.Cut(target.ID, "/")
+	output, err := t.function(ctx, functionName)
+	if err != nil {
+		return targetState{}, err
+	}
+	state := targetState{Version: aws.ToString(output.RevisionId)}
+	if output.Environment != nil {
+		state.Value = output.Environment.Variables[variable]
+	}
+	registerSecret(state.Value)
+	return state, nil
+}
+
+// putValue updates the variable alone, retrying while another update of the
+// function, such as that of its previous variable, is in progress.
+func (t *environmentVariableTargets) putValue(ctx context.Context, target restoreTarget, value string) error {
+	functionName, variable, _ := strings.Cut(target.ID, "/")
+	return retry(ctx, 3, 2*time.Second, func() error {
+		output, err := t.function(ctx, functionName)
+		if err != nil {
+			return err
+		}
+		variables := map[string]string{}
+		if output.Environment != nil {
+			maps.Copy(variables, output.Environment.Variables)
+		}
+		variables[variable] = value
+		_, err = t.lambdaClient.UpdateFunctionConfiguration(ctx, &lambda.UpdateFunctionConfigurationInput{
+			FunctionName: aws.String(functionName),
+			Environment:  &lambdaTypes.Environment{Variables: variables},
+			RevisionId:   output.RevisionId,
+		})
+		return err
+	})
+}
+
+// vaultTargets restores a Vault secret to the secret at the same path, as a
+// new version. A secret is a placeholder when all of its fields are.
+type vaultTargets struct {
+	vaultClient VaultAPI
+}
+
+func (t *vaultTargets) noun() string { return "Vault secret" }
+
+func (t *vaultTargets) isPlaceholder(value string) bool {
+	var data map[string]any
+	if err := json.Unmarshal([]byte(value), &data); err != nil || len(data) == 0 {
+		return false
+	}
+	for _, field := range data {
+		if field != placeholderValue {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *vaultTargets) resolve(ctx context.Context, name string) ([]restoreTarget, error) {
+	_, err := t.vaultClient.ReadSecret(ctx, name, 0)
+	var notFound *VaultNotFoundError
+	if errors.As(err, &notFound) {
+		return []restoreTarget{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []restoreTarget{{Name: name, ID: name}}, nil
+}
+
+func (t *vaultTargets) currentValue(ctx context.Context, target restoreTarget) (targetState, error) {
+	secret, err := t.vaultClient.ReadSecret(ctx, target.ID, 0)
+	if err != nil {
+		return targetState{}, err
+	}
+	registerVaultSecret(secret)
+	value, err := vaultValue(secret.Data)
+	if err != nil {
+		return targetState{}, err
+	}
+	return targetState{Value: value, Version: strconv.Itoa(secret.Metadata.Version)}, nil
+}
+
+// putValue writes value as a new version, failing if another version was
+// written since the current one was read.
+func (t *vaultTargets) putValue(ctx context.Context, target restoreTarget, value string) error {
+	var data map[string]any
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return fmt.Errorf("backup of %s is not the data of a Vault secret, %v", target.Name, err)
+	}
+	metadata, err := t.vaultClient.ReadMetadata(ctx, target.ID)
+	if err != nil {
+		return err
+	}
+	_, err = t.vaultClient.WriteSecret(ctx, target.ID, data, metadata.CurrentVersion)
+	return err
+}
+
+// restoreBackup restores the backup at loc, of kind, to the targets holding
+// a placeholder, or with dryRun only reports what it would restore.
+func restoreBackup(ctx context.Context, client *Client, kind string, loc backupLocation, dryRun bool, journalOpt restoreJournalOption, rollbackOnFailure bool, report *Report) error {
+	decrypted, err := loadBackup(ctx, client.S3, client.KMS, loc)
+	if err != nil {
+		return err
+	}
+
+	items, err := parseBackupItems(decrypted)
+	if err != nil {
+		return err
+	}
+	return restoreItems(ctx, client, kind, items, loc, dryRun, journalOpt, rollbackOnFailure, report)
+}
+
+// restoreItems restores items of kind to the targets holding a placeholder,
+// with a journal encrypted with the data key of loc.
+func restoreItems(ctx context.Context, client *Client, kind string, items []backupItem, loc backupLocation, dryRun bool, journalOpt restoreJournalOption, rollbackOnFailure bool, report *Report) error {
+	targets, err := newRestoreTargets(kind, client)
+	if err != nil {
+		return err
+	}
+	planItems, err := planRestore(ctx, targets, items, nil)
+	if err != nil {
+		return err
+	}
+
+	reportRestorePlan(report, planItems, dryRun)
+	if dryRun {
+		return nil
+	}
+	journal, err := newRestoreJournal(ctx, client.S3, client.KMS, journalOpt, kind, loc)
+	if err != nil {
+		return err
+	}
+	return applyRestoreWithRollback(ctx, targets, planItems, backupItemValues(items), journal, rollbackOnFailure, report)
+}
+
+// planRestore decides what to do with the target of every backup item
+// without modifying anything. With hashKey, the items also record keyed
+// hashes of the backup and live values for restore apply to detect drift.
+func planRestore(ctx context.Context, targets restoreTargets, items []backupItem, hashKey []byte) ([]restorePlanItem, error) {
+	planItems := []restorePlanItem{}
+	for _, item := range items {
+		resolved, err := targets.resolve(ctx, item.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(resolved) == 0 {
+			planItems = append(planItems, restorePlanItem{
+				Source: item.Name,
+				Action: restoreActionSkip,
+				Reason: "target is not found",
+			})
+			continue
+		}
+		for _, target := range resolved {
+			current, err := targets.currentValue(ctx, target)
+			if err != nil {
+				return nil, err
+			}
+			planItem := restorePlanItem{
+				Source:   item.Name,
+				Target:   target.Name,
+				TargetID: target.ID,
+			}
+			if hashKey != nil {
+				planItem.ValueHash = keyedValueHash(hashKey, item.Value)
+				planItem.LiveHash = keyedValueHash(hashKey, current.Value)
+			}
+			if !isPlaceholder(targets, current.Value) {
+				planItem.Action = restoreActionSkip
+				planItem.Reason = "target is not a placeholder"
+			} else {
+				planItem.Action = restoreActionRestore
+			}
+			planItems = append(planItems, planItem)
+		}
+	}
+	return planItems, nil
+}
+
+// reportRestorePlan adds the skipped items of a plan to report, and with
+// dryRun also the items that would be restored.
+func reportRestorePlan(report *Report, planItems []restorePlanItem, dryRun bool) {
+	for _, planItem := range planItems {
+		switch {
+		case planItem.Action == restoreActionSkip:
+			report.add(ReportItem{Source: planItem.Source, Target: planItem.Target, Action: ReportActionSkip, Reason: planItem.Reason})
+		case dryRun:
+			report.add(ReportItem{Source: planItem.Source, Target: planItem.Target, Action: ReportActionWouldRestore})
+		}
+	}
+}
+
+// applyRestore puts the backup values to the targets planned to be restored,
+// recording the previous value of each target in journal first.
+// values maps backup item names to their values.
+func applyRestore(ctx context.Context, targets restoreTargets, planItems []restorePlanItem, values map[string]string, journal *restoreJournal, report *Report) error {
+	var applyErr error
+	notAttempted := "not attempted after an earlier failure"
+	for _, planItem := range planItems {
+		if planItem.Action != restoreActionRestore {
+			continue
+		}
+		if applyErr == nil && ctx.Err() != nil {
+			applyErr = fmt.Errorf("restore interrupted, %w", ctx.Err())
+			notAttempted = "not attempted after the restore was interrupted"
+		}
+		if applyErr != nil {
+			report.add(ReportItem{Source: planItem.Source, Target: planItem.Target, Action: ReportActionSkip, Reason: notAttempted})
+			continue
+		}
+
+		// A target being restored is finished even if ctx is canceled
+		// meanwhile, so that the journal tells exactly what was changed.
+		start := time.Now()
+		applyErr = restoreTargetValue(context.WithoutCancel(ctx), targets, restoreTarget{Name: planItem.Target, ID: planItem.TargetID}, values[planItem.Source], journal)
+		report.add(ReportItem{
+			Source:   planItem.Source,
+			Target:   planItem.Target,
+			Action:   ReportActionRestore,
+			Error:    errorString(applyErr),
+			Duration: time.Since(start),
+		})
+	}
+	return applyErr
+}
+
+func restoreTargetValue(ctx context.Context, targets restoreTargets, target restoreTarget, value string, journal *restoreJournal) error {
+	current, err := targets.currentValue(ctx, target)
+	if err != nil {
+		return err
+	}
+	i, err := journal.record(target, current, value)
+	if err != nil {
+		return err
+	}
+	if err := targets.putValue(ctx, target, value); err != nil {
+		return err
+	}
+	return journal.setStatus(i, journalStatusRestored)
+}
+
+func backupItemValues(items []backupItem) map[string]string {
+	values := map[string]string{}
+	for _, item := range items {
+		values[item.Name] = item.Value
+	}
+	return values
+}
@@ -0,0 +1,321 @@
+package brsp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// restoreJournalVersion 2 keys RestoredHash with the data key; version 1
+// journals are still read for rollback.
+const restoreJournalVersion = 2
+
+const (
+	journalStatusPending    = "pending"
+	journalStatusRestored   = "restored"
+	journalStatusRolledBack = "rolled-back"
+)
+
+// restoreJournal records the value every target had before a restore
+// modified it, encrypted with the backup's data key, so that the restore can
+// be rolled back. It is rewritten after every change. A Plaintext journal,
+// written for a plaintext backup restored without a data key, holds the
+// values unencrypted.
+type restoreJournal struct {
+	Version   int                   `json:"version"`
+	Kind      string                `json:"kind"`
+	CreatedAt time.Time             `json:"createdAt"`
+	Source    backupLocation        `json:"source"`
+	Plaintext bool                  `json:"plaintext,omitempty"`
+	Entries   []restoreJournalEntry `json:"entries"`
+
+	path    string
+	dataKey []byte
+}
+
+type restoreJournalEntry struct {
+	Target          string `json:"target"`
+	TargetID        string `json:"targetId"`
+	PreviousVersion string `json:"previousVersion"`
+	PreviousValue   []byte `json:"previousValue"`
+	Nonce           []byte `json:"nonce,omitempty"`
+	RestoredHash    string `json:"restoredHash"`
+	Status          string `json:"status"`
+}
+
+type RollbackCommand struct {
+	client    *Client
+	s3Client  S3API
+	kmsClient KMSAPI
+	opt       *RollbackCommandOption
+}
+
+type RollbackCommandOption struct {
+	commandOption
+	Journal      string `required:"" type:"existingfile" help:"journal written by a restore"`
+	IdentityFile string `type:"existingfile" help:"file containing the base64-encoded plaintext data key, overriding the one recorded in the journal"`
+	Force        bool   `help:"roll back targets even if they changed after the restore"`
+	VaultOption
+}
+
+// NewRollbackCommandOption returns options set to the CLI defaults.
+func NewRollbackCommandOption() *RollbackCommandOption {
+	return withDefaults(&RollbackCommandOption{})
+}
+
+func defaultRestoreJournalPath() string {
+	return fmt.Sprintf("restore-journal-%s.json", time.Now().UTC().Format("20060102T150405Z"))
+}
+
+// restoreJournalOption tells where a restore writes its journal, and whether
+// it may be written unencrypted when there is no data key.
+type restoreJournalOption struct {
+	Path      string
+	Plaintext bool
+}
+
+// newRestoreJournal creates the journal of a restore from the backup at loc.
+func newRestoreJournal(ctx context.Context, s3Client S3API, kmsClient KMSAPI, opt restoreJournalOption, kind string, loc backupLocation) (*restoreJournal, error) {
+	path := opt.Path
+	if path == "" {
+		path = defaultRestoreJournalPath()
+	}
+	journal := &restoreJournal{
+		Version:   restoreJournalVersion,
+		Kind:      kind,
+		CreatedAt: time.Now().UTC(),
+		Source:    loc,
+		Entries:   []restoreJournalEntry{},
+		path:      path,
+	}
+	if loc.DataKeyKey == "" && loc.DataKeyFile == "" && loc.IdentityFile == "" {
+		if !opt.Plaintext {
+			return nil, fmt.Errorf("a data key is required to encrypt the restore journal, specify --data-key-key, --data-key-file or --identity-file, or --plaintext-journal to write it unencrypted")
+		}
+		slog.WarnContext(ctx, "writing the restore journal unencrypted, it holds the previous values of the targets", "journal", path)
+		journal.Plaintext = true
+		return journal, journal.save()
+	}
+	dataKey, err := loadDataKey(ctx, s3Client, kmsClient, loc)
+	if err != nil {
+		return nil, err
+	}
+	journal.dataKey = dataKey
+	return journal, journal.save()
+}
+
+func loadRestoreJournal(path string) (*restoreJournal, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	journal := &restoreJournal{path: path}
+	if err := json.Unmarshal(body, journal); err != nil {
+		return nil, fmt.Errorf("failed to read journal %s, %v", path, err)
+	}
+	if journal.Version != 1 && journal.Version != restoreJournalVersion {
+		return nil, fmt.Errorf("unsupported journal version: %d", journal.Version)
+	}
+	return journal, nil
+}
+
+// valueHash identifies a restored value, keyed with the data key unless the
+// journal is plaintext or of version 1.
+func (j *restoreJournal) valueHash(value string) string {
+	if j.Plaintext || j.Version == 1 {
+		return valueHash(value)
+	}
+	return keyedValueHash(valueHashKey(j.dataKey), value)
+}
+
+func (j *restoreJournal) sealValue(value string) (ciphertext []byte, nonce []byte, err error) {
+	if j.Plaintext {
+		return []byte(value), nil, nil
+	}
+	return encryptData(j.dataKey, []byte(value))
+}
+
+func (j *restoreJournal) openValue(entry restoreJournalEntry) ([]byte, error) {
+	if j.Plaintext {
+		return entry.PreviousValue, nil
+	}
+	return decryptData(j.dataKey, entry.Nonce, entry.PreviousValue)
+}
+
+// record adds a pending entry holding the current state of target and
+// returns its index. It must be called before target is modified.
+func (j *restoreJournal) record(target restoreTarget, current targetState, restoredValue string) (int, error) {
+	ciphertext, nonce, err := j.sealValue(current.Value)
+	if err != nil {
+		return 0, err
+	}
+	j.Entries = append(j.Entries, restoreJournalEntry{
+		Target:          target.Name,
+		TargetID:        target.ID,
+		PreviousVersion: current.Version,
+		PreviousValue:   ciphertext,
+		Nonce:           nonce,
+		RestoredHash:    j.valueHash(restoredValue),
+		Status:          journalStatusPending,
+	})
+	return len(j.Entries) - 1, j.save()
+}
+
+func (j *restoreJournal) count(status string) int {
+	n := 0
+	for _, entry := range j.Entries {
+		if entry.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+func (j *restoreJournal) setStatus(i int, status string) error {
+	j.Entries[i].Status = status
+	return j.save()
+}
+
+// save writes the journal through a temporary file so that a crash never leaves a truncated journal.
+func (j *restoreJournal) save() error {
+	body, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := writeFile(tmp, body); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// applyRestoreWithRollback applies planItems and, if that fails midway and
+// rollbackOnFailure is set, puts back the previous values of the targets
+// already modified.
+func applyRestoreWithRollback(ctx context.Context, targets restoreTargets, planItems []restorePlanItem, values map[string]string, journal *restoreJournal, rollbackOnFailure bool, report *Report) error {
+	err := applyRestore(ctx, targets, planItems, values, journal, report)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		planned := 0
+		for _, planItem := range planItems {
+			if planItem.Action == restoreActionRestore {
+				planned++
+			}
+		}
+		return fmt.Errorf("%d of %d targets were restored before the interruption, roll back with the journal %s if needed, %w", journal.count(journalStatusRestored), planned, journal.path, err)
+	}
+	if !rollbackOnFailure {
+		return fmt.Errorf("restore failed, roll back with the journal %s, %w", journal.path, err)
+	}
+
+	slog.WarnContext(ctx, "restore failed, rolling back", "journal", journal.path, "error", err)
+	if rollbackErr := rollbackRestore(ctx, targets, journal, false, report); rollbackErr != nil {
+		return fmt.Errorf("restore failed, %w; rollback also failed, %v", err, rollbackErr)
+	}
+	return fmt.Errorf("restore failed and was rolled back, %w", err)
+}
+
+// rollbackRestore puts the previous values recorded in journal back, newest
+// first. Targets changed by someone else after the restore are left alone
+// unless force is set. A failure on one target does not stop the others.
+func rollbackRestore(ctx context.Context, targets restoreTargets, journal *restoreJournal, force bool, report *Report) error {
+	skipped := []string{}
+	failed := []string{}
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		entry := journal.Entries[i]
+		if entry.Status == journalStatusRolledBack {
+			continue
+		}
+		target := restoreTarget{Name: entry.Target, ID: entry.TargetID}
+		previous, err := journal.openValue(entry)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the previous value of %s, %v", entry.Target, err)
+		}
+		registerSecret(string(previous))
+
+		start := time.Now()
+		current, err := targets.currentValue(ctx, target)
+		if err != nil {
+			failed = append(failed, entry.Target)
+			report.add(ReportItem{Target: entry.Target, Action: ReportActionRollback, Error: err.Error(), Duration: time.Since(start)})
+			continue
+		}
+		switch {
+		case current.Value == string(previous):
+			// The restore never reached this target.
+		case !force && journal.valueHash(current.Value) != entry.RestoredHash:
+			skipped = append(skipped, entry.Target)
+			report.add(ReportItem{Target: entry.Target, Action: ReportActionSkip, Reason: "changed after the restore"})
+			continue
+		default:
+			err := targets.putValue(ctx, target, string(previous))
+			report.add(ReportItem{
+				Target:   entry.Target,
+				Action:   ReportActionRollback,
+				Reason:   fmt.Sprintf("back to the value of version %s", entry.PreviousVersion),
+				Error:    errorString(err),
+				Duration: time.Since(start),
+			})
+			if err != nil {
+				failed = append(failed, entry.Target)
+				continue
+			}
+		}
+		if err := journal.setStatus(i, journalStatusRolledBack); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to roll back: %s", strings.Join(failed, ", "))
+	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("targets changed after the restore were not rolled back: %s", strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+func NewRollbackCommand(ctx context.Context, opt *RollbackCommandOption) (*RollbackCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(awsConfig, awsConfig).rollbackCommand(opt), nil
+}
+
+func (c *Client) rollbackCommand(opt *RollbackCommandOption) *RollbackCommand {
+	return &RollbackCommand{
+		client:    c.withVault(opt.VaultOption),
+		s3Client:  c.S3,
+		kmsClient: c.KMS,
+		opt:       opt,
+	}
+}
+
+func (c *RollbackCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("rollback")
+	journal, err := loadRestoreJournal(c.opt.Journal)
+	if err != nil {
+		return report, err
+	}
+	if !journal.Plaintext {
+		loc := journal.Source
+		if c.opt.IdentityFile != "" {
+			loc.IdentityFile = c.opt.IdentityFile
+		}
+		journal.dataKey, err = loadDataKey(ctx, c.s3Client, c.kmsClient, loc)
+		if err != nil {
+			return report, err
+		}
+	}
+	targets, err := newRestoreTargets(journal.Kind, c.client)
+	if err != nil {
+		return report, err
+	}
+	return report, rollbackRestore(ctx, targets, journal, c.opt.Force, report)
+}
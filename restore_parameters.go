@@ -2,27 +2,19 @@ package brsp
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/kms"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
 type RestoreParametersCommand struct {
-	ssmClient            *ssm.Client
-	s3Client             *s3.Client
-	kmsClient            *kms.Client
-	secretsmanagerClient *secretsmanager.Client
-	opt                  *RestoreParametersCommandOption
+	client *Client
+	opt    *RestoreParametersCommandOption
 }
 
 type RestoreParametersCommandOption struct {
+	commandOption
 	BucketName        string `help:"S3 bucket name"`
 	Key               string `help:"S3 object key"`
 	WithDecryption    bool   `default:"false" help:"With decryption"`
@@ -31,137 +23,66 @@ type RestoreParametersCommandOption struct {
 	KmsKey            string `help:"KMS key for decryption"`
 	DestinationSuffix string `help:"Destination suffix"`
 	DryRun            bool   `default:"true" help:"Dry run"`
+	FromFile          string `type:"existingfile" help:"restore from a local file instead of S3; either plaintext JSON from download-backup or an encrypted backup with its .nonce file next to it"`
+	DataKeyFile       string `type:"existingfile" help:"local copy of the KMS-encrypted data key, used with --from-file"`
+	IdentityFile      string `type:"existingfile" help:"file containing the base64-encoded plaintext data key, to decrypt --from-file without KMS"`
+	Journal           string `help:"path of the restore journal (default: restore-journal-<time>.json)"`
+	PlaintextJournal  bool   `help:"allow restoring a plaintext --from-file without a data key, writing the previous values to the journal unencrypted"`
+	RollbackOnFailure bool   `default:"true" negatable:"" help:"roll back modified targets when the restore fails midway"`
 }
 
-func NewRestoreParametersCommand(opt *RestoreParametersCommandOption) (*RestoreParametersCommand, error) {
-	awsConfig, err := getAwsConfig()
-	if err != nil {
-		return nil, err
-	}
-	return &RestoreParametersCommand{
-		ssmClient:            ssm.NewFromConfig(awsConfig),
-		s3Client:             s3.NewFromConfig(awsConfig),
-		kmsClient:            kms.NewFromConfig(awsConfig),
-		secretsmanagerClient: secretsmanager.NewFromConfig(awsConfig),
-		opt:                  opt,
-	}, nil
-
+// NewRestoreParametersCommandOption returns options set to the CLI defaults.
+func NewRestoreParametersCommandOption() *RestoreParametersCommandOption {
+	return withDefaults(&RestoreParametersCommandOption{})
 }
 
-func (c *RestoreParametersCommand) Run() error {
-	fmt.Println("Restoring parameters")
-	output, err := c.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(c.opt.Key),
-	})
-	if err != nil {
-		return err
-	}
-	defer output.Body.Close()
-
-	data, err := io.ReadAll(output.Body)
-	if err != nil {
-		return err
-	}
-
-	getNonceObjectOutput, err := c.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(fmt.Sprintf("%s.nonce", c.opt.Key)),
-	})
-	if err != nil {
-		return err
-	}
-	defer getNonceObjectOutput.Body.Close()
-
-	nonce, err := io.ReadAll(getNonceObjectOutput.Body)
-	if err != nil {
-		return err
-	}
-	getObjectOutput, err := c.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(c.opt.BucketName),
-		Key:    aws.String(c.opt.DataKeyKey),
-	})
-	if err != nil {
-		return err
-	}
-
-	dataKey, err := io.ReadAll(getObjectOutput.Body)
-	if err != nil {
-		return err
-	}
-
-	decryptOutput, err := c.kmsClient.Decrypt(context.TODO(), &kms.DecryptInput{
-		CiphertextBlob: dataKey,
-	})
-	if err != nil {
-		return err
-	}
-
-	decrypted, err := decryptData(decryptOutput.Plaintext, nonce, data)
+func NewRestoreParametersCommand(ctx context.Context, opt *RestoreParametersCommandOption) (*RestoreParametersCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return NewClient(awsConfig, awsConfig).restoreParametersCommand(opt), nil
+}
 
-	var parameters []Parameter
-	err = json.Unmarshal(decrypted, &parameters)
-	if err != nil {
-		return err
+func (c *Client) restoreParametersCommand(opt *RestoreParametersCommandOption) *RestoreParametersCommand {
+	return &RestoreParametersCommand{
+		client: c,
+		opt:    opt,
 	}
+}
 
-	for _, parameter := range parameters {
-		fmt.Printf("Restoring parameter %s\n", *parameter.Name)
-		getParametersOutput, err := c.ssmClient.GetParameters(context.TODO(), &ssm.GetParametersInput{
-			Names: []string{*parameter.Name},
-		})
-		if err != nil {
-			return err
-		}
-		if len(getParametersOutput.Parameters) == 0 {
-			fmt.Printf("Parameter %s not found\n", *parameter.Name)
-			continue
-		}
-		for _, p := range getParametersOutput.Parameters {
-			getParametersOutput, err := c.ssmClient.GetParameter(context.TODO(), &ssm.GetParameterInput{
-				Name: p.Name,
-			})
-			if err != nil {
-				return err
-			}
-			if *getParametersOutput.Parameter.Value != "DUMMY" {
-				fmt.Printf("Skip restoring parameter %s because it's not a dummy value\n", *parameter.Name)
-				continue
-			}
-
-			if c.opt.DryRun {
-				fmt.Printf("[DRY RUN] Restore parameter value to %s from %s\n", *p.Name, *parameter.Name)
-				continue
-			}
-
-			fmt.Printf("Restore parameter value to %s from %s\n", *p.Name, *parameter.Name)
-			err = retry(3, 2*time.Second, func() error {
-				_, err = c.ssmClient.PutParameter(context.TODO(), &ssm.PutParameterInput{
-					Name:      p.Name,
-					Value:     parameter.Value,
-					Overwrite: aws.Bool(true),
-				})
-				return err
-			})
-			if err != nil {
-				return err
-			}
-		}
+func (c *RestoreParametersCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("restore-parameters")
+	slog.Info("restoring parameters")
+	loc := backupLocation{
+		BucketName:        c.opt.BucketName,
+		Key:               c.opt.Key,
+		DataKeyBucketName: c.opt.DataKeyBucketName,
+		DataKeyKey:        c.opt.DataKeyKey,
+		FromFile:          c.opt.FromFile,
+		DataKeyFile:       c.opt.DataKeyFile,
+		IdentityFile:      c.opt.IdentityFile,
 	}
-	return nil
+	return report, restoreBackup(ctx, c.client, "parameters", loc, c.opt.DryRun, restoreJournalOption{Path: c.opt.Journal, Plaintext: c.opt.PlaintextJournal}, c.opt.RollbackOnFailure, report)
 }
 
-func retry(attempts int, sleep time.Duration, fn func() error) error {
+// retry calls fn up to attempts times, waiting sleep between attempts, and
+// returns the last error. It stops waiting when ctx is done.
+func retry(ctx context.Context, attempts int, sleep time.Duration, fn func() error) error {
+	var err error
 	for i := 0; i < attempts; i++ {
-		err := fn()
-		if err == nil {
+		if err = fn(); err == nil {
 			return nil
 		}
-		fmt.Printf("Attempt %d failed; retrying in %v\n", i+1, sleep)
-		time.Sleep(sleep)
+		if i == attempts-1 {
+			break
+		}
+		slog.Warn("attempt failed, retrying", "attempt", i+1, "sleep", sleep, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up retrying after attempt %d, %w", i+1, errors.Join(err, ctx.Err()))
+		case <-time.After(sleep):
+		}
 	}
-	return fmt.Errorf("all attempts failed")
+	return fmt.Errorf("all %d attempts failed, %w", attempts, err)
 }
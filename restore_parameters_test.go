@@ -0,0 +1,36 @@
+package brsp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	failure := errors.New("throttled")
+
+	calls := 0
+	err := retry(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		return failure
+	})
+	if !errors.Is(err, failure) || calls != 3 {
+		t.Errorf("retry returned %v after %d calls, want the last error after 3", err, calls)
+	}
+
+	calls = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	err = retry(ctx, 3, time.Hour, func() error {
+		calls++
+		return failure
+	})
+	if !errors.Is(err, failure) || !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("retry with a canceled context returned %v after %d calls, want the error and the cancellation after 1", err, calls)
+	}
+	if time.Since(start) > time.Minute {
+		t.Error("retry waited although the context was canceled")
+	}
+}
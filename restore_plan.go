@@ -0,0 +1,330 @@
+package brsp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+const restorePlanVersion = 2
+
+// restorePlan is a reviewable list of restore actions, signed with a key
+// derived from the backup's data key so that it cannot be edited unnoticed.
+type restorePlan struct {
+	Version   int               `json:"version"`
+	Kind      string            `json:"kind"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Source    backupLocation    `json:"source"`
+	Items     []restorePlanItem `json:"items"`
+	Signature string            `json:"signature,omitempty"`
+}
+
+type restorePlanItem struct {
+	Source    string `json:"source"`
+	Target    string `json:"target,omitempty"`
+	TargetID  string `json:"targetId,omitempty"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason,omitempty"`
+	ValueHash string `json:"valueHash,omitempty"`
+	LiveHash  string `json:"liveHash,omitempty"`
+}
+
+type RestoreCommandOption struct {
+	Plan     *RestorePlanCommandOption     `cmd:"plan" help:"make a restore plan"`
+	Apply    *RestoreApplyCommandOption    `cmd:"apply" help:"apply a restore plan"`
+	Snapshot *RestoreSnapshotCommandOption `cmd:"snapshot" help:"restore a snapshot taken by backup"`
+}
+
+type RestorePlanCommand struct {
+	client    *Client
+	s3Client  S3API
+	kmsClient KMSAPI
+	opt       *RestorePlanCommandOption
+}
+
+type RestorePlanCommandOption struct {
+	commandOption
+	Kind              string `default:"auto" enum:"auto,parameters,secrets,appconfig,lambda,vault" help:"kind of the backup (auto detects it from the backup)"`
+	BucketName        string `help:"S3 bucket name"`
+	Key               string `help:"S3 object key"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	KmsKey            string `help:"KMS key for decryption"`
+	FromFile          string `type:"existingfile" help:"plan from a local file instead of S3"`
+	DataKeyFile       string `type:"existingfile" help:"local copy of the KMS-encrypted data key, used with --from-file"`
+	IdentityFile      string `type:"existingfile" help:"file containing the base64-encoded plaintext data key"`
+	Output            string `required:"" help:"path to write the plan to"`
+	VaultOption
+}
+
+// NewRestorePlanCommandOption returns options set to the CLI defaults.
+func NewRestorePlanCommandOption() *RestorePlanCommandOption {
+	return withDefaults(&RestorePlanCommandOption{})
+}
+
+type RestoreApplyCommand struct {
+	client    *Client
+	s3Client  S3API
+	kmsClient KMSAPI
+	opt       *RestoreApplyCommandOption
+}
+
+type RestoreApplyCommandOption struct {
+	commandOption
+	Plan              string `required:"" type:"existingfile" help:"plan file made by restore plan"`
+	DataKeyBucketName string `help:"data key bucket name"`
+	DataKeyKey        string `help:"data key key"`
+	DataKeyFile       string `type:"existingfile" help:"local copy of the KMS-encrypted data key"`
+	IdentityFile      string `type:"existingfile" help:"file containing the base64-encoded plaintext data key"`
+	FromFile          string `type:"existingfile" help:"local backup file the plan was made from, if any"`
+	Journal           string `help:"path of the restore journal (default: restore-journal-<time>.json)"`
+	RollbackOnFailure bool   `default:"true" negatable:"" help:"roll back modified targets when the restore fails midway"`
+	VaultOption
+}
+
+// NewRestoreApplyCommandOption returns options set to the CLI defaults.
+func NewRestoreApplyCommandOption() *RestoreApplyCommandOption {
+	return withDefaults(&RestoreApplyCommandOption{})
+}
+
+func NewRestorePlanCommand(ctx context.Context, opt *RestorePlanCommandOption) (*RestorePlanCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(awsConfig, awsConfig).restorePlanCommand(opt), nil
+}
+
+func (c *Client) restorePlanCommand(opt *RestorePlanCommandOption) *RestorePlanCommand {
+	return &RestorePlanCommand{
+		client:    c.withVault(opt.VaultOption),
+		s3Client:  c.S3,
+		kmsClient: c.KMS,
+		opt:       opt,
+	}
+}
+
+func (c *RestorePlanCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("restore plan")
+	loc := backupLocation{
+		BucketName:        c.opt.BucketName,
+		Key:               c.opt.Key,
+		DataKeyBucketName: c.opt.DataKeyBucketName,
+		DataKeyKey:        c.opt.DataKeyKey,
+		FromFile:          c.opt.FromFile,
+		DataKeyFile:       c.opt.DataKeyFile,
+		IdentityFile:      c.opt.IdentityFile,
+	}
+	if loc.DataKeyKey == "" && loc.DataKeyFile == "" && loc.IdentityFile == "" {
+		return report, fmt.Errorf("a data key is required to sign the plan, specify --data-key-key, --data-key-file or --identity-file")
+	}
+
+	decrypted, err := loadBackup(ctx, c.s3Client, c.kmsClient, loc)
+	if err != nil {
+		return report, err
+	}
+	kind := c.opt.Kind
+	if kind == "auto" {
+		kind, err = detectBackupKind(decrypted)
+		if err != nil {
+			return report, err
+		}
+	}
+	items, err := parseBackupItems(decrypted)
+	if err != nil {
+		return report, err
+	}
+	targets, err := newRestoreTargets(kind, c.client)
+	if err != nil {
+		return report, err
+	}
+
+	dataKey, err := loadDataKey(ctx, c.s3Client, c.kmsClient, loc)
+	if err != nil {
+		return report, err
+	}
+	planItems, err := planRestore(ctx, targets, items, valueHashKey(dataKey))
+	if err != nil {
+		return report, err
+	}
+	plan := &restorePlan{
+		Version:   restorePlanVersion,
+		Kind:      kind,
+		CreatedAt: time.Now().UTC(),
+		Source:    loc,
+		Items:     planItems,
+	}
+	if err := plan.sign(dataKey); err != nil {
+		return report, err
+	}
+	body, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return report, err
+	}
+	if err := writeFile(c.opt.Output, body); err != nil {
+		return report, err
+	}
+
+	reportRestorePlan(report, planItems, true)
+	slog.Info("plan written", "path", c.opt.Output)
+	return report, nil
+}
+
+func NewRestoreApplyCommand(ctx context.Context, opt *RestoreApplyCommandOption) (*RestoreApplyCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(awsConfig, awsConfig).restoreApplyCommand(opt), nil
+}
+
+func (c *Client) restoreApplyCommand(opt *RestoreApplyCommandOption) *RestoreApplyCommand {
+	return &RestoreApplyCommand{
+		client:    c.withVault(opt.VaultOption),
+		s3Client:  c.S3,
+		kmsClient: c.KMS,
+		opt:       opt,
+	}
+}
+
+func (c *RestoreApplyCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("restore apply")
+	body, err := os.ReadFile(c.opt.Plan)
+	if err != nil {
+		return report, err
+	}
+	var plan restorePlan
+	if err := json.Unmarshal(body, &plan); err != nil {
+		return report, fmt.Errorf("failed to read plan %s, %v", c.opt.Plan, err)
+	}
+	if plan.Version != restorePlanVersion {
+		return report, fmt.Errorf("unsupported plan version: %d", plan.Version)
+	}
+
+	// The plan is only trusted once verified, so the data key and any local
+	// file are taken from the flags, never from the plan itself: otherwise
+	// whoever edits the plan could point it at a key and backup of their own
+	// and sign it again.
+	if c.opt.DataKeyKey == "" && c.opt.DataKeyFile == "" && c.opt.IdentityFile == "" {
+		return report, fmt.Errorf("a data key is required to verify the plan, specify --data-key-key, --data-key-file or --identity-file")
+	}
+	if c.opt.DataKeyKey != "" && c.opt.DataKeyBucketName == "" {
+		return report, fmt.Errorf("--data-key-key requires --data-key-bucket-name")
+	}
+	loc := plan.Source
+	loc.DataKeyBucketName = c.opt.DataKeyBucketName
+	loc.DataKeyKey = c.opt.DataKeyKey
+	loc.DataKeyFile = c.opt.DataKeyFile
+	loc.IdentityFile = c.opt.IdentityFile
+	if plan.Source.FromFile != "" {
+		if c.opt.FromFile == "" {
+			return report, fmt.Errorf("the plan was made from the local file %s, specify it with --from-file", plan.Source.FromFile)
+		}
+		loc.FromFile = c.opt.FromFile
+	}
+	dataKey, err := loadDataKey(ctx, c.s3Client, c.kmsClient, backupLocation{
+		DataKeyBucketName: loc.DataKeyBucketName,
+		DataKeyKey:        loc.DataKeyKey,
+		DataKeyFile:       loc.DataKeyFile,
+		IdentityFile:      loc.IdentityFile,
+	})
+	if err != nil {
+		return report, err
+	}
+	if err := plan.verify(dataKey); err != nil {
+		return report, err
+	}
+
+	decrypted, err := loadBackup(ctx, c.s3Client, c.kmsClient, loc)
+	if err != nil {
+		return report, err
+	}
+	items, err := parseBackupItems(decrypted)
+	if err != nil {
+		return report, err
+	}
+	values := backupItemValues(items)
+	targets, err := newRestoreTargets(plan.Kind, c.client)
+	if err != nil {
+		return report, err
+	}
+
+	if err := checkRestorePlanDrift(ctx, targets, plan.Items, values, valueHashKey(dataKey)); err != nil {
+		return report, err
+	}
+	journal, err := newRestoreJournal(ctx, c.s3Client, c.kmsClient, restoreJournalOption{Path: c.opt.Journal}, plan.Kind, loc)
+	if err != nil {
+		return report, err
+	}
+	reportRestorePlan(report, plan.Items, false)
+	return report, applyRestoreWithRollback(ctx, targets, plan.Items, values, journal, c.opt.RollbackOnFailure, report)
+}
+
+// checkRestorePlanDrift fails when the backup values or the live values of
+// the targets to restore differ from what they were when the plan was made.
+func checkRestorePlanDrift(ctx context.Context, targets restoreTargets, planItems []restorePlanItem, values map[string]string, hashKey []byte) error {
+	drifted := []string{}
+	for _, planItem := range planItems {
+		if planItem.Action != restoreActionRestore {
+			continue
+		}
+		value, ok := values[planItem.Source]
+		if !ok || keyedValueHash(hashKey, value) != planItem.ValueHash {
+			drifted = append(drifted, fmt.Sprintf("%s (backup value changed)", planItem.Source))
+			continue
+		}
+		current, err := targets.currentValue(ctx, restoreTarget{Name: planItem.Target, ID: planItem.TargetID})
+		if err != nil {
+			return err
+		}
+		if keyedValueHash(hashKey, current.Value) != planItem.LiveHash {
+			drifted = append(drifted, fmt.Sprintf("%s (live value changed)", planItem.Target))
+		}
+	}
+	if len(drifted) > 0 {
+		return fmt.Errorf("refusing to apply the plan because state drifted since planning: %s", strings.Join(drifted, ", "))
+	}
+	return nil
+}
+
+func (p *restorePlan) sign(dataKey []byte) error {
+	signature, err := p.signature(dataKey)
+	if err != nil {
+		return err
+	}
+	p.Signature = signature
+	return nil
+}
+
+func (p *restorePlan) verify(dataKey []byte) error {
+	expected, err := p.signature(dataKey)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(p.Signature)) {
+		return fmt.Errorf("plan signature is invalid; the plan was modified or signed with another data key")
+	}
+	return nil
+}
+
+// signature is an HMAC-SHA256 of the plan without its signature, keyed by a
+// key derived from the data key so that the data key itself is never used twice.
+func (p *restorePlan) signature(dataKey []byte) (string, error) {
+	unsigned := *p
+	unsigned.Signature = ""
+	body, err := json.Marshal(unsigned)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, deriveKey(dataKey, "brsp restore plan signing key"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,150 @@
+package brsp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type RestoreSnapshotCommand struct {
+	client *Client
+	opt    *RestoreSnapshotCommandOption
+}
+
+type RestoreSnapshotCommandOption struct {
+	commandOption
+	BucketName        string   `help:"S3 bucket name"`
+	KeyPrefix         string   `help:"key prefix the snapshot was written under"`
+	SnapshotID        string   `default:"latest" help:"ID of the snapshot to restore (latest for the latest one)"`
+	Kinds             []string `enum:"parameters,secrets,appconfig,lambda,vault" help:"kinds of the snapshot to restore (all kinds in the snapshot if empty)"`
+	DataKeyBucketName string   `help:"data key bucket name"`
+	DataKeyKey        string   `help:"data key key"`
+	DryRun            bool     `default:"true" help:"Dry run"`
+	Journal           string   `help:"path of the restore journals, suffixed with the kind (default: restore-journal-<snapshot-id>-<kind>.json)"`
+	RollbackOnFailure bool     `default:"true" negatable:"" help:"roll back modified targets when the restore fails midway"`
+	VaultOption
+}
+
+// NewRestoreSnapshotCommandOption returns options set to the CLI defaults.
+func NewRestoreSnapshotCommandOption() *RestoreSnapshotCommandOption {
+	return withDefaults(&RestoreSnapshotCommandOption{})
+}
+
+func NewRestoreSnapshotCommand(ctx context.Context, opt *RestoreSnapshotCommandOption) (*RestoreSnapshotCommand, error) {
+	awsConfig, err := getAwsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(awsConfig, awsConfig).restoreSnapshotCommand(opt), nil
+}
+
+func (c *Client) restoreSnapshotCommand(opt *RestoreSnapshotCommandOption) *RestoreSnapshotCommand {
+	return &RestoreSnapshotCommand{client: c.withVault(opt.VaultOption), opt: opt}
+}
+
+// Run restores the chosen kinds of a snapshot, or all of its kinds, one after
+// another, stopping at the first kind that fails and undoing the kinds
+// restored before it.
+func (c *RestoreSnapshotCommand) Run(ctx context.Context) (*Report, error) {
+	report := newReport("restore snapshot")
+	dataKey, err := loadDataKey(ctx, c.client.S3, c.client.KMS, backupLocation{
+		BucketName:        c.opt.BucketName,
+		DataKeyBucketName: c.opt.DataKeyBucketName,
+		DataKeyKey:        c.opt.DataKeyKey,
+	})
+	if err != nil {
+		return report, err
+	}
+	manifest, err := loadSnapshotManifest(ctx, c.client.S3, c.opt.BucketName, c.opt.KeyPrefix, c.opt.SnapshotID, dataKey)
+	if err != nil {
+		return report, err
+	}
+	kinds := c.opt.Kinds
+	if len(kinds) == 0 {
+		kinds = slices.Sorted(maps.Keys(manifest.Kinds))
+	}
+	slog.Info("restoring snapshot", "snapshotId", manifest.SnapshotID, "createdAt", manifest.CreatedAt, "kinds", kinds)
+
+	for _, kind := range kinds {
+		if _, ok := manifest.Kinds[kind]; !ok {
+			return report, fmt.Errorf("snapshot %s has no %s", manifest.SnapshotID, kind)
+		}
+	}
+
+	// applied are the kinds restored so far, whose journals are needed to
+	// undo them if a later kind fails.
+	applied := []string{}
+	for _, kind := range kinds {
+		slog.Info("restoring", "kind", kind)
+		loc := backupLocation{
+			BucketName:        c.opt.BucketName,
+			Key:               manifest.Kinds[kind].Key,
+			DataKeyBucketName: c.opt.DataKeyBucketName,
+			DataKeyKey:        c.opt.DataKeyKey,
+		}
+		if err := restoreBackup(ctx, c.client, kind, loc, c.opt.DryRun, restoreJournalOption{Path: c.journalPath(manifest.SnapshotID, kind)}, c.opt.RollbackOnFailure, report); err != nil {
+			err = fmt.Errorf("failed to restore %s of snapshot %s, %w", kind, manifest.SnapshotID, err)
+			return report, c.undoApplied(ctx, manifest.SnapshotID, applied, dataKey, err, report)
+		}
+		if !c.opt.DryRun {
+			applied = append(applied, kind)
+		}
+	}
+	return report, nil
+}
+
+// undoApplied handles the kinds of a snapshot restored before err: they are
+// rolled back, newest first, with --rollback-on-failure, and otherwise listed
+// in the error with their journals so that they can be rolled back later.
+func (c *RestoreSnapshotCommand) undoApplied(ctx context.Context, snapshotID string, applied []string, dataKey []byte, err error, report *Report) error {
+	if len(applied) == 0 {
+		return err
+	}
+	journals := []string{}
+	for _, kind := range applied {
+		journals = append(journals, fmt.Sprintf("%s (journal %s)", kind, c.journalPath(snapshotID, kind)))
+	}
+	if !c.opt.RollbackOnFailure || ctx.Err() != nil {
+		return fmt.Errorf("%w; these kinds were restored, roll them back with their journals if needed: %s", err, strings.Join(journals, ", "))
+	}
+
+	slog.WarnContext(ctx, "restore of the snapshot failed, rolling back the kinds restored", "kinds", applied, "error", err)
+	failed := []string{}
+	for i := len(applied) - 1; i >= 0; i-- {
+		kind := applied[i]
+		if rollbackErr := c.rollbackKind(ctx, snapshotID, kind, dataKey, report); rollbackErr != nil {
+			failed = append(failed, fmt.Sprintf("%s (journal %s), %v", kind, c.journalPath(snapshotID, kind), rollbackErr))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w; rollback of these kinds also failed: %s", err, strings.Join(failed, "; "))
+	}
+	return fmt.Errorf("%w; the kinds restored before were rolled back: %s", err, strings.Join(applied, ", "))
+}
+
+func (c *RestoreSnapshotCommand) rollbackKind(ctx context.Context, snapshotID string, kind string, dataKey []byte, report *Report) error {
+	journal, err := loadRestoreJournal(c.journalPath(snapshotID, kind))
+	if err != nil {
+		return err
+	}
+	journal.dataKey = dataKey
+	targets, err := newRestoreTargets(kind, c.client)
+	if err != nil {
+		return err
+	}
+	return rollbackRestore(ctx, targets, journal, false, report)
+}
+
+// journalPath returns the journal of kind: --journal with the kind inserted
+// before its extension, or one named after the snapshot.
+func (c *RestoreSnapshotCommand) journalPath(snapshotID string, kind string) string {
+	if c.opt.Journal == "" {
+		return fmt.Sprintf("restore-journal-%s-%s.json", snapshotID, kind)
+	}
+	ext := filepath.Ext(c.opt.Journal)
+	return strings.TrimSuffix(c.opt.Journal, ext) + "-" + kind + ext
+}
@@ -0,0 +1,356 @@
+package brsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// backupSchemaVersion is the version of the backup document written by brsp.
+// Version 1 is the bare JSON array of the SDK Parameter and Secret structs
+// written before backups had a schema of their own.
+const backupSchemaVersion = 2
+
+// backupDocument is the decrypted content of a backup. SnapshotID and
+// CreatedAt are set on the backups of a snapshot taken by the backup command.
+type backupDocument struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	Kind          string               `json:"kind"`
+	Source        backupSource         `json:"source"`
+	SnapshotID    string               `json:"snapshotId,omitempty"`
+	CreatedAt     *time.Time           `json:"createdAt,omitempty"`
+	Items         []backupDocumentItem `json:"items"`
+}
+
+// backupSource tells where the items of a backup were read from.
+type backupSource struct {
+	Account string `json:"account,omitempty"`
+	Region  string `json:"region,omitempty"`
+}
+
+// backupDocumentItem is a parameter, secret, hosted configuration,
+// environment variable or Vault secret in a backup. The fields after ARN are
+// set only for the kinds they belong to.
+type backupDocumentItem struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	ARN   string `json:"arn,omitempty"`
+
+	// Parameters; Version and LastModifiedDate also of Vault secrets.
+	// RawValue is the value read without decryption, which is the ciphertext
+	// of a SecureString.
+	Type             string     `json:"type,omitempty"`
+	DataType         string     `json:"dataType,omitempty"`
+	RawValue         string     `json:"rawValue,omitempty"`
+	Version          int64      `json:"version,omitempty"`
+	LastModifiedDate *time.Time `json:"lastModifiedDate,omitempty"`
+
+	// Secrets; Description, KmsKeyId and Version also of hosted
+	// configurations, and KmsKeyId also of environment variables.
+	Description     string      `json:"description,omitempty"`
+	KmsKeyId        string      `json:"kmsKeyId,omitempty"`
+	RotationEnabled bool        `json:"rotationEnabled,omitempty"`
+	Tags            []backupTag `json:"tags,omitempty"`
+	LastChangedDate *time.Time  `json:"lastChangedDate,omitempty"`
+
+	// Hosted configurations.
+	ContentType string `json:"contentType,omitempty"`
+
+	// Vault secrets, whose Value is the JSON object of their data. History
+	// holds their previous versions when backed up with all versions.
+	History []backupItemVersion `json:"history,omitempty"`
+}
+
+// backupItemVersion is a previous version of an item, kept for reference.
+type backupItemVersion struct {
+	Version     int64      `json:"version"`
+	Value       string     `json:"value"`
+	CreatedDate *time.Time `json:"createdDate,omitempty"`
+}
+
+type backupTag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// metadata returns the fields compared besides the value, per kind.
+func (item backupDocumentItem) metadata(kind string) map[string]string {
+	metadata := map[string]string{}
+	set := func(field string, value string) {
+		if value != "" {
+			metadata[field] = value
+		}
+	}
+	switch kind {
+	case "parameters":
+		set("type", item.Type)
+		set("dataType", item.DataType)
+		if item.Version != 0 {
+			set("version", strconv.FormatInt(item.Version, 10))
+		}
+	case "secrets":
+		set("description", item.Description)
+		set("kmsKeyId", item.KmsKeyId)
+		set("rotationEnabled", strconv.FormatBool(item.RotationEnabled))
+		tags := []string{}
+		for _, tag := range item.Tags {
+			tags = append(tags, tag.Key+"="+tag.Value)
+		}
+		set("tags", strings.Join(tags, ","))
+	case "appconfig":
+		set("contentType", item.ContentType)
+		set("description", item.Description)
+		set("kmsKeyId", item.KmsKeyId)
+	case "lambda":
+		set("kmsKeyId", item.KmsKeyId)
+	case "vault":
+		if item.Version != 0 {
+			set("version", strconv.FormatInt(item.Version, 10))
+		}
+	}
+	return metadata
+}
+
+func newParametersDocument(parameters []Parameter) backupDocument {
+	doc := backupDocument{SchemaVersion: backupSchemaVersion, Kind: "parameters", Items: []backupDocumentItem{}}
+	for _, parameter := range parameters {
+		doc.Items = append(doc.Items, backupDocumentItem{
+			Name:             aws.ToString(parameter.Name),
+			Value:            aws.ToString(parameter.Value),
+			ARN:              aws.ToString(parameter.ARN),
+			Type:             string(parameter.Type),
+			DataType:         aws.ToString(parameter.DataType),
+			RawValue:         parameter.KmsKey,
+			Version:          parameter.Version,
+			LastModifiedDate: parameter.LastModifiedDate,
+		})
+	}
+	doc.Source = documentSource(doc.Items)
+	return doc
+}
+
+func newSecretsDocument(secrets []Secret) backupDocument {
+	doc := backupDocument{SchemaVersion: backupSchemaVersion, Kind: "secrets", Items: []backupDocumentItem{}}
+	for _, secret := range secrets {
+		item := backupDocumentItem{
+			Name:            aws.ToString(secret.Name),
+			Value:           secret.SecretValue,
+			ARN:             aws.ToString(secret.ARN),
+			Description:     aws.ToString(secret.Description),
+			KmsKeyId:        aws.ToString(secret.KmsKeyId),
+			RotationEnabled: aws.ToBool(secret.RotationEnabled),
+			LastChangedDate: secret.LastChangedDate,
+		}
+		for _, tag := range secret.Tags {
+			item.Tags = append(item.Tags, backupTag{Key: aws.ToString(tag.Key), Value: aws.ToString(tag.Value)})
+		}
+		doc.Items = append(doc.Items, item)
+	}
+	doc.Source = documentSource(doc.Items)
+	return doc
+}
+
+func newAppConfigDocument(configurations []HostedConfiguration) backupDocument {
+	doc := backupDocument{SchemaVersion: backupSchemaVersion, Kind: "appconfig", Items: []backupDocumentItem{}}
+	for _, configuration := range configurations {
+		doc.Items = append(doc.Items, backupDocumentItem{
+			Name:        configuration.Name(),
+			Value:       string(configuration.Content),
+			Version:     int64(configuration.VersionNumber),
+			Description: aws.ToString(configuration.Description),
+			KmsKeyId:    aws.ToString(configuration.KmsKeyArn),
+			ContentType: aws.ToString(configuration.ContentType),
+		})
+	}
+	return doc
+}
+
+func newLambdaDocument(variables []EnvironmentVariable) backupDocument {
+	doc := backupDocument{SchemaVersion: backupSchemaVersion, Kind: "lambda", Items: []backupDocumentItem{}}
+	for _, variable := range variables {
+		doc.Items = append(doc.Items, backupDocumentItem{
+			Name:     variable.ID(),
+			Value:    variable.Value,
+			ARN:      aws.ToString(variable.Function.FunctionArn),
+			KmsKeyId: aws.ToString(variable.Function.KMSKeyArn),
+		})
+	}
+	doc.Source = documentSource(doc.Items)
+	return doc
+}
+
+func newVaultDocument(entries []VaultEntry) (backupDocument, error) {
+	doc := backupDocument{SchemaVersion: backupSchemaVersion, Kind: "vault", Items: []backupDocumentItem{}}
+	for _, entry := range entries {
+		value, err := vaultValue(entry.Data)
+		if err != nil {
+			return doc, err
+		}
+		item := backupDocumentItem{
+			Name:             entry.Path,
+			Value:            value,
+			Version:          int64(entry.Metadata.Version),
+			LastModifiedDate: aws.Time(entry.Metadata.CreatedTime),
+		}
+		for _, version := range entry.History {
+			value, err := vaultValue(version.Data)
+			if err != nil {
+				return doc, err
+			}
+			item.History = append(item.History, backupItemVersion{
+				Version:     int64(version.Metadata.Version),
+				Value:       value,
+				CreatedDate: aws.Time(version.Metadata.CreatedTime),
+			})
+		}
+		doc.Items = append(doc.Items, item)
+	}
+	return doc, nil
+}
+
+// documentSource takes the account and region of a backup from the ARN of
+// its first item.
+func documentSource(items []backupDocumentItem) backupSource {
+	for _, item := range items {
+		if parsed, err := arn.Parse(item.ARN); err == nil {
+			return backupSource{Account: parsed.AccountID, Region: parsed.Region}
+		}
+	}
+	return backupSource{}
+}
+
+// decodeBackup reads a decrypted backup of any schema version into the
+// current one.
+func decodeBackup(payload []byte) (backupDocument, error) {
+	payload = bytes.TrimSpace(payload)
+	if bytes.HasPrefix(payload, []byte("[")) {
+		return decodeBackupV1(payload)
+	}
+
+	var doc backupDocument
+	var header struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(payload, &header); err != nil {
+		return doc, fmt.Errorf("invalid backup, %v", err)
+	}
+	switch {
+	case header.SchemaVersion > backupSchemaVersion:
+		return doc, fmt.Errorf("backup schema version %d is newer than this brsp supports (%d), upgrade brsp", header.SchemaVersion, backupSchemaVersion)
+	case header.SchemaVersion != backupSchemaVersion:
+		return doc, fmt.Errorf("unsupported backup schema version %d", header.SchemaVersion)
+	}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return doc, fmt.Errorf("invalid backup, %v", err)
+	}
+	for _, item := range doc.Items {
+		if item.Name == "" {
+			return doc, fmt.Errorf("backup contains an item without name")
+		}
+	}
+	return doc, nil
+}
+
+// backupItemV1 is an item of a version 1 backup: an SDK Parameter with KmsKey
+// holding the value read without decryption, or an SDK SecretListEntry with
+// SecretValue.
+type backupItemV1 struct {
+	Name        *string
+	Value       *string
+	SecretValue *string
+	ARN         *string
+
+	Type             string
+	DataType         *string
+	KmsKey           string
+	Version          int64
+	LastModifiedDate *time.Time
+
+	Description     *string
+	KmsKeyId        *string
+	RotationEnabled *bool
+	Tags            []struct {
+		Key   *string
+		Value *string
+	}
+	LastChangedDate *time.Time
+}
+
+func (r backupItemV1) upgrade() (backupDocumentItem, error) {
+	if r.Name == nil {
+		return backupDocumentItem{}, fmt.Errorf("backup contains an item without Name")
+	}
+	item := backupDocumentItem{
+		Name:             *r.Name,
+		Value:            aws.ToString(r.Value),
+		ARN:              aws.ToString(r.ARN),
+		Type:             r.Type,
+		DataType:         aws.ToString(r.DataType),
+		RawValue:         r.KmsKey,
+		Version:          r.Version,
+		LastModifiedDate: r.LastModifiedDate,
+		Description:      aws.ToString(r.Description),
+		KmsKeyId:         aws.ToString(r.KmsKeyId),
+		RotationEnabled:  aws.ToBool(r.RotationEnabled),
+		LastChangedDate:  r.LastChangedDate,
+	}
+	if r.SecretValue != nil {
+		item.Value = *r.SecretValue
+	}
+	for _, tag := range r.Tags {
+		item.Tags = append(item.Tags, backupTag{Key: aws.ToString(tag.Key), Value: aws.ToString(tag.Value)})
+	}
+	return item, nil
+}
+
+func decodeBackupV1(payload []byte) (backupDocument, error) {
+	doc := backupDocument{SchemaVersion: backupSchemaVersion, Items: []backupDocumentItem{}}
+	var records []backupItemV1
+	if err := json.Unmarshal(payload, &records); err != nil {
+		return doc, fmt.Errorf("invalid backup, %v", err)
+	}
+	for _, record := range records {
+		item, err := record.upgrade()
+		if err != nil {
+			return doc, err
+		}
+		if record.SecretValue != nil {
+			doc.Kind = "secrets"
+		} else if doc.Kind == "" {
+			doc.Kind = "parameters"
+		}
+		doc.Items = append(doc.Items, item)
+	}
+	doc.Source = documentSource(doc.Items)
+	return doc, nil
+}
+
+// decodeBackupItem reads an item stored on its own, as in a generation of
+// an incremental backup, written with schemaVersion.
+func decodeBackupItem(raw json.RawMessage, schemaVersion int) (backupDocumentItem, error) {
+	switch schemaVersion {
+	case 0, 1:
+		var record backupItemV1
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return backupDocumentItem{}, err
+		}
+		return record.upgrade()
+	case backupSchemaVersion:
+		var item backupDocumentItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return item, err
+		}
+		if item.Name == "" {
+			return item, fmt.Errorf("backup contains an item without name")
+		}
+		return item, nil
+	default:
+		return backupDocumentItem{}, fmt.Errorf("unsupported backup schema version %d", schemaVersion)
+	}
+}
@@ -0,0 +1,272 @@
+package brsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultOption tells how to reach a HashiCorp Vault KV version 2 secrets
+// engine, authenticating with a token or with AppRole.
+type VaultOption struct {
+	VaultAddr         string `env:"VAULT_ADDR" help:"address of Vault, e.g. https://vault.example.com:8200"`
+	VaultToken        string `env:"VAULT_TOKEN" help:"Vault token (use AppRole if empty)"`
+	VaultRoleId       string `env:"VAULT_ROLE_ID" help:"AppRole role ID"`
+	VaultSecretId     string `env:"VAULT_SECRET_ID" help:"AppRole secret ID"`
+	VaultApproleMount string `default:"approle" help:"path the AppRole auth method is mounted at"`
+	VaultNamespace    string `env:"VAULT_NAMESPACE" help:"Vault Enterprise namespace"`
+	VaultMount        string `default:"secret" help:"path the KV version 2 secrets engine is mounted at"`
+}
+
+// VaultAPI is the part of the Vault KV version 2 API brsp uses, on the
+// secrets engine the client is configured for. Paths are relative to its
+// mount.
+type VaultAPI interface {
+	// ListSecrets returns the paths of the secrets under dir, recursively.
+	ListSecrets(ctx context.Context, dir string) ([]string, error)
+	ReadMetadata(ctx context.Context, path string) (*VaultMetadata, error)
+	// ReadSecret returns the version of the secret at path, or its current
+	// version if version is 0.
+	ReadSecret(ctx context.Context, path string, version int) (*VaultSecret, error)
+	// WriteSecret writes a new version of the secret at path if its current
+	// version is cas, and returns the new version.
+	WriteSecret(ctx context.Context, path string, data map[string]any, cas int) (int, error)
+}
+
+// VaultSecret is a version of a secret.
+type VaultSecret struct {
+	Data     map[string]any `json:"data"`
+	Metadata struct {
+		Version      int       `json:"version"`
+		CreatedTime  time.Time `json:"created_time"`
+		DeletionTime string    `json:"deletion_time"`
+		Destroyed    bool      `json:"destroyed"`
+	} `json:"metadata"`
+}
+
+// VaultMetadata is the metadata of a secret and its versions.
+type VaultMetadata struct {
+	CurrentVersion int                             `json:"current_version"`
+	Versions       map[string]VaultVersionMetadata `json:"versions"`
+}
+
+type VaultVersionMetadata struct {
+	CreatedTime  time.Time `json:"created_time"`
+	DeletionTime string    `json:"deletion_time"`
+	Destroyed    bool      `json:"destroyed"`
+}
+
+// readable tells whether the data of a version can still be read.
+func (v VaultVersionMetadata) readable() bool {
+	return v.DeletionTime == "" && !v.Destroyed
+}
+
+// VaultNotFoundError is returned when a secret or version does not exist.
+type VaultNotFoundError struct {
+	Path string
+}
+
+func (e *VaultNotFoundError) Error() string {
+	return fmt.Sprintf("vault secret %s is not found", e.Path)
+}
+
+// vaultClient talks to the Vault HTTP API, on the secrets engine mounted at
+// --vault-mount. With AppRole, it logs in on the first request.
+type vaultClient struct {
+	opt        VaultOption
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+func newVaultClient(opt VaultOption) *vaultClient {
+	registerSecret(opt.VaultToken)
+	registerSecret(opt.VaultSecretId)
+	return &vaultClient{opt: opt, httpClient: &http.Client{}, token: opt.VaultToken}
+}
+
+// withVault returns a copy of c using the Vault given by opt, unless c
+// already has one or opt has no address.
+func (c *Client) withVault(opt VaultOption) *Client {
+	if c.Vault != nil || opt.VaultAddr == "" {
+		return c
+	}
+	client := *c
+	client.Vault = newVaultClient(opt)
+	return &client
+}
+
+func (v *vaultClient) login(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token != "" {
+		return v.token, nil
+	}
+	if v.opt.VaultRoleId == "" {
+		return "", fmt.Errorf("no Vault credentials, specify --vault-token or --vault-role-id and --vault-secret-id")
+	}
+	var output struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": v.opt.VaultRoleId, "secret_id": v.opt.VaultSecretId}
+	if err := v.do(ctx, "", http.MethodPost, path.Join("auth", v.opt.VaultApproleMount, "login"), nil, body, &output); err != nil {
+		return "", fmt.Errorf("failed to log in to Vault with AppRole, %w", err)
+	}
+	registerSecret(output.Auth.ClientToken)
+	v.token = output.Auth.ClientToken
+	return v.token, nil
+}
+
+// request calls the Vault API at /v1/<apiPath> and decodes the data of the
+// response into output.
+func (v *vaultClient) request(ctx context.Context, method string, apiPath string, query url.Values, input any, output any) error {
+	token, err := v.login(ctx)
+	if err != nil {
+		return err
+	}
+	return v.do(ctx, token, method, apiPath, query, input, output)
+}
+
+// do sends a request to Vault, timing out after --request-timeout like a
+// request to AWS.
+func (v *vaultClient) do(ctx context.Context, token string, method string, apiPath string, query url.Values, input any, output any) error {
+	if timeout := requestTimeout(ctx); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	endpoint := strings.TrimSuffix(v.opt.VaultAddr, "/") + "/v1/" + apiPath
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var body io.Reader
+	if input != nil {
+		data, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.opt.VaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.opt.VaultNamespace)
+	}
+	if input != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return &VaultNotFoundError{Path: apiPath}
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(data, &apiErr)
+		return fmt.Errorf("%s %s returned %s: %s", method, apiPath, resp.Status, strings.Join(apiErr.Errors, ", "))
+	}
+	if output == nil || len(data) == 0 {
+		return nil
+	}
+	// Numbers in secret data are kept as they are rather than as float64.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(output)
+}
+
+func (v *vaultClient) ListSecrets(ctx context.Context, dir string) ([]string, error) {
+	var output struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	err := v.request(ctx, "LIST", path.Join(v.opt.VaultMount, "metadata", dir), nil, nil, &output)
+	var notFound *VaultNotFoundError
+	if errors.As(err, &notFound) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, key := range output.Data.Keys {
+		if !strings.HasSuffix(key, "/") {
+			paths = append(paths, strings.TrimPrefix(path.Join(dir, key), "/"))
+			continue
+		}
+		children, err := v.ListSecrets(ctx, path.Join(dir, key))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, children...)
+	}
+	return paths, nil
+}
+
+func (v *vaultClient) ReadMetadata(ctx context.Context, secretPath string) (*VaultMetadata, error) {
+	var output struct {
+		Data VaultMetadata `json:"data"`
+	}
+	if err := v.request(ctx, http.MethodGet, path.Join(v.opt.VaultMount, "metadata", secretPath), nil, nil, &output); err != nil {
+		return nil, err
+	}
+	return &output.Data, nil
+}
+
+func (v *vaultClient) ReadSecret(ctx context.Context, secretPath string, version int) (*VaultSecret, error) {
+	var query url.Values
+	if version != 0 {
+		query = url.Values{"version": []string{strconv.Itoa(version)}}
+	}
+	var output struct {
+		Data *VaultSecret `json:"data"`
+	}
+	if err := v.request(ctx, http.MethodGet, path.Join(v.opt.VaultMount, "data", secretPath), query, nil, &output); err != nil {
+		return nil, err
+	}
+	if output.Data == nil || output.Data.Data == nil {
+		return nil, &VaultNotFoundError{Path: secretPath}
+	}
+	return output.Data, nil
+}
+
+func (v *vaultClient) WriteSecret(ctx context.Context, secretPath string, data map[string]any, cas int) (int, error) {
+	input := map[string]any{"data": data, "options": map[string]int{"cas": cas}}
+	var output struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+	if err := v.request(ctx, http.MethodPost, path.Join(v.opt.VaultMount, "data", secretPath), nil, input, &output); err != nil {
+		return 0, err
+	}
+	return output.Data.Version, nil
+}
@@ -0,0 +1,52 @@
+package brsp
+
+import (
+	"context"
+	"sync"
+)
+
+// runConcurrently calls fn for every index in [0, n) using at most concurrency
+// goroutines. The first error cancels the remaining calls and is returned.
+// Callers write results into index-addressed slots to keep output order stable.
+func runConcurrently(ctx context.Context, concurrency int, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency = max(min(concurrency, n), 1)
+	indexes := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range n {
+		select {
+		case <-ctx.Done():
+			break feed
+		case indexes <- i:
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}